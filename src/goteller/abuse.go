@@ -0,0 +1,280 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const DEFAULT_ABUSE_WINDOW time.Duration = 10 * time.Second
+const DEFAULT_MAX_MESSAGE_RATE float64 = 50 // Descriptors per second
+const DEFAULT_MAX_DUPLICATE_RATIO float64 = 0.5
+const DEFAULT_MAX_PARSE_ERRORS int = 10
+const DEFAULT_MAX_TTL_VIOLATIONS int = 20
+const DEFAULT_MAX_TTL int = int(DEFAULT_WALK_TTL) // Random walkers live longest
+const DEFAULT_BAN_DURATION time.Duration = time.Hour
+const MIN_DUPLICATE_SAMPLE int = 20 // Descriptors in a window before the duplicate ratio is checked
+const MAX_TRACKED_IDS int = 10000   // Descriptor IDs remembered per neighbor and window to spot duplicates
+
+// Thresholds over which a neighbor is banned. Counts are per Window. Zero
+// fields use the defaults.
+type AbuseLimits struct {
+	Window            time.Duration
+	MaxMessageRate    float64 // Descriptors per second, averaged over Window
+	MaxDuplicateRatio float64 // Share of pings and queries repeating an ID the neighbor already sent
+	MaxParseErrors    int
+	MaxTTL            int // Descriptors whose TTL and hops add up to more violate the TTL limit
+	MaxTTLViolations  int
+	BanDuration       time.Duration
+}
+
+// Accounting of the descriptors received from a neighbor in the current window
+type NeighborStats struct {
+	Addr          ipaddr.IPAddr
+	WindowStart   time.Time
+	Messages      int
+	Duplicates    int
+	ParseErrors   int
+	TTLViolations int
+	seenIDs       map[[16]byte]bool
+}
+
+// Ratio of duplicate pings and queries to all descriptors in the window
+func (stats *NeighborStats) DuplicateRatio() float64 {
+	if stats.Messages == 0 {
+		return 0
+	}
+	return float64(stats.Duplicates) / float64(stats.Messages)
+}
+
+// A temporary ban of an IP address
+type Ban struct {
+	IP     string
+	Reason string
+	Until  time.Time
+}
+
+type ban struct {
+	reason string
+	until  time.Time
+}
+
+// Returns the accounting of every neighbor heard from recently
+func (teller *GoTeller) NeighborStats() []NeighborStats {
+	teller.abuseMutex.Lock()
+	stats := make([]NeighborStats, 0, len(teller.neighborStats))
+	for _, neighbor := range teller.neighborStats {
+		copied := *neighbor
+		copied.seenIDs = nil
+		stats = append(stats, copied)
+	}
+	teller.abuseMutex.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr.String() < stats[j].Addr.String() })
+	return stats
+}
+
+// Returns the bans that haven't expired
+func (teller *GoTeller) Bans() []Ban {
+	teller.abuseMutex.Lock()
+	var bans []Ban
+	now := time.Now()
+	for ip, b := range teller.bans {
+		if now.Before(b.until) {
+			bans = append(bans, Ban{IP: fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3]), Reason: b.reason, Until: b.until})
+		}
+	}
+	teller.abuseMutex.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Lifts the ban of an IP address given as "a.b.c.d"
+func (teller *GoTeller) Unban(ip string) error {
+	addr, err := ipaddr.ParseAddrString(ip + ":0")
+	if err != nil {
+		return err
+	}
+	teller.abuseMutex.Lock()
+	defer teller.abuseMutex.Unlock()
+	if _, ok := teller.bans[addr.IP]; !ok {
+		return fmt.Errorf("%s isn't banned", ip)
+	}
+	delete(teller.bans, addr.IP)
+	for neighbor := range teller.neighborStats {
+		if neighbor.IP == addr.IP { // Start its accounting over
+			delete(teller.neighborStats, neighbor)
+		}
+	}
+	return nil
+}
+
+// Lifts every ban
+func (teller *GoTeller) ClearBans() {
+	teller.abuseMutex.Lock()
+	defer teller.abuseMutex.Unlock()
+	teller.bans = nil
+	teller.neighborStats = nil
+}
+
+// Returns the limits with defaults filled in
+func (teller *GoTeller) abuseLimits() AbuseLimits {
+	limits := teller.AbuseLimits
+	if limits.Window <= 0 {
+		limits.Window = DEFAULT_ABUSE_WINDOW
+	}
+	if limits.MaxMessageRate <= 0 {
+		limits.MaxMessageRate = DEFAULT_MAX_MESSAGE_RATE
+	}
+	if limits.MaxDuplicateRatio <= 0 {
+		limits.MaxDuplicateRatio = DEFAULT_MAX_DUPLICATE_RATIO
+	}
+	if limits.MaxParseErrors <= 0 {
+		limits.MaxParseErrors = DEFAULT_MAX_PARSE_ERRORS
+	}
+	if limits.MaxTTL <= 0 {
+		limits.MaxTTL = DEFAULT_MAX_TTL
+	}
+	if limits.MaxTTLViolations <= 0 {
+		limits.MaxTTLViolations = DEFAULT_MAX_TTL_VIOLATIONS
+	}
+	if limits.BanDuration <= 0 {
+		limits.BanDuration = DEFAULT_BAN_DURATION
+	}
+	return limits
+}
+
+// Counts a descriptor received from a neighbor. Returns false if the neighbor is
+// banned, possibly because of this descriptor, in which case it isn't handled.
+func (teller *GoTeller) accountDescriptor(header messages.DescHeader, from ipaddr.IPAddr) bool {
+	maxTTL := teller.abuseLimits().MaxTTL
+	return teller.account(from, func(stats *NeighborStats) {
+		stats.Messages++
+		if header.PayloadDesc == messages.PING || header.PayloadDesc == messages.QUERY {
+			if stats.seenIDs[header.DescID] {
+				stats.Duplicates++
+			} else if len(stats.seenIDs) < MAX_TRACKED_IDS {
+				stats.seenIDs[header.DescID] = true
+			}
+		}
+		if int(header.TTL)+int(header.Hops) > maxTTL {
+			stats.TTLViolations++
+		}
+	})
+}
+
+// Counts a descriptor from a neighbor that couldn't be parsed
+func (teller *GoTeller) noteParseError(from ipaddr.IPAddr) {
+	teller.account(from, func(stats *NeighborStats) {
+		stats.ParseErrors++
+	})
+}
+
+// Updates a neighbor's accounting and bans it if it is over a limit. Returns
+// false if it is banned.
+func (teller *GoTeller) account(from ipaddr.IPAddr, update func(*NeighborStats)) bool {
+	if teller.DisableAbuseDetection {
+		return true
+	}
+	limits := teller.abuseLimits()
+	now := time.Now()
+	teller.abuseMutex.Lock()
+	if b, ok := teller.bans[from.IP]; ok && now.Before(b.until) {
+		teller.abuseMutex.Unlock()
+		return false
+	}
+	if teller.neighborStats == nil {
+		teller.neighborStats = make(map[ipaddr.IPAddr]*NeighborStats)
+	}
+	stats, ok := teller.neighborStats[from]
+	if !ok || now.Sub(stats.WindowStart) >= limits.Window {
+		stats = &NeighborStats{Addr: from, WindowStart: now, seenIDs: make(map[[16]byte]bool)}
+		teller.neighborStats[from] = stats
+	}
+	update(stats)
+	reason := ""
+	switch {
+	case float64(stats.Messages) > limits.MaxMessageRate*limits.Window.Seconds():
+		reason = "Flooding"
+	case stats.Messages >= MIN_DUPLICATE_SAMPLE && stats.DuplicateRatio() > limits.MaxDuplicateRatio:
+		reason = "Duplicate descriptors"
+	case stats.ParseErrors > limits.MaxParseErrors:
+		reason = "Malformed descriptors"
+	case stats.TTLViolations > limits.MaxTTLViolations:
+		reason = "TTL too high"
+	}
+	if reason == "" {
+		teller.abuseMutex.Unlock()
+		return true
+	}
+	if teller.bans == nil {
+		teller.bans = make(map[[4]byte]ban)
+	}
+	teller.bans[from.IP] = ban{reason: reason, until: now.Add(limits.BanDuration)}
+	delete(teller.neighborStats, from)
+	teller.abuseMutex.Unlock()
+
+	if teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, "Banned "+from.String()+" for "+limits.BanDuration.String()+": "+reason)
+	}
+	teller.removeNeighbor(from)
+	teller.removeLeaf(from) // in ultrapeer.go
+	return false
+}
+
+// True if an IP address is banned
+func (teller *GoTeller) isBanned(ip [4]byte) bool {
+	teller.abuseMutex.Lock()
+	defer teller.abuseMutex.Unlock()
+	b, ok := teller.bans[ip]
+	return ok && time.Now().Before(b.until)
+}
+
+// Tells a banned neighbor why before the connection is closed
+func (teller *GoTeller) sayBye(link *neighborLink) {
+	teller.abuseMutex.Lock()
+	reason := teller.bans[link.peer.IP].reason
+	teller.abuseMutex.Unlock()
+	bye := messages.ByeMsg{Code: messages.BYE_CODE_ABUSE, Message: reason}
+	byeBuffer := bye.ToBytes()
+	header := messages.DescHeader{
+		DescID:      teller.newID(),
+		PayloadDesc: messages.BYE,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(byeBuffer)),
+	}
+	err := link.write(append(header.ToBytes(), byeBuffer...)) // in link.go
+	if err != nil && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, err)
+	}
+}
+
+// A neighbor closing its connection to this servant is no longer a neighbor
+func (teller *GoTeller) onBye(bye messages.ByeMsg, from ipaddr.IPAddr) {
+	if teller.debugFile != nil {
+		fmt.Fprintf(teller.debugFile, "%s said bye: %d %s\n", from.String(), bye.Code, bye.Message)
+	}
+	teller.removeNeighbor(from)
+	teller.removeLeaf(from)
+}
+
+// Forgets expired bans and the accounting of neighbors not heard from for a
+// window
+func (teller *GoTeller) expireAbuse() {
+	window := teller.abuseLimits().Window
+	now := time.Now()
+	teller.abuseMutex.Lock()
+	defer teller.abuseMutex.Unlock()
+	for ip, b := range teller.bans {
+		if !now.Before(b.until) {
+			delete(teller.bans, ip)
+		}
+	}
+	for addr, stats := range teller.neighborStats {
+		if now.Sub(stats.WindowStart) >= window {
+			delete(teller.neighborStats, addr)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kinds of traffic whose bandwidth can be limited
+type TrafficClass int
+
+const (
+	TRAFFIC_UPLOAD   TrafficClass = iota // File bodies served to other servants
+	TRAFFIC_DOWNLOAD                     // File bodies fetched from other servants
+	TRAFFIC_PROTOCOL                     // Descriptors sent to neighbors and over UDP
+	numTrafficClasses
+)
+
+const THROTTLE_CHUNK_SIZE int = 16 * 1024 // Largest read or write passed to a limited connection at once
+const PEER_BUCKET_IDLE_TIMEOUT time.Duration = time.Minute
+
+func (class TrafficClass) String() string {
+	switch class {
+	case TRAFFIC_UPLOAD:
+		return "Upload"
+	case TRAFFIC_DOWNLOAD:
+		return "Download"
+	case TRAFFIC_PROTOCOL:
+		return "Protocol"
+	}
+	return "Unknown"
+}
+
+// Limits a class of traffic to bytesPerSecond in total. 0 removes the limit.
+// Can be changed while the servant runs.
+func (teller *GoTeller) SetBandwidthLimit(class TrafficClass, bytesPerSecond int64) {
+	if class < 0 || class >= numTrafficClasses {
+		return
+	}
+	teller.bandwidthMutex.Lock()
+	defer teller.bandwidthMutex.Unlock()
+	teller.bandwidthLimits[class] = bytesPerSecond
+	if teller.globalBuckets[class] != nil {
+		teller.globalBuckets[class].setRate(bytesPerSecond)
+	}
+}
+
+// Limits a class of traffic to bytesPerSecond with each servant. 0 removes the
+// limit. Can be changed while the servant runs.
+func (teller *GoTeller) SetPeerBandwidthLimit(class TrafficClass, bytesPerSecond int64) {
+	if class < 0 || class >= numTrafficClasses {
+		return
+	}
+	teller.bandwidthMutex.Lock()
+	defer teller.bandwidthMutex.Unlock()
+	teller.peerBandwidthLimits[class] = bytesPerSecond
+	for key, bucket := range teller.peerBuckets {
+		if key.class == class {
+			bucket.setRate(bytesPerSecond)
+		}
+	}
+}
+
+// Returns the total and per servant limits of a class of traffic, in bytes per
+// second. 0 means unlimited.
+func (teller *GoTeller) BandwidthLimit(class TrafficClass) (int64, int64) {
+	if class < 0 || class >= numTrafficClasses {
+		return 0, 0
+	}
+	teller.bandwidthMutex.Lock()
+	defer teller.bandwidthMutex.Unlock()
+	return teller.bandwidthLimits[class], teller.peerBandwidthLimits[class]
+}
+
+// Token bucket holding up to a second's worth of bytes
+type tokenBucket struct {
+	rate     int64 // Bytes per second. 0 is unlimited
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+	mutex    sync.Mutex
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: now, lastUsed: now}
+}
+
+func (bucket *tokenBucket) setRate(rate int64) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.refill(time.Now())
+	if bucket.rate <= 0 {
+		bucket.tokens = float64(rate) // Unlimited buckets start over full
+	}
+	bucket.rate = rate
+	if bucket.tokens > float64(rate) {
+		bucket.tokens = float64(rate)
+	}
+}
+
+// Must be called with mutex held
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * float64(bucket.rate)
+	if bucket.tokens > float64(bucket.rate) {
+		bucket.tokens = float64(bucket.rate)
+	}
+	bucket.last = now
+}
+
+// Takes n bytes' worth of tokens, going into debt if there aren't enough, and
+// returns how long to wait until the debt is paid off
+func (bucket *tokenBucket) take(n int) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	now := time.Now()
+	bucket.lastUsed = now
+	if bucket.rate <= 0 {
+		return 0
+	}
+	bucket.refill(now)
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / float64(bucket.rate) * float64(time.Second))
+}
+
+type peerBucketKey struct {
+	class TrafficClass
+	ip    [4]byte
+}
+
+// Waits until n bytes of a class of traffic with a servant are within the
+// limits
+func (teller *GoTeller) throttle(class TrafficClass, peer ipaddr.IPAddr, n int) {
+	teller.bandwidthMutex.Lock()
+	if teller.globalBuckets[class] == nil {
+		teller.globalBuckets[class] = newTokenBucket(teller.bandwidthLimits[class])
+	}
+	global := teller.globalBuckets[class]
+	if teller.peerBuckets == nil {
+		teller.peerBuckets = make(map[peerBucketKey]*tokenBucket)
+	}
+	key := peerBucketKey{class: class, ip: peer.IP}
+	perPeer, ok := teller.peerBuckets[key]
+	if !ok {
+		perPeer = newTokenBucket(teller.peerBandwidthLimits[class])
+		teller.peerBuckets[key] = perPeer
+	}
+	teller.bandwidthMutex.Unlock()
+	wait := global.take(n)
+	if peerWait := perPeer.take(n); peerWait > wait {
+		wait = peerWait
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Forgets the buckets of servants that haven't been sent to or received from
+// for a while
+func (teller *GoTeller) expirePeerBuckets() {
+	now := time.Now()
+	teller.bandwidthMutex.Lock()
+	defer teller.bandwidthMutex.Unlock()
+	for key, bucket := range teller.peerBuckets {
+		bucket.mutex.Lock()
+		idle := now.Sub(bucket.lastUsed) >= PEER_BUCKET_IDLE_TIMEOUT
+		bucket.mutex.Unlock()
+		if idle {
+			delete(teller.peerBuckets, key)
+		}
+	}
+}
+
+// Writer whose writes are limited to a class of traffic's bandwidth
+type throttledWriter struct {
+	writer io.Writer
+	teller *GoTeller
+	class  TrafficClass
+	peer   ipaddr.IPAddr
+}
+
+func (throttled *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > THROTTLE_CHUNK_SIZE {
+			chunk = chunk[:THROTTLE_CHUNK_SIZE]
+		}
+		throttled.teller.throttle(throttled.class, throttled.peer, len(chunk))
+		n, err := throttled.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Reader whose reads are limited to a class of traffic's bandwidth
+type throttledReader struct {
+	reader io.Reader
+	teller *GoTeller
+	class  TrafficClass
+	peer   ipaddr.IPAddr
+}
+
+func (throttled *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > THROTTLE_CHUNK_SIZE {
+		p = p[:THROTTLE_CHUNK_SIZE]
+	}
+	n, err := throttled.reader.Read(p)
+	if n > 0 {
+		throttled.teller.throttle(throttled.class, throttled.peer, n)
+	}
+	return n, err
+}
@@ -0,0 +1,190 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"bufio"
+	"compress/flate"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+const DEFLATE_ENCODING string = "deflate"
+const DEFLATE_LEVEL int = 7 // Lower levels send sync flushed small batches as stored blocks, larger than uncompressed
+
+// Traffic of the deflate compressed connections with a neighbor. Raw counts are
+// of descriptor bytes, wire counts of the compressed bytes actually sent.
+type CompressionStats struct {
+	BytesSent         int64
+	WireBytesSent     int64
+	BytesReceived     int64
+	WireBytesReceived int64
+}
+
+// Returns compressed size over uncompressed size of the descriptors sent, or 1
+// if none were sent
+func (stats CompressionStats) SendRatio() float64 {
+	if stats.BytesSent == 0 {
+		return 1
+	}
+	return float64(stats.WireBytesSent) / float64(stats.BytesSent)
+}
+
+// Returns compressed size over uncompressed size of the descriptors received,
+// or 1 if none were received
+func (stats CompressionStats) ReceiveRatio() float64 {
+	if stats.BytesReceived == 0 {
+		return 1
+	}
+	return float64(stats.WireBytesReceived) / float64(stats.BytesReceived)
+}
+
+// Returns the compression stats of each servant this one has had a deflate
+// compressed connection with
+func (teller *GoTeller) CompressionStats() map[ipaddr.IPAddr]CompressionStats {
+	teller.compressionMutex.Lock()
+	defer teller.compressionMutex.Unlock()
+	stats := make(map[ipaddr.IPAddr]CompressionStats, len(teller.compressionStats))
+	for peer, peerStats := range teller.compressionStats {
+		stats[peer] = *peerStats
+	}
+	return stats
+}
+
+// Which directions of a connection are deflate compressed, as negotiated in its
+// 0.6 handshake
+type connEncoding struct {
+	in  bool // Descriptors received
+	out bool // Descriptors sent
+}
+
+// True if the handshake headers of the other servant accept deflate
+func (teller *GoTeller) acceptsDeflate(headers textproto.MIMEHeader) bool {
+	if teller.DisableCompression {
+		return false
+	}
+	for _, encoding := range strings.Split(headers.Get("Accept-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(encoding), DEFLATE_ENCODING) {
+			return true
+		}
+	}
+	return false
+}
+
+// True if the handshake headers of the other servant say it compresses what it
+// sends
+func contentDeflated(headers textproto.MIMEHeader) bool {
+	return strings.EqualFold(strings.TrimSpace(headers.Get("Content-Encoding")), DEFLATE_ENCODING)
+}
+
+// Replaces the reader and writer of connIO with deflate streams in the
+// directions that are compressed. Returns the compressing writer, which must be
+// closed to end the stream, or nil if sent descriptors aren't compressed.
+func (teller *GoTeller) deflateStreams(connIO *bufio.ReadWriter, peer ipaddr.IPAddr, encoding connEncoding) *deflateWriter {
+	if !encoding.in && !encoding.out {
+		return nil
+	}
+	stats := teller.peerCompressionStats(peer)
+	if encoding.in {
+		wire := &countingReader{Reader: connIO.Reader, count: teller.counter(&stats.WireBytesReceived)}
+		raw := &countingReader{Reader: flate.NewReader(wire), count: teller.counter(&stats.BytesReceived)}
+		connIO.Reader = bufio.NewReader(raw)
+	}
+	if !encoding.out {
+		return nil
+	}
+	wire := &countingWriter{Writer: connIO.Writer, count: teller.counter(&stats.WireBytesSent)}
+	compressor, _ := flate.NewWriter(wire, DEFLATE_LEVEL) // Only fails for a bad level
+	writer := &deflateWriter{compressor: compressor, buffer: connIO.Writer, count: teller.counter(&stats.BytesSent)}
+	connIO.Writer = bufio.NewWriter(writer)
+	return writer
+}
+
+func (teller *GoTeller) peerCompressionStats(peer ipaddr.IPAddr) *CompressionStats {
+	teller.compressionMutex.Lock()
+	defer teller.compressionMutex.Unlock()
+	if teller.compressionStats == nil {
+		teller.compressionStats = make(map[ipaddr.IPAddr]*CompressionStats)
+	}
+	stats, ok := teller.compressionStats[peer]
+	if !ok {
+		stats = new(CompressionStats)
+		teller.compressionStats[peer] = stats
+	}
+	return stats
+}
+
+// Returns a function adding to one of the counts of a CompressionStats
+func (teller *GoTeller) counter(count *int64) func(int) {
+	return func(n int) {
+		teller.compressionMutex.Lock()
+		*count += int64(n)
+		teller.compressionMutex.Unlock()
+	}
+}
+
+// Compresses everything written to a link as a single stream, so descriptors
+// are compressed against those sent before them. Every write is a batch of
+// descriptors (as flushed from the connection's bufio.Writer), which is sync
+// flushed so the other servant can handle it right away.
+type deflateWriter struct {
+	compressor *flate.Writer
+	buffer     *bufio.Writer // Of the connection, under the compressor
+	count      func(int)
+}
+
+func (writer *deflateWriter) Write(p []byte) (int, error) {
+	n, err := writer.compressor.Write(p)
+	writer.count(n)
+	if err == nil {
+		err = writer.compressor.Flush()
+	}
+	if err == nil {
+		err = writer.buffer.Flush()
+	}
+	return n, err
+}
+
+// Ends the compressed stream so the other servant reads a clean EOF
+func (writer *deflateWriter) Close() error {
+	err := writer.compressor.Close()
+	if err == nil {
+		err = writer.buffer.Flush()
+	}
+	return err
+}
+
+// A connection whose sent descriptors are compressed. Closing it ends the
+// compressed stream first.
+type deflateConn struct {
+	net.Conn
+	writer *deflateWriter
+}
+
+func (conn *deflateConn) Close() error {
+	conn.writer.Close()
+	return conn.Conn.Close()
+}
+
+type countingReader struct {
+	io.Reader
+	count func(int)
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.count(n)
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count func(int)
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.Writer.Write(p)
+	writer.count(n)
+	return n, err
+}
@@ -0,0 +1,416 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PARTIAL_SUFFIX string = ".part"
+const RESUME_OVERLAP int64 = 512 // Bytes requested again and compared when resuming
+
+// Describes a file to fetch from another servant. The source is given either
+// by Result (a QueryResult received in an OnHit callback) or by Addr, FileIndex
+// and Filename. The destination is either Writer or Path. If a URN is known,
+// the download fails if the contents received don't match it.
+type DownloadRequest struct {
+	Addr       string                           // "IP:Port" address of the servant sharing the file
+	FileIndex  uint32                           // File index given in the servant's query hit
+	Filename   string                           // Filename given in the servant's query hit
+	URN        string                           // Expected "urn:sha1:" URN of the contents. If Filename is empty, the file is requested by URN
+	Result     *QueryResult                     // If set, overrides Addr, FileIndex, Filename and URN
+	Writer     io.Writer                        // Destination of the file's contents
+	Path       string                           // If Writer is nil, the file is created (or truncated) at Path
+	Resume     bool                             // Keep partial data at Path + PARTIAL_SUFFIX and continue from it. Requires Path
+	OnProgress func(written int64, total int64) // Optional. total is -1 if the servant didn't give a length
+}
+
+// Outcome of a call to GoTeller.Download
+type DownloadResult struct {
+	Addr         ipaddr.IPAddr
+	FileIndex    uint32
+	Filename     string
+	URN          string      // URN of the contents, as verified or given by the servant
+	StatusCode   int         // Status code of the servant's HTTP response
+	Header       http.Header // Headers of the servant's HTTP response
+	Size         int64       // Length of the whole file given by the servant. -1 if unknown
+	Offset       int64       // Number of bytes already downloaded by an earlier, resumed attempt
+	BytesWritten int64       // Number of bytes written to the destination by this attempt
+	Duration     time.Duration
+}
+
+// Fetches a file directly from another servant. Blocks until the file has been
+// written to the destination, the servant fails to deliver it or ctx is done.
+// A non 200 response is returned as an error along with a non nil result.
+func (teller *GoTeller) Download(ctx context.Context, dreq DownloadRequest) (*DownloadResult, error) {
+	result := &DownloadResult{Size: -1}
+	err := dreq.resolve(result)
+	if err != nil {
+		return nil, err
+	}
+	if dreq.Writer == nil && dreq.Path == "" {
+		return nil, fmt.Errorf("Must set either Writer or Path on DownloadRequest")
+	}
+	to, filename := result.Addr, result.Filename
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	if dreq.Resume {
+		if dreq.Path == "" {
+			return nil, fmt.Errorf("Must set Path on DownloadRequest to resume downloads")
+		}
+		err = teller.resumeDownload(ctx, dreq, result)
+		return result, err
+	}
+
+	res, err := teller.openRequest(ctx, to, requestPath(result.FileIndex, filename, result.URN), nil)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	result.StatusCode = res.StatusCode
+	result.Header = res.Header
+	result.Size = res.ContentLength
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("Servant at %s responded to request for \"%s\" with status \"%s\"", to, filename, res.Status)
+	}
+	err = checkContentURN(result, res)
+	if err != nil {
+		return result, err
+	}
+
+	writer := dreq.Writer
+	if writer == nil {
+		file, err := os.Create(dreq.Path)
+		if err != nil {
+			return result, err
+		}
+		defer file.Close()
+		writer = file
+	}
+	hash := sha1.New()
+	err = copyBody(ctx, dreq, io.MultiWriter(writer, hash), res.Body, result)
+	if err == nil && result.URN != "" {
+		if urn := messages.SHA1URN(hash.Sum(nil)); urn != result.URN {
+			err = fmt.Errorf("Contents of \"%s\" from %s have URN %s instead of %s", filename, to, urn, result.URN)
+		}
+	}
+	return result, err
+}
+
+// Takes the URN given by the servant if none is expected, and otherwise checks
+// that the servant's URN matches
+func checkContentURN(result *DownloadResult, res *http.Response) error {
+	contentURN := res.Header.Get("X-Gnutella-Content-URN")
+	if !messages.IsSHA1URN(contentURN) {
+		return nil
+	}
+	contentURN = messages.NormalizeURN(contentURN)
+	if result.URN == "" {
+		result.URN = contentURN
+	} else if contentURN != result.URN {
+		return fmt.Errorf("Servant at %s is sharing %s as \"%s\" instead of %s", result.Addr, contentURN, result.Filename, result.URN)
+	}
+	return nil
+}
+
+// Checks the contents of file against the expected URN, truncating it if they
+// don't match so that it isn't resumed
+func verifyFileURN(file *os.File, result *DownloadResult) error {
+	if result.URN == "" {
+		return nil
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	urn, err := messages.ComputeSHA1URN(file)
+	if err != nil {
+		return err
+	}
+	if urn != result.URN {
+		file.Truncate(0)
+		return fmt.Errorf("Contents of \"%s\" from %s have URN %s instead of %s", result.Filename, result.Addr, urn, result.URN)
+	}
+	return nil
+}
+
+// Continues a download from the data kept in the partial file by an earlier
+// attempt. The last RESUME_OVERLAP bytes already downloaded are requested again
+// and compared with the partial file so that a file which changed at the
+// servant isn't spliced onto stale data. If they differ, the partial file is
+// emptied and the whole file downloaded again. The partial file is renamed to
+// dreq.Path once complete.
+func (teller *GoTeller) resumeDownload(ctx context.Context, dreq DownloadRequest, result *DownloadResult) error {
+	partialPath := dreq.Path + PARTIAL_SUFFIX
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	verifyFrom := offset - RESUME_OVERLAP
+	if verifyFrom < 0 {
+		verifyFrom = 0
+	}
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", verifyFrom)}}
+	}
+
+	res, err := teller.openRequest(ctx, result.Addr, requestPath(result.FileIndex, result.Filename, result.URN), header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	result.StatusCode = res.StatusCode
+	result.Header = res.Header
+	result.Size = res.ContentLength
+	err = checkContentURN(result, res)
+	if err != nil {
+		return err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK: // Servant doesn't support ranges. Start over
+		offset = 0
+		err = file.Truncate(0)
+	case http.StatusPartialContent:
+		var start int64
+		start, _, result.Size, err = parseContentRange(res.Header.Get("Content-Range"))
+		if err == nil && start != verifyFrom {
+			err = fmt.Errorf("Servant at %s sent range starting at %d instead of %d", result.Addr, start, verifyFrom)
+		}
+		var matched bool
+		if err == nil {
+			matched, err = verifyOverlap(file, res.Body, verifyFrom, offset-verifyFrom)
+		}
+		if err == nil && !matched {
+			// The file changed at the servant, so none of the partial file can be
+			// trusted. Start over from the beginning.
+			res.Body.Close()
+			err = file.Truncate(0)
+			if err != nil {
+				return err
+			}
+			file.Close()
+			return teller.resumeDownload(ctx, dreq, result)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, _, size, perr := parseContentRange(res.Header.Get("Content-Range"))
+		if perr != nil || size != offset {
+			return fmt.Errorf("Servant at %s couldn't satisfy range for \"%s\" starting at %d", result.Addr, result.Filename, verifyFrom)
+		}
+		// Partial file already holds the whole file
+		result.Size = size
+		result.Offset = offset
+		err = verifyFileURN(file, result)
+		if err != nil {
+			return err
+		}
+		file.Close()
+		return os.Rename(partialPath, dreq.Path)
+	default:
+		return fmt.Errorf("Servant at %s responded to request for \"%s\" with status \"%s\"", result.Addr, result.Filename, res.Status)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	result.Offset = offset
+
+	err = copyBody(ctx, dreq, file, res.Body, result)
+	if err != nil {
+		return err
+	}
+	err = verifyFileURN(file, result)
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(partialPath, dreq.Path)
+}
+
+// Reads n bytes from body and checks that they match the file's data at
+// offset. Returns false if they don't.
+func verifyOverlap(file *os.File, body io.Reader, offset int64, n int64) (bool, error) {
+	if n == 0 {
+		return true, nil
+	}
+	expected := make([]byte, n)
+	_, err := file.ReadAt(expected, offset)
+	if err != nil {
+		return false, err
+	}
+	received := make([]byte, n)
+	_, err = io.ReadFull(body, received)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(expected, received), nil
+}
+
+// Copies a response body to writer, updating the result and reporting progress
+func copyBody(ctx context.Context, dreq DownloadRequest, writer io.Writer, body io.Reader, result *DownloadResult) error {
+	if dreq.OnProgress != nil {
+		writer = &progressWriter{writer: writer, written: result.Offset, total: result.Size, onProgress: dreq.OnProgress}
+	}
+	var err error
+	result.BytesWritten, err = io.Copy(writer, body)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil && result.Size >= 0 && result.Offset+result.BytesWritten != result.Size {
+		err = fmt.Errorf("Received %d out of %d bytes of \"%s\" from %s", result.Offset+result.BytesWritten, result.Size, result.Filename, result.Addr)
+	}
+	return err
+}
+
+// Fills in the result's source from the request
+func (dreq *DownloadRequest) resolve(result *DownloadResult) error {
+	if dreq.Result != nil {
+		result.Addr = dreq.Result.addr
+		result.FileIndex = dreq.Result.fileIndex
+		result.Filename = dreq.Result.filename
+		result.URN = dreq.Result.urn
+		return nil
+	}
+	if dreq.Addr == "" {
+		return fmt.Errorf("Must set either Result or Addr on DownloadRequest")
+	}
+	if dreq.URN != "" && !messages.IsSHA1URN(dreq.URN) {
+		return fmt.Errorf("URN on DownloadRequest \"%s\" must be a valid urn:sha1: URN", dreq.URN)
+	}
+	addr, err := ipaddr.ParseAddrString(dreq.Addr)
+	if err != nil {
+		return err
+	}
+	result.Addr = *addr
+	result.FileIndex = dreq.FileIndex
+	result.Filename = dreq.Filename
+	result.URN = messages.NormalizeURN(dreq.URN)
+	return nil
+}
+
+// Returns the path to request a file at. Files without a filename are requested
+// by URN.
+func requestPath(fileIndex uint32, filename string, urn string) string {
+	if filename == "" && urn != "" {
+		return N2R_PATH + "?" + urn
+	}
+	return fmt.Sprintf("/get/%d/%s", fileIndex, filename)
+}
+
+// Sends a GET request with the given extra headers (may be nil) for path and
+// returns the servant's response. The connection is closed once the response
+// body is closed or ctx is done.
+func (teller *GoTeller) openRequest(ctx context.Context, to ipaddr.IPAddr, path string, header http.Header) (*http.Response, error) {
+	if teller.isBlocked(to) { // in ipfilter.go
+		return nil, fmt.Errorf("%s is blocked by the IP filter or banned", to.String())
+	}
+	endpoint := to.String()
+	req, err := http.NewRequest("GET", "http://"+endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", USER_AGENT)
+	id := teller.servantGUID() // in push.go
+	req.Header.Set(SERVANT_ID_HEADER, strings.ToUpper(hex.EncodeToString(id[:])))
+	teller.addQueueHeaders(req, to, path) // in uploadqueue.go
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	// The file index is only used to push to firewalled servants
+	var fileIndex uint32
+	fmt.Sscanf(path, "/get/%d/", &fileIndex)
+	conn, reader, err := teller.dialServant(ctx, to, fileIndex) // in push.go
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() { // Unblocks any pending reads once ctx is done
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	closeConn := func() {
+		once.Do(func() {
+			close(done)
+			conn.Close()
+		})
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		closeConn()
+		return nil, err
+	}
+	res, err := http.ReadResponse(reader, req)
+	if err == nil && teller.answerRequestChallenge(req, res) { // in private.go
+		// Ask again over the same connection with proof of membership in the private network
+		res.Body.Close()
+		err = req.Write(conn)
+		if err == nil {
+			res, err = http.ReadResponse(reader, req)
+		}
+	}
+	if err != nil {
+		closeConn()
+		return nil, err
+	}
+	teller.noteQueueResponse(res, to, path)
+	body := &throttledReader{reader: res.Body, teller: teller, class: TRAFFIC_DOWNLOAD, peer: to} // in bandwidth.go
+	res.Body = &connBody{ReadCloser: readCloser{body, res.Body}, closeConn: closeConn}
+	return res, nil
+}
+
+// Response body that also closes the underlying connection
+type connBody struct {
+	io.ReadCloser
+	closeConn func()
+}
+
+func (body *connBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.closeConn()
+	return err
+}
+
+type progressWriter struct {
+	writer     io.Writer
+	written    int64
+	total      int64
+	onProgress func(int64, int64)
+}
+
+func (pw *progressWriter) Write(buffer []byte) (int, error) {
+	n, err := pw.writer.Write(buffer)
+	pw.written += int64(n)
+	pw.onProgress(pw.written, pw.total)
+	return n, err
+}
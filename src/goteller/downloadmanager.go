@@ -0,0 +1,611 @@
+package goteller
+
+import (
+	"../messages"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_MAX_DOWNLOADS int = 4
+const DEFAULT_MAX_DOWNLOADS_PER_HOST int = 1
+const DEFAULT_DOWNLOAD_RETRIES int = 5 // Retries after the first failed attempt
+const DOWNLOAD_RETRY_BACKOFF time.Duration = 2 * time.Second
+const MAX_DOWNLOAD_RETRY_BACKOFF time.Duration = 2 * time.Minute
+
+type DownloadState int
+
+const (
+	DOWNLOAD_QUEUED    DownloadState = iota // Waiting for a free download slot
+	DOWNLOAD_ACTIVE                         // Transferring from one of its sources
+	DOWNLOAD_WAITING                        // Waiting to retry after a failed attempt, or to ask again a servant that queued the request
+	DOWNLOAD_PAUSED                         // Paused with PauseDownload. Partial data is kept
+	DOWNLOAD_COMPLETE                       // Written to its path
+	DOWNLOAD_FAILED                         // Gave up after running out of retries
+	DOWNLOAD_CANCELLED                      // Cancelled with CancelDownload. Partial data is removed
+)
+
+func (state DownloadState) String() string {
+	switch state {
+	case DOWNLOAD_QUEUED:
+		return "queued"
+	case DOWNLOAD_ACTIVE:
+		return "active"
+	case DOWNLOAD_WAITING:
+		return "waiting"
+	case DOWNLOAD_PAUSED:
+		return "paused"
+	case DOWNLOAD_COMPLETE:
+		return "complete"
+	case DOWNLOAD_FAILED:
+		return "failed"
+	case DOWNLOAD_CANCELLED:
+		return "cancelled"
+	}
+	return fmt.Sprintf("DownloadState(%d)", int(state))
+}
+
+// A servant known to share the file of a managed download
+type DownloadSource struct {
+	Addr      string // "IP:Port" address of the servant
+	FileIndex uint32
+	Filename  string
+	URN       string // "urn:sha1:" URN of the file if known from a query hit
+	Size      int64  // Length of the file if known from a query hit, otherwise 0
+}
+
+// Snapshot of a download in the download manager's queue
+type ManagedDownload struct {
+	ID          uint64
+	Path        string
+	Sources     []DownloadSource
+	State       DownloadState
+	Attempts    int       // Number of failed attempts so far
+	Written     int64     // Bytes of the file downloaded so far
+	Size        int64     // Length of the file. -1 until a servant gives it
+	LastError   string    // Error of the last failed attempt
+	NextAttempt time.Time // When a DOWNLOAD_WAITING download will be retried
+	QueuedAt    int       // Place in the upload queue of the servant that queued the request, 0 if it wasn't queued
+}
+
+// Book keeping for a download. Guarded by teller.downloadsMutex
+type managedDownload struct {
+	ManagedDownload
+	sourceIdx int                // Index of the source to try next
+	hosts     []string           // Addresses of the sources in use while active
+	cancel    context.CancelFunc // Stops the active attempt
+	stopState DownloadState      // State to move to once the active attempt stops
+}
+
+// Adds a download to the download manager's queue and returns its ID. The file
+// is fetched from one of the given sources at a time, moving on to the next
+// one after a failed attempt. If there are several sources which all give the
+// same Size and SHA1 URN, the file is instead swarmed from all of them at once
+// (see SwarmDownload). Downloads with a URN are verified against it. The manager limits the number of active downloads to
+// MaxDownloads overall and MaxDownloadsPerHost per source. If a download that
+// hasn't finished already has the path or the URN of one of the sources, the
+// sources are added to it and its ID is returned instead. A download active
+// from a single source is then started again swarmed if it can be.
+func (teller *GoTeller) EnqueueDownload(path string, sources ...DownloadSource) (uint64, error) {
+	if path == "" {
+		return 0, fmt.Errorf("Must give a path to download to")
+	}
+	if len(sources) == 0 {
+		return 0, fmt.Errorf("Must give at least one source for \"%s\"", path)
+	}
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	teller.initDownloads()
+	if d := teller.unfinishedDownload(path, sources); d != nil {
+		if d.Path == path && !sameFile(d.Sources[0].URN, sources[0].URN) {
+			return 0, fmt.Errorf("A different file is already being downloaded to \"%s\"", path)
+		}
+		for _, source := range sources {
+			d.addSource(source)
+		}
+		d.restartToSwarm()
+		teller.saveDownloads()
+		teller.scheduleDownloads()
+		return d.ID, nil
+	}
+	teller.lastDownloadID++
+	d := &managedDownload{
+		ManagedDownload: ManagedDownload{
+			ID:      teller.lastDownloadID,
+			Path:    path,
+			Sources: append([]DownloadSource(nil), sources...),
+			State:   DOWNLOAD_QUEUED,
+			Size:    -1,
+		},
+	}
+	teller.downloads[d.ID] = d
+	teller.saveDownloads()
+	teller.scheduleDownloads()
+	return d.ID, nil
+}
+
+// Adds an alternate source to a download that hasn't completed yet
+func (teller *GoTeller) AddDownloadSource(id uint64, source DownloadSource) error {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	d, err := teller.findDownload(id)
+	if err != nil {
+		return err
+	}
+	if d.addSource(source) {
+		d.restartToSwarm()
+		teller.saveDownloads()
+		teller.scheduleDownloads()
+	}
+	return nil
+}
+
+// Adds the source to the download unless it already has it. Returns false if
+// it did.
+func (d *managedDownload) addSource(source DownloadSource) bool {
+	for _, known := range d.Sources {
+		if known == source {
+			return false
+		}
+	}
+	d.Sources = append(d.Sources, source)
+	return true
+}
+
+// Stops an active download from a single source once it has enough sources to
+// be swarmed, so that it is started again from all of them. The data
+// downloaded so far is kept. Must be called with downloadsMutex held.
+func (d *managedDownload) restartToSwarm() {
+	if d.State == DOWNLOAD_ACTIVE && d.stopState == DOWNLOAD_ACTIVE && len(d.hosts) == 1 && d.canSwarm() {
+		d.stopState = DOWNLOAD_QUEUED
+		d.cancel()
+	}
+}
+
+// True once the download won't be attempted again
+func (d *managedDownload) finished() bool {
+	return d.State == DOWNLOAD_COMPLETE || d.State == DOWNLOAD_FAILED || d.State == DOWNLOAD_CANCELLED
+}
+
+// Returns the download that hasn't finished yet with the path, or with the URN
+// of one of the sources, or nil if there is none. Must be called with
+// downloadsMutex held.
+func (teller *GoTeller) unfinishedDownload(path string, sources []DownloadSource) *managedDownload {
+	var found *managedDownload
+	for _, d := range teller.downloads {
+		if d.finished() {
+			continue
+		}
+		if d.Path == path {
+			return d
+		}
+		for _, source := range sources {
+			if source.URN != "" && source.URN == d.Sources[0].URN && (found == nil || d.ID < found.ID) {
+				found = d
+			}
+		}
+	}
+	return found
+}
+
+// True unless the URNs are both known and differ
+func sameFile(urn1 string, urn2 string) bool {
+	return urn1 == "" || urn2 == "" || urn1 == urn2
+}
+
+// Returns the path in dir that a download from source is written to. The path
+// of an unfinished download with the same URN is reused, so that its sources
+// can be swarmed. Otherwise a number is added to the name if the path is
+// already taken by a file or another download.
+func (teller *GoTeller) downloadPathFor(dir string, source DownloadSource) string {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	if d := teller.unfinishedDownload("", []DownloadSource{source}); d != nil {
+		return d.Path
+	}
+	name := source.Filename
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	path := filepath.Join(dir, name)
+	for i := 1; teller.pathTaken(path); i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+	return path
+}
+
+// True if a file, partial file or download already has the path. Must be
+// called with downloadsMutex held.
+func (teller *GoTeller) pathTaken(path string) bool {
+	for _, d := range teller.downloads {
+		if d.Path == path {
+			return true
+		}
+	}
+	for _, taken := range []string{path, path + PARTIAL_SUFFIX} {
+		if _, err := os.Lstat(taken); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops a download, keeping the data downloaded so far, until ResumeDownload
+func (teller *GoTeller) PauseDownload(id uint64) error {
+	return teller.stopDownload(id, DOWNLOAD_PAUSED)
+}
+
+// Stops a download and removes the data downloaded so far
+func (teller *GoTeller) CancelDownload(id uint64) error {
+	return teller.stopDownload(id, DOWNLOAD_CANCELLED)
+}
+
+// Queues a paused or failed download again. Failed downloads get a fresh set
+// of retries.
+func (teller *GoTeller) ResumeDownload(id uint64) error {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	d, err := teller.findDownload(id)
+	if err != nil {
+		return err
+	}
+	if d.State != DOWNLOAD_PAUSED && d.State != DOWNLOAD_FAILED {
+		return fmt.Errorf("Download %d is %s and can't be resumed", id, d.State)
+	}
+	d.State = DOWNLOAD_QUEUED
+	d.Attempts = 0
+	teller.saveDownloads()
+	teller.scheduleDownloads()
+	return nil
+}
+
+// Returns a snapshot of every download known to the download manager, ordered
+// by ID
+func (teller *GoTeller) ListDownloads() []ManagedDownload {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	list := make([]ManagedDownload, 0, len(teller.downloads))
+	for _, d := range teller.downloads {
+		list = append(list, d.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Removes completed, failed and cancelled downloads from the download manager
+func (teller *GoTeller) ClearFinishedDownloads() {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	for id, d := range teller.downloads {
+		if d.State == DOWNLOAD_COMPLETE || d.State == DOWNLOAD_FAILED || d.State == DOWNLOAD_CANCELLED {
+			delete(teller.downloads, id)
+		}
+	}
+	teller.saveDownloads()
+}
+
+// Sets a callback run whenever a managed download completes or fails for good.
+// err is nil if the download completed.
+func (teller *GoTeller) OnDownloadDone(doneFunc func(ManagedDownload, error)) {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	teller.downloadDoneFunc = doneFunc
+}
+
+// Sets the file in which the download manager's queue is kept, so that it
+// survives restarts, and loads any downloads already saved in it. Downloads
+// that were active when the queue was saved are queued again and resume from
+// their partial files.
+func (teller *GoTeller) SetDownloadStateFile(path string) error {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	teller.initDownloads()
+	teller.downloadStateFile = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved []ManagedDownload
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return err
+	}
+	for _, s := range saved {
+		if s.State == DOWNLOAD_ACTIVE || s.State == DOWNLOAD_WAITING {
+			s.State = DOWNLOAD_QUEUED
+		}
+		if s.ID > teller.lastDownloadID {
+			teller.lastDownloadID = s.ID
+		}
+		teller.downloads[s.ID] = &managedDownload{ManagedDownload: s}
+	}
+	teller.scheduleDownloads()
+	return nil
+}
+
+func (teller *GoTeller) initDownloads() {
+	if teller.downloads == nil {
+		teller.downloads = make(map[uint64]*managedDownload)
+		teller.activeHosts = make(map[string]int)
+	}
+}
+
+func (teller *GoTeller) findDownload(id uint64) (*managedDownload, error) {
+	if d, ok := teller.downloads[id]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("No download with ID %d", id)
+}
+
+func (teller *GoTeller) stopDownload(id uint64, state DownloadState) error {
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	d, err := teller.findDownload(id)
+	if err != nil {
+		return err
+	}
+	switch d.State {
+	case DOWNLOAD_ACTIVE:
+		d.stopState = state
+		d.cancel() // runDownload moves it to state once the attempt stops
+		return nil
+	case DOWNLOAD_QUEUED, DOWNLOAD_WAITING, DOWNLOAD_PAUSED:
+		if state == DOWNLOAD_CANCELLED {
+			os.Remove(d.Path + PARTIAL_SUFFIX)
+		}
+		d.State = state
+		teller.saveDownloads()
+		return nil
+	}
+	return fmt.Errorf("Download %d is already %s", id, d.State)
+}
+
+func (d *managedDownload) snapshot() ManagedDownload {
+	s := d.ManagedDownload
+	s.Sources = append([]DownloadSource(nil), d.Sources...)
+	return s
+}
+
+// Starts as many queued downloads as the concurrency limits allow. Must be
+// called with downloadsMutex held.
+func (teller *GoTeller) scheduleDownloads() {
+	maxDownloads := teller.MaxDownloads
+	if maxDownloads <= 0 {
+		maxDownloads = DEFAULT_MAX_DOWNLOADS
+	}
+	maxPerHost := teller.MaxDownloadsPerHost
+	if maxPerHost <= 0 {
+		maxPerHost = DEFAULT_MAX_DOWNLOADS_PER_HOST
+	}
+	ids := make([]uint64, 0, len(teller.downloads))
+	for id := range teller.downloads {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] }) // Oldest downloads first
+	now := time.Now()
+	for _, id := range ids {
+		if teller.numActiveDownloads >= maxDownloads {
+			return
+		}
+		d := teller.downloads[id]
+		if d.State != DOWNLOAD_QUEUED && !(d.State == DOWNLOAD_WAITING && !now.Before(d.NextAttempt)) {
+			continue
+		}
+		if d.canSwarm() {
+			// Swarm from every source whose host has a free slot
+			var hosts []string
+			for _, source := range d.Sources {
+				if teller.activeHosts[source.Addr] < maxPerHost && !teller.isBlockedHost(source.Addr) { // in ipfilter.go
+					hosts = append(hosts, source.Addr)
+				}
+			}
+			if len(hosts) > 0 {
+				teller.startDownload(d, hosts)
+			}
+			continue
+		}
+		// Find the next source whose host has a free slot
+		for i := 0; i < len(d.Sources); i++ {
+			idx := (d.sourceIdx + i) % len(d.Sources)
+			host := d.Sources[idx].Addr
+			if teller.activeHosts[host] < maxPerHost && !teller.isBlockedHost(host) {
+				d.sourceIdx = idx
+				teller.startDownload(d, []string{host})
+				break
+			}
+		}
+	}
+}
+
+// True if the download has several sources that agree on the file's size and
+// SHA1 URN. Sources without a URN are never swarmed, as nothing would show
+// that they share the same file.
+func (d *managedDownload) canSwarm() bool {
+	if len(d.Sources) < 2 {
+		return false
+	}
+	first := d.Sources[0]
+	if first.Size <= 0 || !messages.IsSHA1URN(first.URN) {
+		return false
+	}
+	urn := messages.NormalizeURN(first.URN)
+	for _, source := range d.Sources[1:] {
+		if source.Size != first.Size || messages.NormalizeURN(source.URN) != urn {
+			return false
+		}
+	}
+	return true
+}
+
+// Must be called with downloadsMutex held
+func (teller *GoTeller) startDownload(d *managedDownload, hosts []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.State = DOWNLOAD_ACTIVE
+	d.hosts = hosts
+	d.cancel = cancel
+	d.stopState = DOWNLOAD_ACTIVE
+	for _, host := range hosts {
+		teller.activeHosts[host]++
+	}
+	teller.numActiveDownloads++
+	var sources []DownloadSource
+	swarmed := d.canSwarm()
+	if !swarmed {
+		sources = []DownloadSource{d.Sources[d.sourceIdx]}
+	} else {
+		for _, source := range d.Sources {
+			for _, host := range hosts {
+				if source.Addr == host {
+					sources = append(sources, source)
+					break
+				}
+			}
+		}
+	}
+	go teller.runDownload(ctx, d, sources, swarmed)
+}
+
+func (teller *GoTeller) runDownload(ctx context.Context, d *managedDownload, sources []DownloadSource, swarmed bool) {
+	onProgress := func(written int64, total int64) {
+		teller.downloadsMutex.Lock()
+		d.Written = written
+		d.Size = total
+		teller.downloadsMutex.Unlock()
+	}
+	source := sources[0]
+	var result *DownloadResult
+	var err error
+	if swarmed {
+		sreq := SwarmRequest{
+			Sources:    sources,
+			Size:       source.Size,
+			URN:        source.URN,
+			Path:       d.Path,
+			Resume:     true,
+			OnProgress: onProgress,
+		}
+		_, err = teller.SwarmDownload(ctx, sreq)
+	} else {
+		dreq := DownloadRequest{
+			Addr:       source.Addr,
+			FileIndex:  source.FileIndex,
+			Filename:   source.Filename,
+			URN:        source.URN,
+			Path:       d.Path,
+			Resume:     true,
+			OnProgress: onProgress,
+		}
+		result, err = teller.Download(ctx, dreq)
+	}
+
+	teller.downloadsMutex.Lock()
+	defer teller.downloadsMutex.Unlock()
+	d.cancel()
+	for _, host := range d.hosts {
+		teller.activeHosts[host]--
+	}
+	teller.numActiveDownloads--
+	doneFunc := teller.downloadDoneFunc
+	d.QueuedAt = 0
+	var retry time.Duration
+	var queued bool
+	if result != nil && err != nil {
+		retry, d.QueuedAt, queued = queuedRetry(result.StatusCode, result.Header) // in uploadqueue.go
+	}
+	switch {
+	case d.stopState == DOWNLOAD_PAUSED:
+		d.State = DOWNLOAD_PAUSED
+	case d.stopState == DOWNLOAD_QUEUED:
+		d.State = DOWNLOAD_QUEUED // Stopped by restartToSwarm
+	case d.stopState == DOWNLOAD_CANCELLED:
+		d.State = DOWNLOAD_CANCELLED
+		os.Remove(d.Path + PARTIAL_SUFFIX)
+	case err == nil:
+		d.State = DOWNLOAD_COMPLETE
+		d.LastError = ""
+		if doneFunc != nil {
+			go doneFunc(d.snapshot(), nil)
+		}
+	case queued:
+		// Ask the same servant again when it said to, which doesn't use up a retry
+		d.LastError = err.Error()
+		teller.retryDownloadAfter(d, retry)
+	default:
+		d.Attempts++
+		d.LastError = err.Error()
+		d.sourceIdx = (d.sourceIdx + 1) % len(d.Sources) // Try an alternate source next time
+		if teller.debugFile != nil {
+			fmt.Fprintf(teller.debugFile, "Download %d from %s failed: %s\n", d.ID, source.Addr, err)
+		}
+		retries := teller.DownloadRetries
+		if retries <= 0 {
+			retries = DEFAULT_DOWNLOAD_RETRIES
+		}
+		if d.Attempts > retries {
+			d.State = DOWNLOAD_FAILED
+			if doneFunc != nil {
+				go doneFunc(d.snapshot(), err)
+			}
+		} else {
+			teller.retryDownloadAfter(d, retryBackoff(d.Attempts))
+		}
+	}
+	teller.saveDownloads()
+	teller.scheduleDownloads()
+}
+
+// Moves the download to DOWNLOAD_WAITING until the wait is over. Must be called
+// with downloadsMutex held.
+func (teller *GoTeller) retryDownloadAfter(d *managedDownload, wait time.Duration) {
+	d.State = DOWNLOAD_WAITING
+	d.NextAttempt = time.Now().Add(wait)
+	time.AfterFunc(wait, func() {
+		teller.downloadsMutex.Lock()
+		defer teller.downloadsMutex.Unlock()
+		teller.scheduleDownloads()
+	})
+}
+
+// Doubles the wait after every failed attempt, up to MAX_DOWNLOAD_RETRY_BACKOFF
+func retryBackoff(attempts int) time.Duration {
+	backoff := DOWNLOAD_RETRY_BACKOFF
+	for i := 1; i < attempts && backoff < MAX_DOWNLOAD_RETRY_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_DOWNLOAD_RETRY_BACKOFF {
+		backoff = MAX_DOWNLOAD_RETRY_BACKOFF
+	}
+	return backoff
+}
+
+// Writes the queue to the download state file, if one was set. Must be called
+// with downloadsMutex held.
+func (teller *GoTeller) saveDownloads() {
+	if teller.downloadStateFile == "" {
+		return
+	}
+	saved := make([]ManagedDownload, 0, len(teller.downloads))
+	for _, d := range teller.downloads {
+		saved = append(saved, d.snapshot())
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err == nil {
+		// Write to a temporary file first so a crash can't leave a truncated queue
+		tmpPath := teller.downloadStateFile + ".tmp"
+		err = ioutil.WriteFile(tmpPath, data, 0644)
+		if err == nil {
+			err = os.Rename(tmpPath, teller.downloadStateFile)
+		}
+	}
+	if err != nil && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, err)
+	}
+}
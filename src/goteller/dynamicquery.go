@@ -0,0 +1,202 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"fmt"
+	"math"
+	"time"
+)
+
+const DEFAULT_TARGET_RESULTS int = 150 // Results sought for leaves' queries
+const DEFAULT_QUERY_WAIT time.Duration = 2400 * time.Millisecond
+const DYNAMIC_PROBE_CONNECTIONS int = 3
+const DYNAMIC_MIN_TTL byte = 1 // A query sent with TTL 0 isn't forwarded, so it never reaches the ultrapeer's leaves
+const DYNAMIC_MAX_TTL byte = 3
+const DYNAMIC_DEGREE float64 = 6 // Assumed number of connections of every ultrapeer
+
+// A query being sent by dynamic querying
+type dynamicQuery struct {
+	from     ipaddr.IPAddr // Leaf the query is for, or this servant
+	results  int           // Hits routed back through this servant, or kept by OnHit for its own queries
+	leafKept int           // Results the leaf reported keeping, or -1 if it hasn't
+}
+
+// Sends a query to a few connections at a time, using the number of results
+// of previous steps to choose the TTL of the next, until target results are
+// found or every connection has been queried. header is that of the query as
+// forwarded. Leaves with a matching route table are sent the query first.
+// Messages sent are counted in search, if it isn't nil.
+func (teller *GoTeller) dynamicQuery(header messages.DescHeader, query messages.QueryMsg, from ipaddr.IPAddr, target int, search *Search) {
+	defer func() {
+		if r := recover(); r != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, r)
+			}
+		}
+	}()
+	dq := &dynamicQuery{from: from, leafKept: -1}
+	teller.dynamicMutex.Lock()
+	if teller.dynamicQueries == nil {
+		teller.dynamicQueries = make(map[[16]byte]*dynamicQuery)
+	}
+	teller.dynamicQueries[header.DescID] = dq
+	teller.dynamicMutex.Unlock()
+	defer func() {
+		teller.dynamicMutex.Lock()
+		delete(teller.dynamicQueries, header.DescID)
+		teller.dynamicMutex.Unlock()
+	}()
+
+	queryBuffer := query.ToBytes()
+	header.PayloadDesc = messages.QUERY
+	header.PayloadLen = uint32(len(queryBuffer))
+	msgFor := func(ttl byte) []byte {
+		header.TTL = ttl
+		return append(header.ToBytes(), queryBuffer...)
+	}
+	teller.routeQueryToLeaves(msgFor(0), query, from) // in qrp.go
+
+	connections := teller.neighborsFor(from) // in ultrapeer.go
+	hostsQueried := 0.0
+	send := func(addr ipaddr.IPAddr, ttl byte) {
+		if teller.routeQueryTo(addr, query, ttl) && teller.sendToNeighbor(msgFor(ttl), addr) {
+			hostsQueried += horizon(ttl)
+			if search != nil {
+				search.countMessage()
+			}
+		}
+	}
+
+	// Probe a few connections with the lowest TTL that reaches their leaves to
+	// estimate how popular the content is
+	next := 0
+	for ; next < len(connections) && next < DYNAMIC_PROBE_CONNECTIONS; next++ {
+		send(connections[next], DYNAMIC_MIN_TTL)
+	}
+	wait := teller.QueryWait
+	for ; next < len(connections) && teller.alive; next++ {
+		// Ask the leaf for its count shortly before looking at the results, so its
+		// answer has arrived
+		time.Sleep(wait - wait/4)
+		teller.requestQueryStatus(header.DescID, from)
+		time.Sleep(wait / 4)
+		results, stop := teller.dynamicResults(dq)
+		if stop || results >= target {
+			return
+		}
+		ttl := dynamicTTL(results, target, hostsQueried, len(connections)-next)
+		send(connections[next], ttl)
+		wait = teller.QueryWait * time.Duration(ttl+1)
+	}
+}
+
+// Returns the number of results found so far, taking the leaf's count if it
+// reported one, and whether the leaf asked to stop
+func (teller *GoTeller) dynamicResults(dq *dynamicQuery) (int, bool) {
+	teller.dynamicMutex.Lock()
+	defer teller.dynamicMutex.Unlock()
+	if dq.leafKept == int(messages.QUERY_STATUS_STOP) {
+		return 0, true
+	}
+	if dq.leafKept >= 0 {
+		return dq.leafKept, false
+	}
+	return dq.results, false
+}
+
+// Number of servants a query sent to one connection with the given TTL is
+// expected to reach. A query received with TTL t is forwarded with t-1 while
+// t > 0, so it travels t+1 hops.
+func horizon(ttl byte) float64 {
+	hosts := 0.0
+	for hop := 0; hop <= int(ttl); hop++ {
+		hosts += math.Pow(DYNAMIC_DEGREE-1, float64(hop))
+	}
+	return hosts
+}
+
+// Chooses the TTL for the next connection so that it and the connections left
+// after it are expected to reach enough servants for the missing results. Never
+// below DYNAMIC_MIN_TTL.
+func dynamicTTL(results int, target int, hostsQueried float64, connectionsLeft int) byte {
+	if results == 0 || hostsQueried == 0 {
+		return DYNAMIC_MAX_TTL // Rare content. Search as widely as allowed
+	}
+	resultsPerHost := float64(results) / hostsQueried
+	hostsNeeded := float64(target-results) / resultsPerHost / float64(connectionsLeft)
+	for ttl := DYNAMIC_MIN_TTL; ttl < DYNAMIC_MAX_TTL; ttl++ {
+		if horizon(ttl) >= hostsNeeded {
+			return ttl
+		}
+	}
+	return DYNAMIC_MAX_TTL
+}
+
+// Counts the hits of a query hit routed through this servant
+func (teller *GoTeller) countDynamicHits(descID [16]byte, numHits int) {
+	teller.dynamicMutex.Lock()
+	defer teller.dynamicMutex.Unlock()
+	if dq, ok := teller.dynamicQueries[descID]; ok {
+		dq.results += numHits
+	}
+}
+
+// Asks a leaf how many results it has kept for its query
+func (teller *GoTeller) requestQueryStatus(descID [16]byte, leaf ipaddr.IPAddr) {
+	if !teller.isLeafPeer(leaf) {
+		return
+	}
+	request := messages.VendorMsg{Vendor: messages.VENDOR_BEAR, Selector: messages.BEAR_QUERY_STATUS_REQUEST, Version: 1}
+	teller.sendVendorMsg(request, descID, leaf)
+}
+
+func (teller *GoTeller) sendVendorMsg(vendor messages.VendorMsg, descID [16]byte, to ipaddr.IPAddr) bool {
+	vendorBuffer := vendor.ToBytes()
+	header := messages.DescHeader{
+		DescID:      descID,
+		PayloadDesc: messages.VENDOR,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(vendorBuffer)),
+	}
+	return teller.sendToNeighbor(append(header.ToBytes(), vendorBuffer...), to)
+}
+
+func (teller *GoTeller) onVendorMsg(header messages.DescHeader, vendor messages.VendorMsg, from ipaddr.IPAddr) {
+	switch {
+	case vendor.Vendor == messages.VENDOR_LIME:
+		teller.onPushProxyMsg(header, vendor, from) // in push.go
+	case vendor.Is(messages.VENDOR_BEAR, messages.BEAR_QUERY_STATUS_REQUEST):
+		// Leaf guidance: tell the ultrapeer how many results OnHit kept for the
+		// query, or that it should stop once the query's target is reached
+		teller.myQueryMapMutex.RLock()
+		query, ok := teller.myQueries[header.DescID]
+		numResults := teller.myQueryResults[header.DescID]
+		teller.myQueryMapMutex.RUnlock()
+		if !ok {
+			return
+		}
+		status := messages.QUERY_STATUS_STOP
+		if query.TargetResults == 0 || numResults < query.TargetResults {
+			if numResults >= int(messages.QUERY_STATUS_STOP) {
+				numResults = int(messages.QUERY_STATUS_STOP) - 1
+			}
+			status = uint16(numResults)
+		}
+		teller.sendVendorMsg(messages.QueryStatusResponse(status), header.DescID, from)
+	case vendor.Is(messages.VENDOR_BEAR, messages.BEAR_QUERY_STATUS_RESPONSE):
+		numResults, err := vendor.QueryStatus()
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		teller.dynamicMutex.Lock()
+		defer teller.dynamicMutex.Unlock()
+		if dq, ok := teller.dynamicQueries[header.DescID]; ok && dq.from == from {
+			dq.leafKept = int(numResults)
+		}
+	}
+}
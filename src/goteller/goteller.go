@@ -3,7 +3,8 @@ package goteller
 import (
 	"../ipaddr"
 	"../messages"
-	"bufio"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -15,31 +16,173 @@ import (
 
 const SEED int64 = 7187 // A large prime number
 const DEFAULT_PING_INTERVAL time.Duration = 3 * time.Second
+const VENDOR_CODE string = "GTLA" // Identifies this implementation in query hits
 
 type HitResult messages.HitResult
 
 type GoTeller struct {
-	alive           bool
-	debugFile       io.Writer
-	addr            ipaddr.IPAddr
-	Neighbors       []ipaddr.IPAddr
-	NumShared       uint32
-	NumKB           uint32
-	Port            uint16
-	NetworkSpeed    uint32
-	PingInterval    time.Duration
-	hashCount       uint32
-	servantID       string
-	randGen         *rand.Rand
-	savedPings      map[[16]byte]ipaddr.IPAddr
-	savedQueries    map[[16]byte]ipaddr.IPAddr
-	myQueries       map[[16]byte]Query
-	neighborsMutex  sync.RWMutex
-	pingMapMutex    sync.RWMutex
-	queryMapMutex   sync.RWMutex
-	myQueryMapMutex sync.RWMutex
-	queryFunc       func(string) []messages.HitResult
-	requestFunc     func(uint32, string) (io.ReadCloser, int64)
+	alive            bool
+	debugFile        io.Writer
+	addr             ipaddr.IPAddr
+	Neighbors        []ipaddr.IPAddr
+	NumShared        uint32
+	NumKB            uint32
+	Port             uint16
+	NetworkSpeed     uint32
+	PingInterval     time.Duration
+	Firewalled       bool   // Set if other servants can't connect to this one, so they must push to download from it
+	HitPrivateData   []byte // Vendor specific data put in the private data area of this servant's query hits
+	uploadCount      uint64 // Number of completed uploads. Accessed atomically
+	hashCount        uint32
+	servantID        string
+	randGen          *rand.Rand
+	savedPings       map[[16]byte]ipaddr.IPAddr
+	savedQueries     map[[16]byte]ipaddr.IPAddr
+	myQueries        map[[16]byte]Query
+	myQueryResults   map[[16]byte]int // Results OnHit kept for each of myQueries
+	searches         map[[16]byte]*Search
+	searchList       []*Search // Most recent last
+	searchMutex      sync.Mutex
+	neighborsMutex   sync.RWMutex
+	pingMapMutex     sync.RWMutex
+	queryMapMutex    sync.RWMutex
+	myQueryMapMutex  sync.RWMutex
+	idMutex          sync.Mutex // Guards randGen and hashCount
+	queryFunc        func(string) []messages.HitResult
+	queryMsgFunc     func(messages.QueryMsg) []messages.HitResult
+	pongFunc         func(messages.PongMsg)
+	PongGGEP         messages.GGEP // Extensions attached to pongs sent by this servant
+	requestFunc      func(uint32, string) (io.ReadCloser, int64)
+	rangeRequestFunc func(uint32, string) (io.ReadSeeker, int64)
+	sharedURNs       map[string]messages.HitResult
+	fileURNs         map[sharedFileKey]string
+	urnMutex         sync.RWMutex
+
+	// Query routing (qrp.go)
+	sharedFiles    map[sharedFileKey]messages.HitResult
+	qrpVersion     uint64 // Incremented whenever sharedFiles changes
+	qrpSent        map[ipaddr.IPAddr]uint64
+	neighborTables map[ipaddr.IPAddr]*routeTable
+	qrpMutex       sync.RWMutex
+
+	// Ultrapeers and leaves (ultrapeer.go)
+	Mode               Mode          // Defaults to MODE_NORMAL
+	MaxLeaves          int           // Leaves accepted as an ultrapeer. Defaults to DEFAULT_MAX_LEAVES
+	MaxUltrapeers      int           // Ultrapeers connected to as a leaf. Defaults to DEFAULT_MAX_ULTRAPEERS
+	UltrapeerMinUptime time.Duration // Uptime before MODE_AUTO can be elected ultrapeer. Defaults to DEFAULT_ULTRAPEER_MIN_UPTIME
+	elected            bool          // Elected ultrapeer in MODE_AUTO
+	reachable          bool          // Another servant connected to this one
+	startTime          time.Time
+	guidedUntil        time.Time // Stay a leaf until then, as guided by an ultrapeer
+	peers              map[ipaddr.IPAddr]*peerInfo
+	leaves             map[ipaddr.IPAddr]time.Time // When each leaf was last heard from
+	peersMutex         sync.RWMutex
+
+	// Dynamic querying (dynamicquery.go)
+	QueryWait      time.Duration // Time waited for results between steps of a dynamic query. Defaults to DEFAULT_QUERY_WAIT
+	dynamicQueries map[[16]byte]*dynamicQuery
+	dynamicMutex   sync.Mutex
+
+	// UDP (udp.go)
+	HostCache      bool // Advertise as a UDP host cache in pongs sent over UDP
+	udpConn        *net.UDPConn
+	hostCaches     []ipaddr.IPAddr
+	knownHosts     map[ipaddr.IPAddr]time.Time // When each was last heard of
+	udpPings       map[[16]byte]udpPing        // UDP pings awaiting a pong
+	solicitedUDP   bool
+	unsolicitedUDP bool
+	udpMutex       sync.Mutex
+
+	// Out of band hits (oob.go)
+	oobReplies    map[[16]byte]*oobReply     // Hits offered for OOB queries, waiting to be claimed
+	udpHitSources map[udpHitSource]time.Time // Servants hits are expected from over UDP, until when
+	oobMutex      sync.Mutex
+
+	// Pushes (push.go)
+	pushRoutes      map[[16]byte]ipaddr.IPAddr    // Neighbor each firewalled servant's query hits came from
+	pushTargets     map[ipaddr.IPAddr]*pushTarget // Firewalled servants of our query hits
+	pushWaiters     map[[16]byte]chan *givConn
+	pushProxies     map[ipaddr.IPAddr]ipaddr.IPAddr // As a leaf: the address of each ultrapeer that is our push proxy
+	pushProxyLeaves map[[16]byte]ipaddr.IPAddr      // As an ultrapeer: leaves we are push proxy for, by servant ID
+	pushMutex       sync.Mutex
+
+	// Compression (deflate.go)
+	DisableCompression bool // Don't accept deflate compressed connections
+	compressionStats   map[ipaddr.IPAddr]*CompressionStats
+	compressionMutex   sync.Mutex
+
+	// Neighbor links (link.go)
+	links      map[ipaddr.IPAddr]*neighborLink
+	linksMutex sync.Mutex
+
+	// Uploads (upload.go, uploadqueue.go)
+	uploadRequestFunc func(*UploadRequest) *UploadResponse
+	UploadSlots       int // Files uploaded at once. 0 is unlimited
+	UploadQueueLength int // Requests queued once all slots are in use. Defaults to DEFAULT_UPLOAD_QUEUE_LENGTH
+	activeUploads     int
+	uploadQueue       []*QueuedUpload
+	queuedIDs         map[queuedRequest]string // IDs other servants queued our requests with
+	uploadMutex       sync.Mutex
+
+	// Bandwidth limits (bandwidth.go)
+	bandwidthLimits     [numTrafficClasses]int64 // Bytes per second in total. 0 is unlimited
+	peerBandwidthLimits [numTrafficClasses]int64 // Bytes per second with each servant
+	globalBuckets       [numTrafficClasses]*tokenBucket
+	peerBuckets         map[peerBucketKey]*tokenBucket
+	bandwidthMutex      sync.Mutex
+
+	// Spam filters (spamfilter.go)
+	queryFilters []QueryFilter
+	hitFilters   []HitFilter
+	filtersMutex sync.RWMutex
+
+	// Abuse detection (abuse.go)
+	AbuseLimits           AbuseLimits // Limits over which neighbors are banned (Optional)
+	DisableAbuseDetection bool        // Never ban neighbors
+	neighborStats         map[ipaddr.IPAddr]*NeighborStats
+	bans                  map[[4]byte]ban
+	abuseMutex            sync.Mutex
+
+	// IP filter (ipfilter.go)
+	IPFilter *IPFilter // Addresses refused as neighbors, hosts and download sources (Optional)
+
+	// Private network (private.go)
+	NetworkKey []byte // Pre-shared key of a private network. Only servants that know it are connected to and heard from (Optional)
+
+	// Identity (identity.go)
+	IdentityKeyPath string // PEM file holding the ed25519 key that signs query hits, generated on first start. If empty, a new key is generated on every start
+	identityKey     ed25519.PrivateKey
+	peerIdentities  map[ipaddr.IPAddr]ed25519.PublicKey // Identity keys servants gave in handshakes
+	trustedKeys     map[string]string                   // Names of trusted keys
+	identityMutex   sync.Mutex
+
+	// TLS (tls.go)
+	TLS         bool   // Accept and make TLS connections
+	TLSCertPath string // PEM file holding the certificate and key, generated on first start. If empty, a new certificate is generated on every start
+	tlsConfig   *tls.Config
+	tlsHosts    map[ipaddr.IPAddr]bool      // Whether servants accept TLS connections
+	tlsFailures map[ipaddr.IPAddr]time.Time // When a TLS handshake with each servant last failed
+	tlsMutex    sync.Mutex
+
+	// GUESS (guess.go)
+	guessKeys      map[ipaddr.IPAddr][]byte // Query keys issued to this servant, nil until asked for
+	queryKeySecret []byte
+	guessQueried   map[[4]byte]time.Time      // When each host last sent a GUESS query
+	guessQueries   map[[16]byte]time.Time     // When each query received over UDP arrived
+	guessPending   map[udpHitSource]time.Time // GUESS queries sent that weren't acknowledged yet
+	guessMutex     sync.Mutex
+
+	// Download manager (downloadmanager.go)
+	MaxDownloads        int // Defaults to DEFAULT_MAX_DOWNLOADS
+	MaxDownloadsPerHost int // Defaults to DEFAULT_MAX_DOWNLOADS_PER_HOST
+	DownloadRetries     int // Times a failed download is retried before giving up. Defaults to DEFAULT_DOWNLOAD_RETRIES
+	downloads           map[uint64]*managedDownload
+	activeHosts         map[string]int
+	numActiveDownloads  int
+	lastDownloadID      uint64
+	downloadStateFile   string
+	downloadDoneFunc    func(ManagedDownload, error)
+	downloadsMutex      sync.Mutex
 }
 
 func (teller *GoTeller) StartAtPort(port uint16) error {
@@ -49,17 +192,17 @@ func (teller *GoTeller) StartAtPort(port uint16) error {
 		teller.alive = false
 		return fmt.Errorf("Must set Servant ID (use SetServantID)")
 	}
-	if teller.queryFunc == nil {
+	if teller.queryFunc == nil && teller.queryMsgFunc == nil {
 		teller.alive = false
-		return fmt.Errorf("Must set Query callback function (use OnQuery)")
+		return fmt.Errorf("Must set Query callback function (use OnQuery or OnQueryMsg)")
 	}
-	if teller.requestFunc == nil {
+	if teller.requestFunc == nil && teller.rangeRequestFunc == nil && teller.uploadRequestFunc == nil {
 		teller.alive = false
-		return fmt.Errorf("Must set Request callback function (use OnRequest)")
+		return fmt.Errorf("Must set Request callback function (use OnRequest, OnRangeRequest or OnUploadRequest)")
 	}
-	if len(teller.Neighbors) == 0 {
+	if len(teller.Neighbors) == 0 && len(teller.hostCaches) == 0 {
 		teller.alive = false
-		return fmt.Errorf("Must set initial neighbors (use SetInitNeighbors)")
+		return fmt.Errorf("Must set initial neighbors (use SetInitNeighbors) or host caches (use SetHostCaches)")
 	}
 	teller.Port = port
 	teller.addr.Port = port
@@ -73,6 +216,19 @@ func (teller *GoTeller) StartAtPort(port uint16) error {
 	teller.savedPings = make(map[[16]byte]ipaddr.IPAddr)
 	teller.savedQueries = make(map[[16]byte]ipaddr.IPAddr)
 	teller.myQueries = make(map[[16]byte]Query)
+	teller.myQueryResults = make(map[[16]byte]int)
+	if teller.QueryWait == 0 {
+		teller.QueryWait = DEFAULT_QUERY_WAIT
+	}
+	teller.initPeers()     // in ultrapeer.go
+	err = teller.initTLS() // in tls.go
+	if err == nil {
+		err = teller.initIdentity() // in identity.go
+	}
+	if err != nil {
+		teller.alive = false
+		return err
+	}
 	err = teller.startServant()
 	if err != nil {
 		return err
@@ -82,6 +238,8 @@ func (teller *GoTeller) StartAtPort(port uint16) error {
 
 func (teller *GoTeller) Stop() {
 	teller.alive = false
+	teller.closeLinks() // in link.go
+	teller.stopUDP()    // in udp.go
 }
 
 func (teller *GoTeller) IsRunning() bool {
@@ -115,49 +273,51 @@ func (teller *GoTeller) OnQuery(qFunc func(string) []messages.HitResult) {
 	teller.queryFunc = qFunc
 }
 
+// Alternative to OnQuery whose callback is given the whole query message,
+// including its URN and GGEP extensions. Takes precedence over OnQuery if both
+// are set.
+func (teller *GoTeller) OnQueryMsg(qFunc func(messages.QueryMsg) []messages.HitResult) {
+	teller.queryMsgFunc = qFunc
+}
+
+// Sets a callback run for every pong answering this servant's pings, e.g. to
+// read the pong's GGEP extensions. Optional.
+func (teller *GoTeller) OnPong(pongFunc func(messages.PongMsg)) {
+	teller.pongFunc = pongFunc
+}
+
 func (teller *GoTeller) OnRequest(reqFunc func(uint32, string) (io.ReadCloser, int64)) {
 	teller.requestFunc = reqFunc
 }
 
+// Alternative to OnRequest for files that can be seeked, so that requests for
+// a byte range don't have to read through the preceding bytes. The body is
+// closed after the response is sent if it is also an io.Closer. Takes
+// precedence over OnRequest if both are set.
+func (teller *GoTeller) OnRangeRequest(reqFunc func(uint32, string) (io.ReadSeeker, int64)) {
+	teller.rangeRequestFunc = reqFunc
+}
+
 // send msg to all neighbors except for from
 func (teller *GoTeller) floodToNeighbors(msg []byte, from ipaddr.IPAddr) {
-	teller.neighborsMutex.RLock()
-	defer teller.neighborsMutex.RUnlock()
-	for _, addr := range teller.Neighbors {
-		if from != addr {
-			teller.sendToNeighbor(msg, addr)
-		}
+	for _, addr := range teller.neighborsFor(from) { // in ultrapeer.go
+		teller.sendToNeighbor(msg, addr)
 	}
 }
 
 func (teller *GoTeller) sendToNeighbor(msg []byte, to ipaddr.IPAddr) bool {
-	conn, err := net.Dial("tcp", to.String())
-	if err != nil {
-		if teller.debugFile != nil {
-			fmt.Fprintln(teller.debugFile, err)
-		}
+	if teller.isBlocked(to) { // in ipfilter.go
 		return false
 	}
-
-	defer conn.Close()
-
-	connIO := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	connected, err := gnutellaConnect(connIO)
+	link, err := teller.linkTo(to) // in link.go
 	if err != nil {
 		if teller.debugFile != nil {
 			fmt.Fprintln(teller.debugFile, err)
 		}
 		return false
 	}
-	if !connected {
-		err = fmt.Errorf("Didn't receive a valid connect reply")
-		if teller.debugFile != nil {
-			fmt.Fprintln(teller.debugFile, err)
-		}
-		return false
-	}
 
-	err = sendBytes(connIO, msg) // in requesthandler.go
+	err = link.enqueue(msg)
 	if err != nil {
 		if teller.debugFile != nil {
 			fmt.Fprintln(teller.debugFile, err)
@@ -202,12 +362,15 @@ func (teller *GoTeller) removeNeighbor(deadNeighbor ipaddr.IPAddr) {
 	for i, addr := range teller.Neighbors {
 		if addr == deadNeighbor {
 			teller.Neighbors = append(teller.Neighbors[:i], teller.Neighbors[i+1:]...)
+			teller.forgetRouteTable(deadNeighbor) // in qrp.go
 			break
 		}
 	}
 }
 
 func (teller *GoTeller) newID() [16]byte {
+	teller.idMutex.Lock()
+	defer teller.idMutex.Unlock()
 	var id [16]byte
 	addrBuffer := teller.addr.ToBytes()
 	copy(id[:6], addrBuffer)
@@ -220,6 +383,13 @@ func (teller *GoTeller) newID() [16]byte {
 	return id
 }
 
+// Returns a random permutation of the integers [0, n)
+func (teller *GoTeller) randPerm(n int) []int {
+	teller.idMutex.Lock()
+	defer teller.idMutex.Unlock()
+	return teller.randGen.Perm(n)
+}
+
 func (teller *GoTeller) SendQuery(query Query) error {
 	defer func() {
 		if r := recover(); r != nil {
@@ -228,21 +398,45 @@ func (teller *GoTeller) SendQuery(query Query) error {
 			}
 		}
 	}()
-	// First check if both callbacks have been set
-	if query.onHit == nil && query.onResponse != nil {
+	// First check if both callbacks have been set. Results chosen by OnHit go to
+	// the download manager instead of OnResponse if DownloadDir is set
+	if query.onHit == nil && (query.onResponse != nil || query.DownloadDir != "") {
 		return fmt.Errorf("Must set OnHit callback for query (Use OnHit(callback))")
-	} else if query.onResponse == nil && query.onHit != nil {
+	} else if query.onResponse == nil && query.onHit != nil && query.DownloadDir == "" {
 		return fmt.Errorf("Must set OnResponse callback for query (Use OnResponse(callback))")
 	} else if query.onResponse == nil && query.onHit == nil {
 		return fmt.Errorf("Must set OnHit and OnResponse callbacks for query (Use OnHit(callback) & OnResponse(callback))")
 	}
-	if query.TTL == 0 {
+	if query.TTL == 0 && query.Strategy == nil && query.TargetResults == 0 {
 		return fmt.Errorf("TTL on query for \"%s\" was 0. Query TTL must be greater than 0.", query.SearchQuery)
 	}
 	// Save query into myQueries map
-	descID := teller.sendQuery(query.SearchQuery, query.TTL, query.MinSpeed, teller.addr)
-	teller.myQueryMapMutex.Lock()
-	defer teller.myQueryMapMutex.Unlock()
-	teller.myQueries[descID] = query
+	if query.URN != "" && !messages.IsSHA1URN(query.URN) {
+		return fmt.Errorf("URN on query \"%s\" must be a valid urn:sha1: URN", query.URN)
+	}
+	queryMsg := messages.QueryMsg{
+		MinSpeed:    query.MinSpeed,
+		SearchQuery: query.SearchQuery,
+		URN:         query.URN,
+		GGEP:        query.GGEP,
+	}
+	if query.MinSpeed == 0 && teller.canReceiveOOB() { // in oob.go
+		queryMsg.SetOOB()
+	}
+	strategy := query.Strategy
+	if strategy == nil {
+		strategy = Flood{}
+	}
+	if query.Strategy == nil && query.TargetResults > 0 && teller.isUltrapeer() {
+		search := teller.newSearch(query, queryMsg, "dynamic") // in searchstrategy.go
+		header := messages.DescHeader{DescID: search.descID}
+		go func() {
+			teller.dynamicQuery(header, queryMsg, teller.addr, query.TargetResults, search) // in dynamicquery.go
+			search.finish()
+		}()
+		return nil
+	}
+	search := teller.newSearch(query, queryMsg, strategy.Name())
+	go search.run(strategy)
 	return nil
 }
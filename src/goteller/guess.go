@@ -0,0 +1,354 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+const DEFAULT_GUESS_TARGET_RESULTS int = 50
+const DEFAULT_GUESS_MAX_HOSTS int = 30
+const DEFAULT_GUESS_WAIT time.Duration = 500 * time.Millisecond
+const GUESS_KEY_WAIT time.Duration = time.Second           // Wait for a query key after asking for one
+const GUESS_MIN_QUERY_INTERVAL time.Duration = time.Second // GUESS queries are accepted from each host at most this often
+const GUESS_ROUTE_TIMEOUT time.Duration = 5 * time.Minute  // Hits for a GUESS query are sent back for this long
+
+// Queries ultrapeers one at a time over UDP, with a query key from each, until
+// TargetResults results are found or MaxHosts have been queried. Ultrapeers
+// answer and pass the query on to their leaves, but don't flood it.
+type GUESS struct {
+	TargetResults int           // Defaults to DEFAULT_GUESS_TARGET_RESULTS
+	MaxHosts      int           // Defaults to DEFAULT_GUESS_MAX_HOSTS
+	Wait          time.Duration // Wait for results after querying each ultrapeer. Defaults to DEFAULT_GUESS_WAIT
+}
+
+func (GUESS) Name() string {
+	return "guess"
+}
+
+func (guess GUESS) Search(search *Search) {
+	if guess.TargetResults == 0 {
+		guess.TargetResults = DEFAULT_GUESS_TARGET_RESULTS
+	}
+	if guess.MaxHosts == 0 {
+		guess.MaxHosts = DEFAULT_GUESS_MAX_HOSTS
+	}
+	if guess.Wait == 0 {
+		guess.Wait = DEFAULT_GUESS_WAIT
+	}
+	teller := search.teller
+	queried := 0
+	for _, host := range teller.guessHosts() {
+		if queried == guess.MaxHosts {
+			return
+		}
+		key := teller.queryKey(host)
+		if key == nil || !search.sendGUESS(host, key) {
+			continue
+		}
+		queried++
+		if !search.Wait(guess.Wait) {
+			return
+		}
+		if !search.guessAcked(host) {
+			// The key may have expired or been issued to an old address
+			teller.clearQueryKey(host)
+		}
+		if search.Results() >= guess.TargetResults {
+			return
+		}
+	}
+}
+
+// Sends the current round of the query over UDP with a query key
+func (search *Search) sendGUESS(to ipaddr.IPAddr, key []byte) bool {
+	queryMsg := search.queryMsg
+	queryMsg.GGEP = append(messages.GGEP(nil), queryMsg.GGEP...)
+	search.mutex.Lock()
+	descID := search.descID
+	search.mutex.Unlock()
+	search.teller.expectUDPHits(descID, to) // in oob.go
+	search.teller.guessMutex.Lock()
+	if search.teller.guessPending == nil {
+		search.teller.guessPending = make(map[udpHitSource]time.Time)
+	}
+	search.teller.guessPending[udpHitSource{descID, to}] = time.Now()
+	search.teller.guessMutex.Unlock()
+	queryMsg.GGEP.Set(messages.GGEP_QK_ID, key)
+	search.teller.tagGGEP(&queryMsg.GGEP, descID, search.teller.addr, queryMsg.ToBytes) // in private.go
+	queryBuffer := queryMsg.ToBytes()
+	header := messages.DescHeader{
+		DescID:      descID,
+		PayloadDesc: messages.QUERY,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(queryBuffer)),
+	}
+	err := search.teller.sendUDP(append(header.ToBytes(), queryBuffer...), to) // in udp.go
+	if err != nil {
+		if search.teller.debugFile != nil {
+			fmt.Fprintln(search.teller.debugFile, err)
+		}
+		return false
+	}
+	search.countMessage()
+	return true
+}
+
+// True if the servant sent the current round of the query by GUESS acknowledged
+// it or sent hits for it
+func (search *Search) guessAcked(host ipaddr.IPAddr) bool {
+	search.mutex.Lock()
+	descID := search.descID
+	search.mutex.Unlock()
+	search.teller.guessMutex.Lock()
+	defer search.teller.guessMutex.Unlock()
+	_, pending := search.teller.guessPending[udpHitSource{descID, host}]
+	delete(search.teller.guessPending, udpHitSource{descID, host})
+	return !pending
+}
+
+// Records that a servant acknowledged a GUESS query or sent hits for it.
+// Returns false if no GUESS query with the ID was waiting for it to.
+func (teller *GoTeller) ackGUESSQuery(descID [16]byte, from ipaddr.IPAddr) bool {
+	teller.guessMutex.Lock()
+	defer teller.guessMutex.Unlock()
+	_, pending := teller.guessPending[udpHitSource{descID, from}]
+	delete(teller.guessPending, udpHitSource{descID, from})
+	return pending
+}
+
+// Forgets the query key a servant issued, so that a new one is asked for
+// before it is queried again
+func (teller *GoTeller) clearQueryKey(host ipaddr.IPAddr) {
+	teller.guessMutex.Lock()
+	defer teller.guessMutex.Unlock()
+	if _, ok := teller.guessKeys[host]; ok {
+		teller.guessKeys[host] = nil
+	}
+}
+
+// Returns the servants to send GUESS queries to: those that advertised GUESS
+// in a pong, then ultrapeer neighbors
+func (teller *GoTeller) guessHosts() []ipaddr.IPAddr {
+	var hosts []ipaddr.IPAddr
+	teller.guessMutex.Lock()
+	for host := range teller.guessKeys {
+		hosts = append(hosts, host)
+	}
+	teller.guessMutex.Unlock()
+	seen := make(map[ipaddr.IPAddr]bool)
+	for _, host := range hosts {
+		seen[host] = true
+	}
+	for _, neighbor := range teller.neighborsFor(teller.addr) { // in ultrapeer.go
+		if !seen[neighbor] {
+			seen[neighbor] = true
+			hosts = append(hosts, neighbor)
+		}
+	}
+	return hosts
+}
+
+// Returns the query key issued by a servant, asking it for one if there isn't
+// one yet. Returns nil if it didn't issue one in time.
+func (teller *GoTeller) queryKey(host ipaddr.IPAddr) []byte {
+	teller.guessMutex.Lock()
+	key := teller.guessKeys[host]
+	teller.guessMutex.Unlock()
+	if key != nil {
+		return key
+	}
+	err := teller.pingUDP(host, messages.GGEP_QK_ID) // in udp.go
+	if err != nil {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		return nil
+	}
+	for waited := time.Duration(0); waited < GUESS_KEY_WAIT && teller.alive; waited += 10 * time.Millisecond {
+		time.Sleep(10 * time.Millisecond)
+		teller.guessMutex.Lock()
+		key = teller.guessKeys[host]
+		teller.guessMutex.Unlock()
+		if key != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+// Records that a servant answers GUESS queries, and the query key it issued
+// this servant if the pong has one
+func (teller *GoTeller) onGUESSPong(pong messages.PongMsg, from ipaddr.IPAddr) {
+	key, hasKey := pong.GGEP.Get(messages.GGEP_QK_ID)
+	if !pong.GGEP.Has(messages.GGEP_GUE_ID) && !hasKey {
+		return
+	}
+	teller.guessMutex.Lock()
+	defer teller.guessMutex.Unlock()
+	if teller.guessKeys == nil {
+		teller.guessKeys = make(map[ipaddr.IPAddr][]byte)
+	}
+	if hasKey {
+		teller.guessKeys[from] = key
+	} else if _, ok := teller.guessKeys[from]; !ok {
+		teller.guessKeys[from] = nil
+	}
+}
+
+// Adds the GUESS extensions to a pong answering a UDP ping. Leaves don't
+// answer GUESS queries.
+func (teller *GoTeller) addGUESSExtensions(pong *messages.PongMsg, ping messages.GGEP, from ipaddr.IPAddr) {
+	if teller.isLeaf() {
+		return
+	}
+	pong.GGEP.Set(messages.GGEP_GUE_ID, []byte{messages.GUESS_VERSION})
+	if ping.Has(messages.GGEP_QK_ID) {
+		pong.GGEP.Set(messages.GGEP_QK_ID, messages.QueryKey(teller.guessSecret(), from))
+	}
+}
+
+// Returns the secret query keys are made from, creating it if needed
+func (teller *GoTeller) guessSecret() []byte {
+	teller.guessMutex.Lock()
+	defer teller.guessMutex.Unlock()
+	if teller.queryKeySecret == nil {
+		teller.queryKeySecret = make([]byte, 16)
+		rand.Read(teller.queryKeySecret)
+	}
+	return teller.queryKeySecret
+}
+
+// Answers a query received over UDP if it has a valid query key and its sender
+// hasn't queried too recently, and passes it on to the leaves whose route
+// table matches. Hits are sent back over UDP.
+func (teller *GoTeller) onGUESSQuery(header messages.DescHeader, query messages.QueryMsg, from ipaddr.IPAddr) {
+	if teller.isLeaf() {
+		return
+	}
+	key, ok := query.GGEP.Get(messages.GGEP_QK_ID)
+	if !ok || !hmac.Equal(key, messages.QueryKey(teller.guessSecret(), from)) {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, "Dropped GUESS query with a bad query key from "+from.String())
+		}
+		return
+	}
+	teller.sendGUESSAck(header.DescID, from)
+	teller.guessMutex.Lock()
+	if teller.guessQueried == nil {
+		teller.guessQueried = make(map[[4]byte]time.Time)
+	}
+	last, ok := teller.guessQueried[from.IP]
+	if ok && time.Since(last) < GUESS_MIN_QUERY_INTERVAL {
+		teller.guessMutex.Unlock()
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, "Dropped GUESS query from "+from.String()+" for exceeding the rate limit")
+		}
+		return
+	}
+	teller.guessQueried[from.IP] = time.Now()
+	teller.guessMutex.Unlock()
+	if !teller.filterQuery(header, &query, from) { // in spamfilter.go
+		return
+	}
+
+	teller.queryMapMutex.Lock()
+	if _, seen := teller.savedQueries[header.DescID]; seen {
+		teller.queryMapMutex.Unlock()
+		return
+	}
+	teller.savedQueries[header.DescID] = from
+	teller.queryMapMutex.Unlock()
+	teller.guessMutex.Lock()
+	if teller.guessQueries == nil {
+		teller.guessQueries = make(map[[16]byte]time.Time)
+	}
+	teller.guessQueries[header.DescID] = time.Now()
+	teller.guessMutex.Unlock()
+
+	query.GGEP.Remove(messages.GGEP_QK_ID)
+	query.GGEP.Remove(messages.GGEP_NETWORK_TAG_ID)
+	if teller.NetworkSpeed >= uint32(query.Speed()) {
+		if hitResults := teller.answerQuery(query); len(hitResults) > 0 { // in urn.go
+			queryHit := teller.queryHitFor(header.DescID, hitResults) // in queryhandler.go
+			queryHitBuffer := queryHit.ToBytes()
+			queryHitHeader := messages.DescHeader{
+				DescID:      header.DescID,
+				PayloadDesc: messages.QUERYHIT,
+				TTL:         1,
+				Hops:        0,
+				PayloadLen:  uint32(len(queryHitBuffer)),
+			}
+			err := teller.sendUDP(append(queryHitHeader.ToBytes(), queryHitBuffer...), from)
+			if err != nil && teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+		}
+	}
+	queryBuffer := query.ToBytes()
+	header.TTL = 0
+	header.Hops++
+	header.PayloadLen = uint32(len(queryBuffer))
+	teller.routeQueryToLeaves(append(header.ToBytes(), queryBuffer...), query, from) // in qrp.go
+}
+
+// Acknowledges a GUESS query with a pong, so that its sender knows its query
+// key is still valid
+func (teller *GoTeller) sendGUESSAck(descID [16]byte, to ipaddr.IPAddr) {
+	pong := messages.PongMsg{Addr: teller.addr, NumShared: teller.NumShared, NumKB: teller.NumKB}
+	teller.tagGGEP(&pong.GGEP, descID, pong.Addr, pong.ToBytes) // in private.go
+	pongBuffer := pong.ToBytes()
+	header := messages.DescHeader{
+		DescID:      descID,
+		PayloadDesc: messages.PONG,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(pongBuffer)),
+	}
+	err := teller.sendUDP(append(header.ToBytes(), pongBuffer...), to) // in udp.go
+	if err != nil && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, err)
+	}
+}
+
+// True if a query was received over UDP, so its hits are sent back over UDP
+func (teller *GoTeller) isGUESSQuery(descID [16]byte) bool {
+	teller.guessMutex.Lock()
+	defer teller.guessMutex.Unlock()
+	_, ok := teller.guessQueries[descID]
+	return ok
+}
+
+// Forgets the hosts that can query again, the GUESS queries sent that were
+// never acknowledged, and the GUESS queries received long enough ago that
+// their hits are no longer sent back
+func (teller *GoTeller) expireGUESSQueriers() {
+	var expired [][16]byte
+	teller.guessMutex.Lock()
+	for ip, last := range teller.guessQueried {
+		if time.Since(last) >= GUESS_MIN_QUERY_INTERVAL {
+			delete(teller.guessQueried, ip)
+		}
+	}
+	for sent, at := range teller.guessPending {
+		if time.Since(at) >= GUESS_ROUTE_TIMEOUT {
+			delete(teller.guessPending, sent)
+		}
+	}
+	for descID, received := range teller.guessQueries {
+		if time.Since(received) >= GUESS_ROUTE_TIMEOUT {
+			delete(teller.guessQueries, descID)
+			expired = append(expired, descID)
+		}
+	}
+	teller.guessMutex.Unlock()
+	teller.queryMapMutex.Lock()
+	for _, descID := range expired {
+		delete(teller.savedQueries, descID)
+	}
+	teller.queryMapMutex.Unlock()
+}
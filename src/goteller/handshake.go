@@ -0,0 +1,236 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+const CONNECTOR_06 string = "GNUTELLA CONNECT/0.6"
+const STATUS_06 string = "GNUTELLA/0.6"
+const OK_06 string = STATUS_06 + " 200 OK"
+const USER_AGENT string = "GoTeller"
+
+// Returned by the 0.6 handshake when the other servant only speaks 0.4
+var errLegacyPeer = fmt.Errorf("Servant doesn't support the 0.6 handshake")
+
+// Dials a neighbor and completes the handshake, using 0.4 for servants known
+// not to support 0.6. Members of a private network only use 0.6.
+func (teller *GoTeller) dialNeighbor(to ipaddr.IPAddr) (net.Conn, *bufio.ReadWriter, error) {
+	legacy := teller.isLegacyPeer(to) && !teller.isPrivate() // in ultrapeer.go
+	conn, err := teller.dial(context.Background(), to)
+	if err != nil {
+		return nil, nil, err
+	}
+	connIO := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if !legacy {
+		encoding, err := teller.gnutellaConnect06(connIO, to)
+		if err == nil {
+			if writer := teller.deflateStreams(connIO, to, encoding); writer != nil { // in deflate.go
+				conn = &deflateConn{Conn: conn, writer: writer}
+			}
+			return conn, connIO, nil
+		}
+		conn.Close()
+		if err != errLegacyPeer || teller.isPrivate() {
+			return nil, nil, err
+		}
+		teller.setLegacyPeer(to)
+		conn, err = teller.dial(context.Background(), to) // in tls.go
+		if err != nil {
+			return nil, nil, err
+		}
+		connIO = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+	connected, err := gnutellaConnect(connIO) // in multiplexer.go
+	if err == nil && !connected {
+		err = fmt.Errorf("Didn't receive a valid connect reply")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, connIO, nil
+}
+
+// Connects with the 0.6 handshake and returns which directions of the
+// connection are compressed
+func (teller *GoTeller) gnutellaConnect06(connIO *bufio.ReadWriter, to ipaddr.IPAddr) (connEncoding, error) {
+	var encoding connEncoding
+	connect := teller.handshakeHeaders(false)
+	nonce, err := teller.challenge(connect) // in private.go
+	if err != nil {
+		return encoding, err
+	}
+	err = writeHandshake(connIO, CONNECTOR_06, connect)
+	if err != nil {
+		return encoding, err
+	}
+	status, err := connIO.Reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, STATUS_06) {
+		return encoding, errLegacyPeer // 0.4 servants hang up on the unknown connect string
+	}
+	headers, err := textproto.NewReader(connIO.Reader).ReadMIMEHeader()
+	if err != nil {
+		return encoding, err
+	}
+	code := strings.TrimSpace(status[len(STATUS_06):])
+	if !strings.HasPrefix(code, "200") {
+		return encoding, fmt.Errorf("%s rejected the handshake: %s", to.String(), code)
+	}
+	err = teller.checkChallenge(to, headers, headers, AUTH_ROLE_REPLY, nonce)
+	if err != nil {
+		return encoding, err
+	}
+	teller.noteHandshakeTLS(to, headers)             // in tls.go
+	teller.noteHandshakeIdentity(to, headers)        // in identity.go
+	final := teller.onHandshakeResponse(to, headers) // in ultrapeer.go
+	encoding.in = contentDeflated(headers)           // in deflate.go
+	encoding.out = teller.acceptsDeflate(headers)
+	if encoding.out {
+		final.Set("Content-Encoding", DEFLATE_ENCODING)
+	}
+	err = teller.answerChallenge(final, headers, AUTH_ROLE_CONNECT, nonce)
+	if err != nil {
+		return encoding, err
+	}
+	return encoding, writeHandshake(connIO, OK_06, final)
+}
+
+// Answers a 0.6 handshake and returns the address the other servant listens on
+// and which directions of the connection are compressed
+func (teller *GoTeller) gnutellaReplyToConnect06(connIO *bufio.ReadWriter, remote ipaddr.IPAddr) (ipaddr.IPAddr, connEncoding, bool, error) {
+	var encoding connEncoding
+	connectLine, err := connIO.Reader.ReadString('\n')
+	if err != nil {
+		return remote, encoding, false, err
+	}
+	if strings.TrimSpace(connectLine) != CONNECTOR_06 {
+		return remote, encoding, false, nil
+	}
+	reader := textproto.NewReader(connIO.Reader)
+	headers, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return remote, encoding, false, err
+	}
+	from := teller.peerAddr(remote, headers.Get("Listen-IP"))
+	teller.noteHandshakeTLS(from, headers)      // in tls.go
+	teller.noteHandshakeIdentity(from, headers) // in identity.go
+	reply := teller.handshakeHeaders(true)
+	nonce, err := teller.challenge(reply) // in private.go
+	if err != nil {
+		return from, encoding, false, err
+	}
+	err = teller.answerChallenge(reply, headers, AUTH_ROLE_REPLY, nonce)
+	if err != nil {
+		writeHandshake(connIO, STATUS_06+" 401 Private network", teller.handshakeHeaders(true))
+		return from, encoding, false, err
+	}
+	// Members of a private network are only accepted once they've answered our challenge
+	reason := ""
+	if !teller.isPrivate() {
+		reason = teller.acceptPeer(from, headers) // in ultrapeer.go
+	}
+	if reason != "" {
+		err = writeHandshake(connIO, STATUS_06+" 503 "+reason, teller.handshakeHeaders(true))
+		return from, encoding, false, err
+	}
+	encoding.out = teller.acceptsDeflate(headers) // in deflate.go
+	if encoding.out {
+		reply.Set("Content-Encoding", DEFLATE_ENCODING)
+	}
+	err = writeHandshake(connIO, OK_06, reply)
+	if err != nil {
+		return from, encoding, false, err
+	}
+	status, err := connIO.Reader.ReadString('\n')
+	if err != nil {
+		return from, encoding, false, err
+	}
+	final, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return from, encoding, false, err
+	}
+	if !strings.HasPrefix(status, STATUS_06+" 200") {
+		return from, encoding, false, nil
+	}
+	err = teller.checkChallenge(from, headers, final, AUTH_ROLE_CONNECT, nonce)
+	if err != nil {
+		return from, encoding, false, err
+	}
+	if teller.isPrivate() {
+		if reason := teller.acceptPeer(from, headers); reason != "" {
+			return from, encoding, false, fmt.Errorf("Rejected %s after the handshake: %s", from.String(), reason)
+		}
+	}
+	teller.onHandshakeFinal(from, final) // in ultrapeer.go
+	encoding.in = contentDeflated(final)
+	return from, encoding, true, nil
+}
+
+// Returns the address a servant listens on. The IP is always that of the
+// connection, so only the port is taken from its Listen-IP header.
+func (teller *GoTeller) peerAddr(remote ipaddr.IPAddr, listenIP string) ipaddr.IPAddr {
+	if listen, err := ipaddr.ParseAddrString(listenIP); err == nil && listenIP != "" {
+		return ipaddr.IPAddr{IP: remote.IP, Port: listen.Port}
+	}
+	if neighbor, ok := teller.neighborWithSameIP(remote); ok {
+		return neighbor
+	}
+	return remote
+}
+
+// Returns the headers sent by this servant in a handshake
+func (teller *GoTeller) handshakeHeaders(reply bool) textproto.MIMEHeader {
+	headers := make(textproto.MIMEHeader)
+	headers.Set("User-Agent", USER_AGENT)
+	headers.Set("Listen-IP", teller.addr.String())
+	headers.Set("X-Query-Routing", "0.1")
+	if !teller.DisableCompression {
+		headers.Set("Accept-Encoding", DEFLATE_ENCODING)
+	}
+	if teller.tlsConfig != nil {
+		headers.Set("TLS", "true")
+	}
+	if key := teller.IdentityKey(); key != nil {
+		headers.Set("X-Identity-Key", base64.StdEncoding.EncodeToString(key))
+	}
+	if teller.Mode != MODE_NORMAL {
+		headers.Set("X-Ultrapeer", boolHeader(teller.isUltrapeer()))
+		if reply && teller.isUltrapeer() {
+			headers.Set("X-Ultrapeer-Needed", boolHeader(teller.ultrapeersNeeded()))
+		}
+	}
+	return headers
+}
+
+func writeHandshake(connIO *bufio.ReadWriter, status string, headers textproto.MIMEHeader) error {
+	buffer := status + "\r\n"
+	for key, values := range headers {
+		for _, value := range values {
+			buffer += key + ": " + value + "\r\n"
+		}
+	}
+	return sendBytes(connIO, []byte(buffer+"\r\n")) // in requesthandler.go
+}
+
+func boolHeader(value bool) string {
+	if value {
+		return "True"
+	}
+	return "False"
+}
+
+// Returns the value of a True/False header, and false if it isn't set
+func parseBoolHeader(headers textproto.MIMEHeader, key string) (bool, bool) {
+	value := headers.Get(key)
+	if value == "" {
+		return false, false
+	}
+	return strings.EqualFold(strings.TrimSpace(value), "true"), true
+}
@@ -0,0 +1,196 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A key in the trust store, with the name it was trusted under
+type TrustedKey struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// Returns the public key that signs this servant's query hits
+func (teller *GoTeller) IdentityKey() ed25519.PublicKey {
+	if teller.identityKey == nil {
+		return nil
+	}
+	return teller.identityKey.Public().(ed25519.PublicKey)
+}
+
+// Returns the identity key a servant gave in its handshake
+func (teller *GoTeller) PeerIdentity(addr ipaddr.IPAddr) (ed25519.PublicKey, bool) {
+	teller.identityMutex.Lock()
+	defer teller.identityMutex.Unlock()
+	key, ok := teller.peerIdentities[addr]
+	return key, ok
+}
+
+// Adds a key to the trust store under a name. Results of query hits it signs
+// are then reported as trusted.
+func (teller *GoTeller) TrustKey(name string, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("Identity key has %d bytes. Must be %d", len(key), ed25519.PublicKeySize)
+	}
+	if strings.ContainsAny(name, "\r\n") {
+		return fmt.Errorf("Name of a trusted key can't contain line breaks")
+	}
+	teller.identityMutex.Lock()
+	defer teller.identityMutex.Unlock()
+	if teller.trustedKeys == nil {
+		teller.trustedKeys = make(map[string]string)
+	}
+	teller.trustedKeys[string(key)] = name
+	return nil
+}
+
+// Removes a key from the trust store
+func (teller *GoTeller) DistrustKey(key ed25519.PublicKey) {
+	teller.identityMutex.Lock()
+	defer teller.identityMutex.Unlock()
+	delete(teller.trustedKeys, string(key))
+}
+
+// Returns the keys in the trust store, sorted by name
+func (teller *GoTeller) TrustedKeys() []TrustedKey {
+	teller.identityMutex.Lock()
+	var keys []TrustedKey
+	for key, name := range teller.trustedKeys {
+		keys = append(keys, TrustedKey{Name: name, Key: ed25519.PublicKey(key)})
+	}
+	teller.identityMutex.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// Adds the keys in a trust store file to the trust store. Each line of the file
+// is a base64 encoded key followed by a space and its name.
+func (teller *GoTeller) LoadTrustedKeys(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		key, err := base64.StdEncoding.DecodeString(fields[0])
+		if err == nil && len(fields) == 2 {
+			err = teller.TrustKey(strings.TrimSpace(fields[1]), key)
+		} else if err == nil {
+			err = fmt.Errorf("Trusted key has no name")
+		}
+		if err != nil {
+			return fmt.Errorf("Line %d of %s: %s", line, path, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Writes the trust store to a file that LoadTrustedKeys can read
+func (teller *GoTeller) SaveTrustedKeys(path string) error {
+	var buffer strings.Builder
+	for _, trusted := range teller.TrustedKeys() {
+		buffer.WriteString(base64.StdEncoding.EncodeToString(trusted.Key) + " " + trusted.Name + "\n")
+	}
+	return ioutil.WriteFile(path, []byte(buffer.String()), 0600)
+}
+
+// Loads the servant's identity key, or generates one if there isn't one at
+// IdentityKeyPath yet
+func (teller *GoTeller) initIdentity() error {
+	data, err := ioutil.ReadFile(teller.IdentityKeyPath)
+	if teller.IdentityKeyPath != "" && err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("%s doesn't hold a PEM encoded identity key", teller.IdentityKeyPath)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		identityKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("%s doesn't hold an ed25519 key", teller.IdentityKeyPath)
+		}
+		teller.identityKey = identityKey
+		return nil
+	}
+	_, identityKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if teller.IdentityKeyPath != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(identityKey)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(teller.IdentityKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	teller.identityKey = identityKey
+	return nil
+}
+
+// Notes the identity key a servant gave in its handshake headers
+func (teller *GoTeller) noteHandshakeIdentity(peer ipaddr.IPAddr, headers textproto.MIMEHeader) {
+	key, err := base64.StdEncoding.DecodeString(headers.Get("X-Identity-Key"))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return
+	}
+	teller.identityMutex.Lock()
+	defer teller.identityMutex.Unlock()
+	if teller.peerIdentities == nil {
+		teller.peerIdentities = make(map[ipaddr.IPAddr]ed25519.PublicKey)
+	}
+	if len(teller.peerIdentities) >= MAX_KNOWN_HOSTS {
+		for host := range teller.peerIdentities {
+			delete(teller.peerIdentities, host) // Forget any one of them
+			break
+		}
+	}
+	teller.peerIdentities[peer] = ed25519.PublicKey(key)
+}
+
+// Signs one of this servant's query hits, for the query with the given
+// descriptor ID
+func (teller *GoTeller) signQueryHit(queryHit *messages.QueryHitMsg, descID [16]byte) {
+	if teller.identityKey != nil {
+		queryHit.Sign(descID, teller.identityKey)
+	}
+}
+
+// Records which key signed the query hit the results are from, and the name
+// it is trusted under
+func (teller *GoTeller) noteSigner(results []QueryResult, signer ed25519.PublicKey) {
+	if signer == nil {
+		return
+	}
+	teller.identityMutex.Lock()
+	name, trusted := teller.trustedKeys[string(signer)]
+	teller.identityMutex.Unlock()
+	for i := range results {
+		results[i].signer = signer
+		results[i].trusted = trusted
+		results[i].trustedName = name
+	}
+}
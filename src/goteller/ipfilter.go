@@ -0,0 +1,311 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const IPFILTER_DAT_MAX_BLOCKED_LEVEL = 127 // ipfilter.dat ranges with a higher access level aren't blocked
+
+// Decides which addresses the servant refuses as neighbors, hosts and download
+// sources. Addresses in a denied range are refused unless they are also in an
+// allowed range, so denying "0.0.0.0/0" refuses every address that isn't
+// allowed. The zero value allows every address.
+type IPFilter struct {
+	manual  filterSource             // Ranges added with Allow and Deny
+	files   map[string]*filterSource // Ranges loaded from each file
+	allowed []ipRange                // Sorted and merged ranges of all sources
+	denied  []ipRange
+	mutex   sync.RWMutex
+}
+
+type filterSource struct {
+	allow   bool // Ranges of a file are either all allowed or all denied
+	allowed []ipRange
+	denied  []ipRange
+	modTime time.Time
+}
+
+// Inclusive range of IPv4 addresses
+type ipRange struct {
+	first uint32
+	last  uint32
+}
+
+// Allows a CIDR range ("10.0.0.0/8"), a range ("10.0.0.1-10.0.0.9") or a
+// single IP address
+func (filter *IPFilter) Allow(spec string) error {
+	return filter.addManual(spec, true)
+}
+
+// Denies a CIDR range, a range or a single IP address
+func (filter *IPFilter) Deny(spec string) error {
+	return filter.addManual(spec, false)
+}
+
+// Allows or denies the ranges in a file. Lines can be in the ipfilter.dat
+// format ("1.2.3.0 - 1.2.3.255 , 000 , Description"), the P2P format
+// ("Description:1.2.3.0-1.2.3.255"), or a CIDR range, range or IP address.
+// Blank lines and lines starting with # or // are skipped. Changes to the file
+// are picked up by Reload.
+func (filter *IPFilter) LoadFile(path string, allow bool) error {
+	source, err := loadFilterFile(path, allow)
+	if err != nil {
+		return err
+	}
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	if filter.files == nil {
+		filter.files = make(map[string]*filterSource)
+	}
+	filter.files[path] = source
+	filter.compile()
+	return nil
+}
+
+// Removes the ranges loaded from a file
+func (filter *IPFilter) RemoveFile(path string) {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	delete(filter.files, path)
+	filter.compile()
+}
+
+// Loads the files that changed since they were last loaded again. Files that
+// fail to load keep their previous ranges. The servant calls this every
+// PingInterval.
+func (filter *IPFilter) Reload() error {
+	filter.mutex.RLock()
+	changed := make(map[string]bool)
+	for path, source := range filter.files {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(source.modTime) {
+			changed[path] = source.allow
+		}
+	}
+	filter.mutex.RUnlock()
+	var firstErr error
+	for path, allow := range changed {
+		source, err := loadFilterFile(path, allow)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		filter.mutex.Lock()
+		if _, ok := filter.files[path]; ok { // Unless it was removed meanwhile
+			filter.files[path] = source
+			filter.compile()
+		}
+		filter.mutex.Unlock()
+	}
+	return firstErr
+}
+
+// Removes every range, including those loaded from files
+func (filter *IPFilter) Clear() {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.manual = filterSource{}
+	filter.files = nil
+	filter.compile()
+}
+
+// True if the filter lets the servant talk to addr
+func (filter *IPFilter) Allowed(addr ipaddr.IPAddr) bool {
+	ip := uint32(addr.IP[0])<<24 | uint32(addr.IP[1])<<16 | uint32(addr.IP[2])<<8 | uint32(addr.IP[3])
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+	return !inRanges(filter.denied, ip) || inRanges(filter.allowed, ip)
+}
+
+func (filter *IPFilter) addManual(spec string, allow bool) error {
+	r, err := parseIPRange(spec)
+	if err != nil {
+		return err
+	}
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	if allow {
+		filter.manual.allowed = append(filter.manual.allowed, r)
+	} else {
+		filter.manual.denied = append(filter.manual.denied, r)
+	}
+	filter.compile()
+	return nil
+}
+
+// Merges the ranges of every source. Must be called with mutex held.
+func (filter *IPFilter) compile() {
+	allowed := append([]ipRange(nil), filter.manual.allowed...)
+	denied := append([]ipRange(nil), filter.manual.denied...)
+	for _, source := range filter.files {
+		allowed = append(allowed, source.allowed...)
+		denied = append(denied, source.denied...)
+	}
+	filter.allowed = mergeRanges(allowed)
+	filter.denied = mergeRanges(denied)
+}
+
+func loadFilterFile(path string, allow bool) (*filterSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	source := &filterSource{allow: allow, modTime: info.ModTime()}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+		r, blocked, err := parseFilterLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of %s: %s", line, path, err)
+		}
+		if allow {
+			source.allowed = append(source.allowed, r)
+		} else if blocked {
+			source.denied = append(source.denied, r)
+		}
+	}
+	return source, scanner.Err()
+}
+
+// Parses a line of a filter file. Returns false if it is an ipfilter.dat range
+// whose access level doesn't block it.
+func parseFilterLine(text string) (ipRange, bool, error) {
+	if fields := strings.Split(text, ","); len(fields) >= 2 {
+		// ipfilter.dat, unless it is a P2P line with a comma in its description
+		if r, err := parseIPRange(fields[0]); err == nil {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return r, false, fmt.Errorf("Bad access level \"%s\"", strings.TrimSpace(fields[1]))
+			}
+			return r, level <= IPFILTER_DAT_MAX_BLOCKED_LEVEL, nil
+		}
+	}
+	if idx := strings.LastIndex(text, ":"); idx != -1 {
+		text = text[idx+1:] // P2P, whose description comes first
+	}
+	r, err := parseIPRange(text)
+	return r, true, err
+}
+
+// Parses a CIDR range, a range of two addresses separated by "-", or a single
+// IP address
+func parseIPRange(spec string) (ipRange, error) {
+	spec = strings.TrimSpace(spec)
+	if idx := strings.Index(spec, "/"); idx != -1 {
+		ip, err := parseIPv4(spec[:idx])
+		if err != nil {
+			return ipRange{}, err
+		}
+		bits, err := strconv.Atoi(spec[idx+1:])
+		if err != nil || bits < 0 || bits > 32 {
+			return ipRange{}, fmt.Errorf("Bad prefix length in \"%s\"", spec)
+		}
+		mask := uint32(0)
+		if bits > 0 {
+			mask = ^uint32(0) << uint(32-bits)
+		}
+		return ipRange{first: ip & mask, last: ip | ^mask}, nil
+	}
+	if idx := strings.Index(spec, "-"); idx != -1 {
+		first, err := parseIPv4(spec[:idx])
+		if err != nil {
+			return ipRange{}, err
+		}
+		last, err := parseIPv4(spec[idx+1:])
+		if err != nil {
+			return ipRange{}, err
+		}
+		if last < first {
+			return ipRange{}, fmt.Errorf("Range \"%s\" ends before it starts", spec)
+		}
+		return ipRange{first: first, last: last}, nil
+	}
+	ip, err := parseIPv4(spec)
+	return ipRange{first: ip, last: ip}, err
+}
+
+// Parses a dotted IPv4 address. Unlike net.ParseIP, parts may have leading
+// zeros as in ipfilter.dat.
+func parseIPv4(text string) (uint32, error) {
+	parts := strings.Split(strings.TrimSpace(text), ".")
+	if len(parts) != 4 {
+		return 0, fmt.Errorf("\"%s\" isn't an IPv4 address", text)
+	}
+	ip := uint32(0)
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 255 {
+			return 0, fmt.Errorf("\"%s\" isn't an IPv4 address", text)
+		}
+		ip = ip<<8 | uint32(n)
+	}
+	return ip, nil
+}
+
+// Sorts ranges and merges those that overlap or touch
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+	var merged []ipRange
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && (merged[last].last == ^uint32(0) || r.first <= merged[last].last+1) {
+			if r.last > merged[last].last {
+				merged[last].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func inRanges(ranges []ipRange, ip uint32) bool {
+	idx := sort.Search(len(ranges), func(i int) bool { return ranges[i].last >= ip })
+	return idx < len(ranges) && ranges[idx].first <= ip
+}
+
+// True if the servant's IP filter refuses addr or its IP is banned
+func (teller *GoTeller) isBlocked(addr ipaddr.IPAddr) bool {
+	return teller.isBanned(addr.IP) || (teller.IPFilter != nil && !teller.IPFilter.Allowed(addr)) // in abuse.go
+}
+
+// True if a host given as a string is blocked, or it can't be parsed
+func (teller *GoTeller) isBlockedHost(host string) bool {
+	addr, err := ipaddr.ParseAddrString(host)
+	return err != nil || teller.isBlocked(*addr)
+}
+
+// True if the other end of an accepted connection is blocked
+func (teller *GoTeller) isBlockedConn(conn net.Conn) bool {
+	return teller.isBlockedHost(conn.RemoteAddr().String())
+}
+
+// Picks up changes to the IP filter's files
+func (teller *GoTeller) reloadIPFilter() {
+	if teller.IPFilter == nil {
+		return
+	}
+	err := teller.IPFilter.Reload()
+	if err != nil && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, err)
+	}
+}
@@ -0,0 +1,194 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const LINK_IDLE_TIMEOUT time.Duration = 2 * time.Minute   // Links nothing was sent or received on for this long are closed
+const LINK_WRITE_TIMEOUT time.Duration = 30 * time.Second // Links a descriptor can't be written to within this long are closed
+const LINK_QUEUE_LEN int = 256                            // Descriptors waiting to be sent on a link. More are dropped
+
+// A persistent connection with a neighbor. Descriptors are sent and received
+// over it in both directions, whichever servant dialed it, so that servants
+// that can't accept connections (such as firewalled leaves) can still be sent
+// descriptors. Descriptors to send are queued and written by their own
+// goroutine within the protocol bandwidth limits, so a slow neighbor doesn't
+// hold up the goroutine handling a descriptor.
+type neighborLink struct {
+	peer     ipaddr.IPAddr
+	conn     net.Conn
+	connIO   *bufio.ReadWriter
+	queue    chan []byte
+	done     chan struct{} // Closed once the link is closed
+	lastUsed int64         // UnixNano time of the last descriptor sent or received. Accessed atomically
+	mutex    sync.Mutex    // Guards writes and closing
+	closed   bool
+}
+
+func newNeighborLink(peer ipaddr.IPAddr, conn net.Conn, connIO *bufio.ReadWriter) *neighborLink {
+	return &neighborLink{
+		peer:     peer,
+		conn:     conn,
+		connIO:   connIO,
+		queue:    make(chan []byte, LINK_QUEUE_LEN),
+		done:     make(chan struct{}),
+		lastUsed: time.Now().UnixNano(),
+	}
+}
+
+// Queues a descriptor to be sent on the link
+func (link *neighborLink) enqueue(msg []byte) error {
+	select {
+	case <-link.done:
+		return fmt.Errorf("Link to %s is closed", link.peer.String())
+	default:
+	}
+	select {
+	case link.queue <- msg:
+		return nil
+	default:
+		return fmt.Errorf("Send queue to %s is full. Dropped a descriptor", link.peer.String())
+	}
+}
+
+// Writes a descriptor to the link
+func (link *neighborLink) write(msg []byte) error {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	if link.closed {
+		return fmt.Errorf("Link to %s is closed", link.peer.String())
+	}
+	link.touch()
+	link.conn.SetWriteDeadline(time.Now().Add(LINK_WRITE_TIMEOUT))
+	return sendBytes(link.connIO, msg) // in requesthandler.go
+}
+
+func (link *neighborLink) touch() {
+	atomic.StoreInt64(&link.lastUsed, time.Now().UnixNano())
+}
+
+func (link *neighborLink) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&link.lastUsed))) >= LINK_IDLE_TIMEOUT
+}
+
+func (link *neighborLink) close() {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	if !link.closed {
+		link.closed = true
+		close(link.done)
+		link.conn.Close()
+	}
+}
+
+// Returns the link with a neighbor, dialing it if there is none
+func (teller *GoTeller) linkTo(to ipaddr.IPAddr) (*neighborLink, error) {
+	teller.linksMutex.Lock()
+	link, ok := teller.links[to]
+	teller.linksMutex.Unlock()
+	if ok {
+		return link, nil
+	}
+	conn, connIO, err := teller.dialNeighbor(to) // in handshake.go
+	if err != nil {
+		return nil, err
+	}
+	link = newNeighborLink(to, conn, connIO)
+	if existing := teller.addLink(link); existing != link {
+		link.close() // Linked with the neighbor while dialing
+		return existing, nil
+	}
+	go teller.serveLink(link)
+	return link, nil
+}
+
+// Registers a link unless there already is one with its neighbor, and returns
+// the link registered
+func (teller *GoTeller) addLink(link *neighborLink) *neighborLink {
+	teller.linksMutex.Lock()
+	defer teller.linksMutex.Unlock()
+	if existing, ok := teller.links[link.peer]; ok {
+		return existing
+	}
+	if teller.links == nil {
+		teller.links = make(map[ipaddr.IPAddr]*neighborLink)
+	}
+	teller.links[link.peer] = link
+	go teller.drainLink(link)
+	return link
+}
+
+// Writes the descriptors queued on a link until it is closed
+func (teller *GoTeller) drainLink(link *neighborLink) {
+	for {
+		select {
+		case <-link.done:
+			return
+		case msg := <-link.queue:
+			teller.throttle(TRAFFIC_PROTOCOL, link.peer, len(msg)) // in bandwidth.go
+			err := link.write(msg)
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
+				}
+				teller.removeLink(link)
+				return
+			}
+		}
+	}
+}
+
+// Closes a link and forgets it
+func (teller *GoTeller) removeLink(link *neighborLink) {
+	teller.linksMutex.Lock()
+	if teller.links[link.peer] == link {
+		delete(teller.links, link.peer)
+	}
+	teller.linksMutex.Unlock()
+	link.close()
+}
+
+// Handles the descriptors received over a link this servant dialed until it
+// is closed
+func (teller *GoTeller) serveLink(link *neighborLink) {
+	defer func() {
+		teller.removeLink(link)
+		if r := recover(); r != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, "Recovered a Panic in serveLink: ", r)
+			}
+		}
+	}()
+	teller.readDescriptors(link) // in multiplexer.go
+}
+
+// Closes the links nothing was sent or received on for a while
+func (teller *GoTeller) closeIdleLinks() {
+	var idle []*neighborLink
+	teller.linksMutex.Lock()
+	for _, link := range teller.links {
+		if link.idle() {
+			idle = append(idle, link)
+		}
+	}
+	teller.linksMutex.Unlock()
+	for _, link := range idle {
+		teller.removeLink(link)
+	}
+}
+
+func (teller *GoTeller) closeLinks() {
+	teller.linksMutex.Lock()
+	links := teller.links
+	teller.links = nil
+	teller.linksMutex.Unlock()
+	for _, link := range links {
+		link.close()
+	}
+}
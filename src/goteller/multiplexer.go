@@ -4,7 +4,9 @@ import (
 	"../ipaddr"
 	"../messages"
 	"bufio"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 )
@@ -22,6 +24,11 @@ func (teller *GoTeller) startServant() error {
 	if err != nil { // If error, just panic. Node will not work if Listen fails
 		return err
 	}
+	err = teller.startUDP() // in udp.go
+	if err != nil {
+		listener.Close()
+		return err
+	}
 	go teller.startPinger() // Will periodically send pings
 	go func() {             // Wait for incoming connections
 		defer listener.Close()
@@ -29,6 +36,8 @@ func (teller *GoTeller) startServant() error {
 			conn, err := listener.Accept()
 			if err != nil && teller.debugFile != nil {
 				fmt.Fprintln(teller.debugFile, err) // no worries. just print the error
+			} else if err == nil && teller.isBlockedConn(conn) { // in ipfilter.go
+				conn.Close()
 			} else {
 				go teller.handleConnection(conn)
 			}
@@ -60,14 +69,44 @@ func (teller *GoTeller) handleConnection(conn net.Conn) {
 		}
 		return
 	}
+	remote, err := ipaddr.ParseAddrString(conn.RemoteAddr().String())
+	if err != nil {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		return
+	}
 	// Peek worked fine
-	if strings.HasPrefix(string(peeked), "GET") {
+	if _, isTLS := conn.(*tls.Conn); !isTLS && teller.tlsConfig != nil && peeked[0] == TLS_RECORD_HANDSHAKE {
+		// Handle the connection again once TLS is set up, as it may be any of the below but not TLS again
+		teller.handleConnection(tls.Server(&bufferedConn{Conn: conn, reader: connIO.Reader}, teller.tlsConfig)) // in tls.go
+		return
+	} else if strings.HasPrefix(string(peeked), "GET") {
 		// Its a http request! Send connIO to request handler
-		teller.handleRequest(connIO)
+		teller.handleRequest(connIO, *remote)
+		return
+	} else if strings.HasPrefix(string(peeked), "GIV") {
+		// A firewalled servant we pushed to connected back
+		teller.onGIV(conn, connIO) // in push.go
 		return
 	}
 
-	connected, err := gnutellaReplyToConnect(connIO)
+	var from ipaddr.IPAddr
+	var encoding connEncoding
+	var connected bool
+	if peeked, _ := connIO.Reader.Peek(len(CONNECTOR_06)); string(peeked) == CONNECTOR_06 {
+		from, encoding, connected, err = teller.gnutellaReplyToConnect06(connIO, *remote) // in handshake.go
+	} else {
+		from = teller.peerAddr(*remote, "")
+		if teller.isLeaf() && !teller.isNeighbor(from) {
+			return // Leaves are shielded from all but their ultrapeers
+		}
+		if teller.isPrivate() {
+			return // The 0.4 handshake can't prove membership of a private network
+		}
+		teller.setReachable()
+		connected, err = gnutellaReplyToConnect(connIO)
+	}
 	if err != nil {
 		if teller.debugFile != nil {
 			fmt.Fprintln(teller.debugFile, err)
@@ -76,41 +115,45 @@ func (teller *GoTeller) handleConnection(conn net.Conn) {
 	} else if !connected {
 		return // Probably failed to get correct CONNECTOR string
 	}
+	if writer := teller.deflateStreams(connIO, from, encoding); writer != nil { // in deflate.go
+		conn = &deflateConn{Conn: conn, writer: writer}
+	}
+	// The link is also used to send to the servant that dialed it, unless there already is one
+	link := newNeighborLink(from, conn, connIO) // in link.go
+	if teller.addLink(link) == link {
+		defer teller.removeLink(link)
+	}
+	teller.readDescriptors(link)
+}
 
+// Handles the descriptors received over a link until it is closed.
+// Descriptors sent together (like a route table's RESET and PATCHes) are
+// handled in order.
+func (teller *GoTeller) readDescriptors(link *neighborLink) {
+	from := link.peer
 	headerBuffer := make([]byte, HEADER_LEN)
-	n, err := connIO.Reader.Read(headerBuffer)
-	if n != HEADER_LEN {
-		if teller.debugFile != nil {
-			fmt.Fprintln(teller.debugFile, "Wasn't able to read HEADER_LEN bytes")
-		}
-	} else if err != nil {
-		if teller.debugFile != nil {
-			fmt.Fprintln(teller.debugFile, err)
-		}
-	} else {
-		header, err := messages.ParseHeaderBytes(headerBuffer)
-		if err != nil {
+	for {
+		n, err := io.ReadFull(link.connIO.Reader, headerBuffer)
+		if err == io.EOF {
+			return
+		} else if n != HEADER_LEN {
 			if teller.debugFile != nil {
-				fmt.Fprintln(teller.debugFile, err)
+				fmt.Fprintln(teller.debugFile, "Wasn't able to read HEADER_LEN bytes")
 			}
 			return
 		}
-
-		from, err := ipaddr.ParseAddrString(conn.RemoteAddr().String())
+		header, err := messages.ParseHeaderBytes(headerBuffer)
 		if err != nil {
 			if teller.debugFile != nil {
 				fmt.Fprintln(teller.debugFile, err)
 			}
+			teller.noteParseError(from) // in abuse.go
 			return
 		}
-		neighborFrom, ok := teller.neighborWithSameIP(*from)
-		if ok {
-			*from = neighborFrom
-		}
 
 		payloadBuffer := make([]byte, header.PayloadLen)
 		if header.PayloadLen > 0 {
-			n, err := connIO.Reader.Read(payloadBuffer)
+			n, err := io.ReadFull(link.connIO.Reader, payloadBuffer)
 			if uint32(n) != header.PayloadLen {
 				if teller.debugFile != nil {
 					fmt.Fprintf(teller.debugFile, "Couldn't read payloadLen bytes for %#x... read %d/%d bytes\n", header.PayloadDesc, n, header.PayloadLen)
@@ -119,61 +162,106 @@ func (teller *GoTeller) handleConnection(conn net.Conn) {
 					}
 				}
 				return
-			} else if err != nil {
+			}
+		}
+		link.touch()
+		if !teller.accountDescriptor(*header, from) { // in abuse.go
+			teller.sayBye(link)
+			return
+		}
+		if teller.isLeafPeer(from) {
+			teller.addLeaf(from) // Note that the leaf is alive
+		}
+		teller.handleDescriptor(*header, payloadBuffer, from)
+	}
+}
+
+func (teller *GoTeller) handleDescriptor(header messages.DescHeader, payloadBuffer []byte, from ipaddr.IPAddr) {
+	switch header.PayloadDesc {
+	case messages.PING:
+		{
+			teller.onPing(header, from)
+		}
+	case messages.PONG:
+		{
+			pong, err := messages.ParsePongBytes(payloadBuffer)
+			if err != nil {
 				if teller.debugFile != nil {
 					fmt.Fprintln(teller.debugFile, err)
 				}
-				return
+				teller.noteParseError(from) // in abuse.go
+			} else {
+				teller.onPong(header, *pong)
 			}
 		}
-		switch header.PayloadDesc {
-		case messages.PING:
-			{
-				teller.onPing(*header, *from)
+	case messages.BYE:
+		{
+			bye, err := messages.ParseByeBytes(payloadBuffer)
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
+				}
+				teller.noteParseError(from)
+			} else {
+				teller.onBye(*bye, from) // in abuse.go
 			}
-		case messages.PONG:
-			{
-				pong, err := messages.ParsePongBytes(payloadBuffer)
-				if err != nil {
-					if teller.debugFile != nil {
-						fmt.Fprintln(teller.debugFile, err)
-					}
-				} else {
-					teller.onPong(*header, *pong)
+		}
+	case messages.PUSH:
+		{
+			push, err := messages.ParsePushBytes(payloadBuffer)
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
 				}
+				teller.noteParseError(from)
+			} else {
+				teller.onPush(header, *push) // in push.go
 			}
-		case messages.PUSH:
-			{
-				/*push, err := messages.ParsePushBytes(payloadBuffer)
-				if err != nil {
-					if teller.debugFile != nil {
-						fmt.Fprintln(teller.debugFile, err)
-					}
-				} else {
-					// TODO: Create push handler
-				}*/
+		}
+	case messages.QUERY:
+		{
+			query, err := messages.ParseQueryBytes(payloadBuffer)
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
+				}
+				teller.noteParseError(from)
+			} else {
+				teller.onQuery(header, *query, from)
 			}
-		case messages.QUERY:
-			{
-				query, err := messages.ParseQueryBytes(payloadBuffer)
-				if err != nil {
-					if teller.debugFile != nil {
-						fmt.Fprintln(teller.debugFile, err)
-					}
-				} else {
-					teller.onQuery(*header, *query, *from)
+		}
+	case messages.QUERYHIT:
+		{
+			queryhit, err := messages.ParseQueryHitBytes(payloadBuffer)
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
 				}
+				teller.noteParseError(from)
+			} else {
+				teller.onQueryHit(header, *queryhit, from)
 			}
-		case messages.QUERYHIT:
-			{
-				queryhit, err := messages.ParseQueryHitBytes(payloadBuffer)
-				if err != nil {
-					if teller.debugFile != nil {
-						fmt.Fprintln(teller.debugFile, err)
-					}
-				} else {
-					teller.onQueryHit(*header, *queryhit)
+		}
+	case messages.VENDOR:
+		{
+			vendor, err := messages.ParseVendorBytes(payloadBuffer)
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
+				}
+				teller.noteParseError(from)
+			} else {
+				teller.onVendorMsg(header, *vendor, from) // in dynamicquery.go
+			}
+		}
+	case messages.ROUTE_TABLE_UPDATE:
+		{
+			err := teller.onRouteTableUpdate(payloadBuffer, from) // in qrp.go
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
 				}
+				teller.noteParseError(from)
 			}
 		}
 	}
@@ -0,0 +1,186 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"fmt"
+	"time"
+)
+
+const OOB_REPLY_TIMEOUT time.Duration = 30 * time.Second // Offered hits are routed back if not claimed by then
+const UDP_HIT_TIMEOUT time.Duration = time.Minute        // Hits are taken over UDP from a servant for this long after claiming its hits or sending it a GUESS query
+
+// Hits offered to the sender of an out of band query, waiting to be claimed
+type oobReply struct {
+	to       ipaddr.IPAddr
+	queryHit messages.QueryHitMsg
+	offered  time.Time
+	msg      []byte        // The hits' descriptor, routed back if they aren't claimed
+	route    ipaddr.IPAddr // Neighbor the query came from
+}
+
+// A servant that may send hits for one of this servant's queries over UDP
+type udpHitSource struct {
+	descID [16]byte
+	addr   ipaddr.IPAddr
+}
+
+// True if this servant's queries can ask for hits out of band. It must be
+// reachable over UDP by servants it hasn't pinged.
+func (teller *GoTeller) canReceiveOOB() bool {
+	return !teller.Firewalled && teller.CanReceiveUnsolicitedUDP() // in udp.go
+}
+
+// Offers the hits for an out of band query to the address in its GUID with a
+// LIME/12 message. They are sent over UDP once claimed with a LIME/11 message,
+// and msg is routed back to the neighbor the query came from if they aren't
+// claimed in time. Returns false if they couldn't be offered, so they should
+// be routed back now.
+func (teller *GoTeller) offerOOBHits(descID [16]byte, queryHit messages.QueryHitMsg, msg []byte, route ipaddr.IPAddr) bool {
+	to := messages.OOBAddr(descID)
+	if to.Port == 0 || to == teller.addr {
+		return false
+	}
+	teller.oobMutex.Lock()
+	if teller.oobReplies == nil {
+		teller.oobReplies = make(map[[16]byte]*oobReply)
+	}
+	teller.oobReplies[descID] = &oobReply{to: to, queryHit: queryHit, offered: time.Now(), msg: msg, route: route}
+	teller.oobMutex.Unlock()
+	offer := messages.ReplyNumber(queryHit.NumHits, teller.CanReceiveUnsolicitedUDP())
+	err := teller.sendUDPVendorMsg(offer, descID, to)
+	if err != nil {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		teller.oobMutex.Lock()
+		delete(teller.oobReplies, descID)
+		teller.oobMutex.Unlock()
+		return false
+	}
+	return true
+}
+
+func (teller *GoTeller) sendUDPVendorMsg(vendor messages.VendorMsg, descID [16]byte, to ipaddr.IPAddr) error {
+	teller.tagVendorMsg(&vendor, descID) // in private.go
+	vendorBuffer := vendor.ToBytes()
+	header := messages.DescHeader{
+		DescID:      descID,
+		PayloadDesc: messages.VENDOR,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(vendorBuffer)),
+	}
+	return teller.sendUDP(append(header.ToBytes(), vendorBuffer...), to) // in udp.go
+}
+
+func (teller *GoTeller) onUDPVendorMsg(header messages.DescHeader, vendor messages.VendorMsg, from ipaddr.IPAddr) {
+	if !teller.untagVendorMsg(&vendor, header.DescID, from) { // in private.go
+		return
+	}
+	switch {
+	case vendor.Is(messages.VENDOR_LIME, messages.LIME_REPLY_NUMBER):
+		// Hits offered for one of our queries. Claim them unless it has enough
+		numResults, err := vendor.ReplyNumber()
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		teller.myQueryMapMutex.RLock()
+		query, ok := teller.myQueries[header.DescID]
+		results := teller.myQueryResults[header.DescID]
+		teller.myQueryMapMutex.RUnlock()
+		if !ok || (query.TargetResults > 0 && results >= query.TargetResults) {
+			return
+		}
+		teller.expectUDPHits(header.DescID, from)
+		err = teller.sendUDPVendorMsg(messages.LimeAck(numResults), header.DescID, from)
+		if err != nil && teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+	case vendor.Is(messages.VENDOR_LIME, messages.LIME_ACK):
+		// Our offered hits were claimed. Send as many as were asked for
+		numResults, err := vendor.LimeAck()
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		teller.oobMutex.Lock()
+		reply, ok := teller.oobReplies[header.DescID]
+		if ok && reply.to.IP == from.IP {
+			delete(teller.oobReplies, header.DescID)
+		}
+		teller.oobMutex.Unlock()
+		if !ok || reply.to.IP != from.IP || numResults == 0 {
+			return
+		}
+		queryHit := reply.queryHit
+		if int(numResults) < len(queryHit.ResultSet) {
+			queryHit.ResultSet = queryHit.ResultSet[:numResults]
+			queryHit.NumHits = numResults
+			teller.signQueryHit(&queryHit, header.DescID) // in identity.go
+			// The network tag also covers the results
+			teller.tagGGEP(&queryHit.Trailer.GGEP, header.DescID, queryHit.Addr, queryHit.ToBytes) // in private.go
+		}
+		queryHitBuffer := queryHit.ToBytes()
+		queryHitHeader := messages.DescHeader{
+			DescID:      header.DescID,
+			PayloadDesc: messages.QUERYHIT,
+			TTL:         1,
+			Hops:        0,
+			PayloadLen:  uint32(len(queryHitBuffer)),
+		}
+		err = teller.sendUDP(append(queryHitHeader.ToBytes(), queryHitBuffer...), from)
+		if err != nil && teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+	}
+}
+
+// Routes back the offered hits that weren't claimed in time, and forgets the
+// servants whose hits were expected over UDP long enough ago
+func (teller *GoTeller) expireOOBReplies() {
+	var expired []*oobReply
+	teller.oobMutex.Lock()
+	for descID, reply := range teller.oobReplies {
+		if time.Since(reply.offered) > OOB_REPLY_TIMEOUT {
+			delete(teller.oobReplies, descID)
+			expired = append(expired, reply)
+		}
+	}
+	for source, until := range teller.udpHitSources {
+		if time.Now().After(until) {
+			delete(teller.udpHitSources, source)
+		}
+	}
+	teller.oobMutex.Unlock()
+	for _, reply := range expired {
+		if !teller.sendToNeighbor(reply.msg, reply.route) && teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, "Couldn't send QueryHitMsg to neighbor at "+reply.route.String())
+		}
+	}
+}
+
+// Takes hits for one of this servant's queries from a servant over UDP for
+// the next UDP_HIT_TIMEOUT
+func (teller *GoTeller) expectUDPHits(descID [16]byte, from ipaddr.IPAddr) {
+	teller.oobMutex.Lock()
+	defer teller.oobMutex.Unlock()
+	if teller.udpHitSources == nil {
+		teller.udpHitSources = make(map[udpHitSource]time.Time)
+	}
+	teller.udpHitSources[udpHitSource{descID, from}] = time.Now().Add(UDP_HIT_TIMEOUT)
+}
+
+// True if hits for the query are taken from the servant over UDP: it offered
+// them and they were claimed, or it was sent the query by GUESS
+func (teller *GoTeller) expectsUDPHits(descID [16]byte, from ipaddr.IPAddr) bool {
+	teller.oobMutex.Lock()
+	defer teller.oobMutex.Unlock()
+	until, ok := teller.udpHitSources[udpHitSource{descID, from}]
+	return ok && time.Now().Before(until)
+}
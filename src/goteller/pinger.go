@@ -1,6 +1,7 @@
 package goteller
 
 import (
+	"../ipaddr"
 	"../messages"
 	"fmt"
 	"time"
@@ -26,6 +27,16 @@ func (teller *GoTeller) pingLoop(ttl byte) {
 
 	// Sleep for a set interval period
 	time.Sleep(teller.PingInterval)
+	teller.maintainPeers()       // in ultrapeer.go
+	teller.sendRouteTables()     // in qrp.go
+	teller.refillNeighbors()     // in udp.go
+	teller.expireOOBReplies()    // in oob.go
+	teller.expireGUESSQueriers() // in guess.go
+	teller.requestPushProxies()  // in push.go
+	teller.reloadIPFilter()      // in ipfilter.go
+	teller.expireAbuse()         // in abuse.go
+	teller.expirePeerBuckets()   // in bandwidth.go
+	teller.closeIdleLinks()      // in link.go
 
 	header := messages.DescHeader{
 		DescID:      teller.newID(),
@@ -41,20 +52,12 @@ func (teller *GoTeller) pingLoop(ttl byte) {
 
 	pingBuffer := header.ToBytes()
 	teller.neighborsMutex.RLock()
-	rlocked := true
-	defer func() {
-		if rlocked {
-			teller.neighborsMutex.RUnlock()
-		}
-	}()
-	for _, addr := range teller.Neighbors {
+	neighbors := append([]ipaddr.IPAddr(nil), teller.Neighbors...)
+	teller.neighborsMutex.RUnlock()
+	for _, addr := range neighbors {
 		sent := teller.sendToNeighbor(pingBuffer, addr)
 		if !sent { // !sent Indicates the neighbor is dead
-			teller.neighborsMutex.RUnlock()
-			rlocked = false
 			teller.removeNeighbor(addr)
-			teller.neighborsMutex.RLock()
-			rlocked = true
 		}
 	}
 }
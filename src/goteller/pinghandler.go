@@ -6,7 +6,7 @@ import (
 )
 
 func (teller *GoTeller) onPing(descHeader messages.DescHeader, from ipaddr.IPAddr) {
-	pong := messages.PongMsg{NumShared: teller.NumShared, NumKB: teller.NumKB}
+	pong := messages.PongMsg{NumShared: teller.NumShared, NumKB: teller.NumKB, GGEP: teller.PongGGEP}
 	pong.Addr = teller.addr
 	pongBuffer := pong.ToBytes()
 	pongHeader := messages.DescHeader{
@@ -20,7 +20,8 @@ func (teller *GoTeller) onPing(descHeader messages.DescHeader, from ipaddr.IPAdd
 	teller.sendToNeighbor(msgBuffer, from)
 	descHeader.TTL--
 	descHeader.Hops++
-	if descHeader.TTL > 0 {
+	descHeader.PayloadLen = 0 // The ping's extensions aren't forwarded
+	if descHeader.TTL > 0 && !teller.isLeaf() {
 		teller.pingMapMutex.Lock()
 		teller.savedPings[descHeader.DescID] = from // Save in saved Pings
 		teller.pingMapMutex.Unlock()
@@ -10,13 +10,19 @@ func (teller *GoTeller) onPong(header messages.DescHeader, pong messages.PongMsg
 		teller.pingMapMutex.RUnlock()
 		if pingSrc == teller.addr {
 			// Pong is for self
-			if pong.Addr != teller.addr && !teller.isNeighbor(pong.Addr) { // Only add to neighbor list if its not already a neighbor and address isn't for self
+			teller.addKnownHost(pong.Addr)
+			if pong.Addr != teller.addr && !teller.isBlocked(pong.Addr) && !teller.isNeighbor(pong.Addr) && !teller.isLeafPeer(pong.Addr) && teller.wantsNeighbors() { // Only add to neighbor list if its not already a neighbor and address isn't for self
 				teller.addNeighbor(pong.Addr)
 			}
+			if teller.pongFunc != nil {
+				teller.pongFunc(pong)
+			}
 		} else if header.TTL > 0 {
 			header.TTL--
 			header.Hops++
-			msgBuffer := append(header.ToBytes(), pong.ToBytes()...)
+			pongBuffer := pong.ToBytes()
+			header.PayloadLen = uint32(len(pongBuffer))
+			msgBuffer := append(header.ToBytes(), pongBuffer...)
 			teller.sendToNeighbor(msgBuffer, pingSrc)
 		} // If TTL is 0, do not forward.
 		teller.pingMapMutex.Lock()
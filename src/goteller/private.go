@@ -0,0 +1,199 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+)
+
+const AUTH_NONCE_LEN int = 16
+
+// Roles in the private network handshake. Each servant's proof names its own
+// role, so a proof can't be reflected back at the servant that challenged.
+const AUTH_ROLE_CONNECT string = "connect"
+const AUTH_ROLE_REPLY string = "reply"
+const AUTH_ROLE_REQUEST string = "request" // Sender of an HTTP request
+
+// True if the servant only talks to members of a private network
+func (teller *GoTeller) isPrivate() bool {
+	return len(teller.NetworkKey) > 0
+}
+
+// Adds a new challenge to handshake headers in a private network and returns
+// it
+func (teller *GoTeller) challenge(headers textproto.MIMEHeader) ([]byte, error) {
+	if !teller.isPrivate() {
+		return nil, nil
+	}
+	nonce := make([]byte, AUTH_NONCE_LEN)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	headers.Set("X-Auth-Challenge", hex.EncodeToString(nonce))
+	return nonce, nil
+}
+
+// Answers the challenge in the other servant's handshake headers with a proof
+// that this servant knows the network key
+func (teller *GoTeller) answerChallenge(headers, peerHeaders textproto.MIMEHeader, role string, nonce []byte) error {
+	if !teller.isPrivate() {
+		return nil
+	}
+	challenge, err := hex.DecodeString(peerHeaders.Get("X-Auth-Challenge"))
+	if err != nil || len(challenge) != AUTH_NONCE_LEN {
+		return fmt.Errorf("Servant didn't send a private network challenge")
+	}
+	headers.Set("X-Auth-Response", hex.EncodeToString(teller.networkProof(role, challenge, nonce)))
+	return nil
+}
+
+// Checks the other servant's answer to our challenge. peerHeaders are those
+// holding its own challenge.
+func (teller *GoTeller) checkChallenge(peer ipaddr.IPAddr, peerHeaders, answer textproto.MIMEHeader, peerRole string, nonce []byte) error {
+	if !teller.isPrivate() {
+		return nil
+	}
+	peerNonce, _ := hex.DecodeString(peerHeaders.Get("X-Auth-Challenge"))
+	response, err := hex.DecodeString(answer.Get("X-Auth-Response"))
+	if err != nil || !hmac.Equal(response, teller.networkProof(peerRole, nonce, peerNonce)) {
+		return fmt.Errorf("%s isn't a member of the private network", peer.String())
+	}
+	return nil
+}
+
+// Proves knowledge of the network key by a servant in role, for the challenge
+// it answers and the one it sent
+func (teller *GoTeller) networkProof(role string, challenge, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, teller.NetworkKey)
+	mac.Write([]byte(role))
+	mac.Write(challenge)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// Tags a GGEP block of a descriptor sent over UDP in a private network.
+// payload encodes the descriptor's payload, and is called while the block has
+// no tag.
+func (teller *GoTeller) tagGGEP(ggep *messages.GGEP, guid [16]byte, sender ipaddr.IPAddr, payload func() []byte) {
+	if teller.isPrivate() {
+		ggep.Remove(messages.GGEP_NETWORK_TAG_ID)
+		ggep.Set(messages.GGEP_NETWORK_TAG_ID, messages.NetworkTag(teller.NetworkKey, guid, sender, payload()))
+	}
+}
+
+// True if a descriptor received over UDP was sent by a member of the private
+// network, or if the servant isn't in one. payload encodes the descriptor's
+// payload, and is called while the GGEP block has no tag.
+func (teller *GoTeller) isMember(ggep *messages.GGEP, guid [16]byte, sender ipaddr.IPAddr, payload func() []byte) bool {
+	if !teller.isPrivate() {
+		return true
+	}
+	tag, ok := ggep.Get(messages.GGEP_NETWORK_TAG_ID)
+	member := false
+	if ok {
+		tagged := *ggep
+		untagged := append(messages.GGEP(nil), tagged...)
+		untagged.Remove(messages.GGEP_NETWORK_TAG_ID)
+		*ggep = untagged
+		member = hmac.Equal(tag, messages.NetworkTag(teller.NetworkKey, guid, sender, payload()))
+		*ggep = tagged
+	}
+	if !member && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, "Dropped a datagram from "+sender.String()+", which isn't a member of the private network")
+	}
+	return member
+}
+
+// Tags a vendor message sent over UDP in a private network by appending the
+// tag to its data
+func (teller *GoTeller) tagVendorMsg(vendor *messages.VendorMsg, guid [16]byte) {
+	if teller.isPrivate() {
+		tag := messages.NetworkTag(teller.NetworkKey, guid, teller.addr, vendor.ToBytes())
+		vendor.Data = append(append([]byte(nil), vendor.Data...), tag...)
+	}
+}
+
+// Checks the tag of a vendor message received over UDP in a private network
+// and removes it from the message's data. Returns false if it wasn't sent by a
+// member of the network.
+func (teller *GoTeller) untagVendorMsg(vendor *messages.VendorMsg, guid [16]byte, sender ipaddr.IPAddr) bool {
+	if !teller.isPrivate() {
+		return true
+	}
+	member := false
+	if len(vendor.Data) >= messages.NETWORK_TAG_LEN {
+		tag := vendor.Data[len(vendor.Data)-messages.NETWORK_TAG_LEN:]
+		vendor.Data = vendor.Data[:len(vendor.Data)-messages.NETWORK_TAG_LEN]
+		member = hmac.Equal(tag, messages.NetworkTag(teller.NetworkKey, guid, sender, vendor.ToBytes()))
+	}
+	if !member && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, "Dropped a datagram from "+sender.String()+", which isn't a member of the private network")
+	}
+	return member
+}
+
+// In a private network, asks the sender of an HTTP request to prove that it
+// knows the network key before the request is served. The servant answers with
+// a 401 response holding a challenge, and reads the request again from the same
+// connection with the proof. Returns the request to serve.
+func (teller *GoTeller) authorizeRequest(req *http.Request, connIO *bufio.ReadWriter, from ipaddr.IPAddr) (*http.Request, error) {
+	if !teller.isPrivate() {
+		return req, nil
+	}
+	nonce := make([]byte, AUTH_NONCE_LEN)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	res := buildResponse("401 Unauthorized", http.StatusUnauthorized, nil, 0, req) // in requesthandler.go
+	res.Close = false
+	res.Header.Set("X-Auth-Challenge", hex.EncodeToString(nonce))
+	err = res.Write(connIO.Writer)
+	if err == nil {
+		err = connIO.Writer.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	req, err = http.ReadRequest(connIO.Reader)
+	if err != nil {
+		return nil, err
+	}
+	response, err := hex.DecodeString(req.Header.Get("X-Auth-Response"))
+	if err != nil || !hmac.Equal(response, teller.requestProof(req, nonce)) {
+		res = buildResponse("403 Forbidden", http.StatusForbidden, nil, 0, req)
+		res.Write(connIO.Writer)
+		connIO.Writer.Flush()
+		return nil, fmt.Errorf("%s isn't a member of the private network", from.String())
+	}
+	return req, nil
+}
+
+// Answers the challenge in a 401 response to an HTTP request, so that the
+// request can be sent again with the proof. Returns false if the response
+// holds no challenge.
+func (teller *GoTeller) answerRequestChallenge(req *http.Request, res *http.Response) bool {
+	if !teller.isPrivate() || res.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	challenge, err := hex.DecodeString(res.Header.Get("X-Auth-Challenge"))
+	if err != nil || len(challenge) != AUTH_NONCE_LEN {
+		return false
+	}
+	req.Header.Set("X-Auth-Response", hex.EncodeToString(teller.requestProof(req, challenge)))
+	return true
+}
+
+// Proves knowledge of the network key by the sender of an HTTP request, for
+// the challenge it was given and the request's method and URI
+func (teller *GoTeller) requestProof(req *http.Request, challenge []byte) []byte {
+	return teller.networkProof(AUTH_ROLE_REQUEST, challenge, []byte(req.Method+" "+req.URL.RequestURI()))
+}
@@ -0,0 +1,433 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"bufio"
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PUSH_PROXY_PATH string = "/gnet/push-proxy"
+const PUSH_TTL byte = 7
+const PUSH_TIMEOUT time.Duration = 20 * time.Second       // Wait for a GIV after pushing
+const PUSH_PROXY_TIMEOUT time.Duration = 10 * time.Second // Wait for a push proxy's answer
+const MAX_PUSH_ROUTES int = 1000
+
+// Servant IDs in push proxy requests are base32 without padding
+var servantIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// A firewalled servant whose files are fetched with a push
+type pushTarget struct {
+	servantID [16]byte
+	proxies   []ipaddr.IPAddr
+}
+
+// A connection a firewalled servant opened with a GIV, handed to the download
+// that pushed for it. Closing it lets the connection's handler return.
+type givConn struct {
+	net.Conn
+	reader *bufio.Reader
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (conn *givConn) Close() error {
+	conn.once.Do(func() {
+		close(conn.done)
+	})
+	return conn.Conn.Close()
+}
+
+// Returns the servant ID as it is sent in query hits and pushes
+func (teller *GoTeller) servantGUID() [16]byte {
+	var id [16]byte
+	copy(id[:], []byte(teller.servantID))
+	return id
+}
+
+// True if the servant of a query hit is firewalled
+func pushNeeded(queryHit messages.QueryHitMsg) bool {
+	if queryHit.Trailer == nil {
+		return false
+	}
+	value, known := queryHit.Trailer.Flag(messages.EQHD_PUSH_FLAG)
+	return value && known
+}
+
+// Returns the push proxies in an extended query hit descriptor
+func pushProxiesOf(trailer *messages.QHDTrailer) []ipaddr.IPAddr {
+	if trailer == nil {
+		return nil
+	}
+	data, ok := trailer.GGEP.Get(messages.GGEP_PUSH_ID)
+	if !ok {
+		return nil
+	}
+	proxies, _ := messages.UnpackIPPorts(data)
+	return proxies
+}
+
+// Remembers the neighbor a firewalled servant's query hit came from, so pushes
+// for it can be routed back the same way
+func (teller *GoTeller) notePushRoute(queryHit messages.QueryHitMsg, from ipaddr.IPAddr) {
+	if !pushNeeded(queryHit) || (!teller.isNeighbor(from) && !teller.isLeafPeer(from)) {
+		return
+	}
+	teller.pushMutex.Lock()
+	defer teller.pushMutex.Unlock()
+	if teller.pushRoutes == nil {
+		teller.pushRoutes = make(map[[16]byte]ipaddr.IPAddr)
+	}
+	if len(teller.pushRoutes) >= MAX_PUSH_ROUTES {
+		for id := range teller.pushRoutes {
+			delete(teller.pushRoutes, id) // Forget any one of them
+			break
+		}
+	}
+	teller.pushRoutes[queryHit.ServantID] = from
+}
+
+// Remembers a firewalled servant of one of our query hits, so downloads from
+// it push instead of connecting
+func (teller *GoTeller) notePushTarget(queryHit messages.QueryHitMsg) {
+	if !pushNeeded(queryHit) {
+		return
+	}
+	teller.pushMutex.Lock()
+	defer teller.pushMutex.Unlock()
+	if teller.pushTargets == nil {
+		teller.pushTargets = make(map[ipaddr.IPAddr]*pushTarget)
+	}
+	if len(teller.pushTargets) >= MAX_PUSH_ROUTES {
+		for addr := range teller.pushTargets {
+			delete(teller.pushTargets, addr)
+			break
+		}
+	}
+	teller.pushTargets[queryHit.Addr] = &pushTarget{servantID: queryHit.ServantID, proxies: pushProxiesOf(queryHit.Trailer)}
+}
+
+// Opens a connection for an HTTP request to a servant, over TLS if it supports
+// it. Firewalled servants are pushed to and the connection they open back with a GIV is returned.
+func (teller *GoTeller) dialServant(ctx context.Context, to ipaddr.IPAddr, fileIndex uint32) (net.Conn, *bufio.Reader, error) {
+	teller.pushMutex.Lock()
+	target, ok := teller.pushTargets[to]
+	teller.pushMutex.Unlock()
+	if !ok {
+		conn, err := teller.dial(ctx, to) // in tls.go
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, bufio.NewReader(conn), nil
+	}
+	waiter := teller.pushWaiter(target.servantID)
+	if !teller.sendPush(*target, fileIndex) {
+		return nil, nil, fmt.Errorf("Couldn't push to firewalled servant at %s", to.String())
+	}
+	select {
+	case giv := <-waiter:
+		return giv, giv.reader, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-time.After(PUSH_TIMEOUT):
+		return nil, nil, fmt.Errorf("Firewalled servant at %s didn't connect back after a push", to.String())
+	}
+}
+
+// Asks a firewalled servant to connect to this one, through its push proxies
+// or else with a PUSH routed back along the path of its query hit
+func (teller *GoTeller) sendPush(target pushTarget, fileIndex uint32) bool {
+	for _, proxy := range target.proxies {
+		err := teller.requestPushProxy(proxy, target.servantID, fileIndex)
+		if err == nil {
+			return true
+		}
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+	}
+	teller.pushMutex.Lock()
+	route, ok := teller.pushRoutes[target.servantID]
+	teller.pushMutex.Unlock()
+	if !ok {
+		return false
+	}
+	push := messages.PushMsg{ServantID: string(target.servantID[:]), FileIndex: fileIndex, Addr: teller.addr}
+	pushBuffer := push.ToBytes()
+	header := messages.DescHeader{
+		DescID:      teller.newID(),
+		PayloadDesc: messages.PUSH,
+		TTL:         PUSH_TTL,
+		Hops:        0,
+		PayloadLen:  uint32(len(pushBuffer)),
+	}
+	return teller.sendToNeighbor(append(header.ToBytes(), pushBuffer...), route)
+}
+
+// Asks a push proxy to push to the firewalled servant with the given ID
+func (teller *GoTeller) requestPushProxy(proxy ipaddr.IPAddr, servantID [16]byte, fileIndex uint32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PUSH_PROXY_TIMEOUT)
+	defer cancel()
+	path := fmt.Sprintf("%s?ServerID=%s&file=%d", PUSH_PROXY_PATH, servantIDEncoding.EncodeToString(servantID[:]), fileIndex)
+	header := make(http.Header)
+	header.Set("X-Node", teller.addr.String())
+	res, err := teller.openRequest(ctx, proxy, path, header) // in download.go
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Push proxy at %s responded with status \"%s\"", proxy.String(), res.Status)
+	}
+	return nil
+}
+
+// Returns the channel GIV connections from the servant with the given ID are
+// handed over on
+func (teller *GoTeller) pushWaiter(servantID [16]byte) chan *givConn {
+	teller.pushMutex.Lock()
+	defer teller.pushMutex.Unlock()
+	if teller.pushWaiters == nil {
+		teller.pushWaiters = make(map[[16]byte]chan *givConn)
+	}
+	waiter, ok := teller.pushWaiters[servantID]
+	if !ok {
+		waiter = make(chan *givConn)
+		teller.pushWaiters[servantID] = waiter
+	}
+	return waiter
+}
+
+// Handles a connection opened by a firewalled servant we pushed to. It starts
+// with "GIV <file index>:<servant ID in hex>/<filename>" and a blank line, after
+// which the connection is used for an HTTP request. Blocks until the download
+// is done with it.
+func (teller *GoTeller) onGIV(conn net.Conn, connIO *bufio.ReadWriter) {
+	line, err := connIO.Reader.ReadString('\n')
+	if err == nil {
+		_, err = connIO.Reader.ReadString('\n')
+	}
+	var servantID []byte
+	if err == nil {
+		colon, slash := strings.Index(line, ":"), strings.Index(line, "/")
+		if colon < 0 || slash < colon {
+			err = fmt.Errorf("Malformed GIV \"%s\"", strings.TrimSpace(line))
+		} else {
+			servantID, err = hex.DecodeString(line[colon+1 : slash])
+		}
+	}
+	if err == nil && len(servantID) != 16 {
+		err = fmt.Errorf("GIV has a servant ID of %d bytes", len(servantID))
+	}
+	if err != nil {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		return
+	}
+	var id [16]byte
+	copy(id[:], servantID)
+	teller.pushMutex.Lock()
+	waiter, ok := teller.pushWaiters[id]
+	teller.pushMutex.Unlock()
+	if !ok {
+		return // We didn't push to it
+	}
+	giv := &givConn{Conn: conn, reader: connIO.Reader, done: make(chan struct{})}
+	select {
+	case waiter <- giv:
+		<-giv.done
+	case <-time.After(time.Second):
+	}
+}
+
+// Routes a PUSH toward the firewalled servant it is for. If it is for this
+// servant, connects to the downloader with a GIV and serves its request.
+func (teller *GoTeller) onPush(header messages.DescHeader, push messages.PushMsg) {
+	id := teller.servantGUID()
+	if push.ServantID == string(id[:]) {
+		go teller.giv(push)
+		return
+	}
+	var servantID [16]byte
+	copy(servantID[:], push.ServantID)
+	teller.pushMutex.Lock()
+	route, ok := teller.pushProxyLeaves[servantID]
+	if !ok {
+		route, ok = teller.pushRoutes[servantID]
+	}
+	teller.pushMutex.Unlock()
+	if ok && header.TTL > 0 {
+		header.TTL--
+		header.Hops++
+		pushBuffer := push.ToBytes()
+		header.PayloadLen = uint32(len(pushBuffer))
+		teller.sendToNeighbor(append(header.ToBytes(), pushBuffer...), route)
+	}
+}
+
+// Connects to the servant that pushed to this one and serves its request
+func (teller *GoTeller) giv(push messages.PushMsg) {
+	defer func() {
+		if r := recover(); r != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, r)
+			}
+		}
+	}()
+	conn, err := net.DialTimeout("tcp", push.Addr.String(), PUSH_PROXY_TIMEOUT)
+	if err != nil {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		return
+	}
+	defer conn.Close()
+	id := teller.servantGUID()
+	connIO := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	giv := fmt.Sprintf("GIV %d:%s/%s\n\n", push.FileIndex, strings.ToUpper(hex.EncodeToString(id[:])), teller.sharedFilename(push.FileIndex))
+	err = sendBytes(connIO, []byte(giv)) // in requesthandler.go
+	if err != nil {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		return
+	}
+	teller.handleRequest(connIO, push.Addr) // in requesthandler.go
+}
+
+// Returns the filename of a file registered with ShareFile, or "" if there is
+// none with the given index
+func (teller *GoTeller) sharedFilename(fileIndex uint32) string {
+	teller.qrpMutex.RLock()
+	defer teller.qrpMutex.RUnlock()
+	for key := range teller.sharedFiles {
+		if key.fileIndex == fileIndex {
+			return key.filename
+		}
+	}
+	return ""
+}
+
+// As a firewalled leaf, asks ultrapeers that aren't yet push proxies to be, and
+// forgets those that are gone
+func (teller *GoTeller) requestPushProxies() {
+	if !teller.isLeaf() || !teller.Firewalled {
+		return
+	}
+	ultrapeers := teller.neighborsFor(teller.addr) // in ultrapeer.go
+	connected := make(map[ipaddr.IPAddr]bool)
+	for _, ultrapeer := range ultrapeers {
+		connected[ultrapeer] = true
+	}
+	teller.pushMutex.Lock()
+	for ultrapeer := range teller.pushProxies {
+		if !connected[ultrapeer] {
+			delete(teller.pushProxies, ultrapeer)
+		}
+	}
+	var asking []ipaddr.IPAddr
+	for _, ultrapeer := range ultrapeers {
+		if _, ok := teller.pushProxies[ultrapeer]; !ok {
+			asking = append(asking, ultrapeer)
+		}
+	}
+	teller.pushMutex.Unlock()
+	request := messages.VendorMsg{Vendor: messages.VENDOR_LIME, Selector: messages.LIME_PUSH_PROXY_REQUEST, Version: 2}
+	for _, ultrapeer := range asking {
+		teller.sendVendorMsg(request, teller.servantGUID(), ultrapeer) // in dynamicquery.go
+	}
+}
+
+// Returns the addresses of this servant's push proxies
+func (teller *GoTeller) currentPushProxies() []ipaddr.IPAddr {
+	teller.pushMutex.Lock()
+	defer teller.pushMutex.Unlock()
+	proxies := make([]ipaddr.IPAddr, 0, len(teller.pushProxies))
+	for _, proxy := range teller.pushProxies {
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
+
+func (teller *GoTeller) onPushProxyMsg(header messages.DescHeader, vendor messages.VendorMsg, from ipaddr.IPAddr) {
+	switch {
+	case vendor.Is(messages.VENDOR_LIME, messages.LIME_PUSH_PROXY_REQUEST):
+		// A leaf asks us to be its push proxy
+		if !teller.isUltrapeer() || !teller.isLeafPeer(from) {
+			return
+		}
+		teller.pushMutex.Lock()
+		if teller.pushProxyLeaves == nil {
+			teller.pushProxyLeaves = make(map[[16]byte]ipaddr.IPAddr)
+		}
+		teller.pushProxyLeaves[header.DescID] = from
+		teller.pushMutex.Unlock()
+		teller.sendVendorMsg(messages.PushProxyAck(teller.addr), header.DescID, from)
+	case vendor.Is(messages.VENDOR_LIME, messages.LIME_PUSH_PROXY_ACK):
+		proxy, err := vendor.PushProxyAddr()
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		if !teller.isUltrapeerPeer(from) {
+			return
+		}
+		teller.pushMutex.Lock()
+		if teller.pushProxies == nil {
+			teller.pushProxies = make(map[ipaddr.IPAddr]ipaddr.IPAddr)
+		}
+		teller.pushProxies[from] = proxy
+		teller.pushMutex.Unlock()
+	}
+}
+
+// Answers a push proxy request, "GET /gnet/push-proxy?ServerID=<servant ID in
+// base32>&file=<file index>" with the downloader's address in the X-Node
+// header, by sending a PUSH to the leaf
+func (teller *GoTeller) onPushProxyRequest(req *http.Request, connIO *bufio.ReadWriter) {
+	status, statusCode := "202 Accepted", http.StatusAccepted
+	servantID, err := servantIDEncoding.DecodeString(strings.ToUpper(req.URL.Query().Get("ServerID")))
+	node, nodeErr := ipaddr.ParseAddrString(req.Header.Get("X-Node"))
+	fileIndex, _ := strconv.ParseUint(req.URL.Query().Get("file"), 10, 32)
+	if err != nil || len(servantID) != 16 || nodeErr != nil {
+		status, statusCode = "400 Bad Request", http.StatusBadRequest
+	} else {
+		var id [16]byte
+		copy(id[:], servantID)
+		teller.pushMutex.Lock()
+		leaf, ok := teller.pushProxyLeaves[id]
+		teller.pushMutex.Unlock()
+		push := messages.PushMsg{ServantID: string(id[:]), FileIndex: uint32(fileIndex), Addr: *node}
+		pushBuffer := push.ToBytes()
+		header := messages.DescHeader{
+			DescID:      teller.newID(),
+			PayloadDesc: messages.PUSH,
+			TTL:         1,
+			Hops:        0,
+			PayloadLen:  uint32(len(pushBuffer)),
+		}
+		if !ok || !teller.isLeafPeer(leaf) || !teller.sendToNeighbor(append(header.ToBytes(), pushBuffer...), leaf) {
+			status, statusCode = "410 Gone", http.StatusGone // No longer connected to the leaf
+		}
+	}
+	res := buildResponse(status, statusCode, nil, 0, req) // in requesthandler.go
+	err = res.Write(connIO.Writer)
+	if err == nil {
+		err = connIO.Writer.Flush()
+	}
+	if err != nil && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, err)
+	}
+}
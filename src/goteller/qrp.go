@@ -0,0 +1,297 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"fmt"
+)
+
+const QRP_TABLE_BITS uint = 16 // Our route table has 2^QRP_TABLE_BITS entries
+const QRP_INFINITY byte = 7
+const QRP_ENTRY_BITS byte = 4
+const QRP_PATCH_CHUNK_SIZE int = 4096    // Max bytes of compressed patch in a PATCH message
+const QRP_MAX_TABLE_LEN uint32 = 1 << 21 // Largest neighbor table accepted
+
+// A neighbor's query route table, built from the RESET and PATCH messages it
+// sent. An entry is a match if it is below infinity.
+type routeTable struct {
+	bits           uint
+	infinity       byte
+	entries        []byte
+	patchData      []byte // Data of the PATCH sequence being received
+	patchSeqNo     byte
+	patchSeqSize   byte
+	patchEntryBits byte
+	compressor     byte
+}
+
+// Registers a file of the shared library. Once files are registered, neighbors
+// are sent a route table of the keywords in their filenames (and their URNs)
+// and only last hop queries that match a file are routed to this servant.
+// Results with a URN are also registered with ShareURN.
+func (teller *GoTeller) ShareFile(hit messages.HitResult) error {
+	if hit.URN != "" {
+		err := teller.ShareURN(hit) // in urn.go
+		if err != nil {
+			return err
+		}
+		hit.URN = messages.NormalizeURN(hit.URN)
+	}
+	teller.qrpMutex.Lock()
+	defer teller.qrpMutex.Unlock()
+	if teller.sharedFiles == nil {
+		teller.sharedFiles = make(map[sharedFileKey]messages.HitResult)
+	}
+	teller.sharedFiles[sharedFileKey{hit.FileIndex, hit.Filename}] = hit
+	teller.qrpVersion++
+	return nil
+}
+
+// Removes a file registered with ShareFile. Neighbors are sent the new route
+// table, which stays empty (matching nothing) if no files are left.
+func (teller *GoTeller) UnshareFile(fileIndex uint32, filename string) {
+	teller.qrpMutex.Lock()
+	defer teller.qrpMutex.Unlock()
+	key := sharedFileKey{fileIndex, filename}
+	if _, ok := teller.sharedFiles[key]; ok {
+		delete(teller.sharedFiles, key)
+		teller.qrpVersion++
+	}
+}
+
+// Builds the route table of the shared files. Must hold qrpMutex.
+func (teller *GoTeller) buildRouteTable() []byte {
+	entries := make([]byte, 1<<QRP_TABLE_BITS)
+	for i := range entries {
+		entries[i] = QRP_INFINITY
+	}
+	for _, hit := range teller.sharedFiles {
+		for _, keyword := range messages.QRPKeywords(hit.Filename) {
+			entries[messages.QRPHash(keyword, QRP_TABLE_BITS)] = 1
+		}
+		if hit.URN != "" {
+			entries[messages.QRPHash(hit.URN, QRP_TABLE_BITS)] = 1
+		}
+	}
+	return entries
+}
+
+// Returns the RESET and PATCH descriptors replacing a neighbor's copy of our
+// route table, or nil if there is nothing to send
+func (teller *GoTeller) routeTableMessages() ([]byte, uint64) {
+	teller.qrpMutex.RLock()
+	defer teller.qrpMutex.RUnlock()
+	if teller.qrpVersion == 0 {
+		return nil, 0 // No files registered. Neighbors route all queries here
+	}
+	entries := teller.buildRouteTable()
+	// A patch holds the change from a table of all infinity, in signed nibbles
+	patchData := make([]byte, len(entries)/2)
+	for i, entry := range entries {
+		delta := (entry - QRP_INFINITY) & 0x0F
+		if i%2 == 0 {
+			patchData[i/2] |= delta << 4
+		} else {
+			patchData[i/2] |= delta
+		}
+	}
+	patches := messages.PatchMessages(patchData, QRP_ENTRY_BITS, QRP_PATCH_CHUNK_SIZE)
+	if patches == nil {
+		return nil, 0
+	}
+	reset := messages.ResetTableMsg{TableLength: uint32(len(entries)), Infinity: QRP_INFINITY}
+	msgBuffer := teller.routeTableDescriptor(reset.ToBytes())
+	for _, patch := range patches {
+		msgBuffer = append(msgBuffer, teller.routeTableDescriptor(patch.ToBytes())...)
+	}
+	return msgBuffer, teller.qrpVersion
+}
+
+func (teller *GoTeller) routeTableDescriptor(payload []byte) []byte {
+	header := messages.DescHeader{
+		DescID:      teller.newID(),
+		PayloadDesc: messages.ROUTE_TABLE_UPDATE,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(payload)),
+	}
+	return append(header.ToBytes(), payload...)
+}
+
+// Sends our route table to the neighbors that don't have its latest version.
+// The RESET and PATCH descriptors are sent on a single connection so they are
+// handled in order.
+func (teller *GoTeller) sendRouteTables() {
+	msgBuffer, version := teller.routeTableMessages()
+	if msgBuffer == nil {
+		return
+	}
+	for _, addr := range teller.neighborsFor(teller.addr) { // in ultrapeer.go
+		teller.qrpMutex.RLock()
+		sentVersion := teller.qrpSent[addr]
+		teller.qrpMutex.RUnlock()
+		if sentVersion == version {
+			continue
+		}
+		if teller.sendToNeighbor(msgBuffer, addr) {
+			teller.qrpMutex.Lock()
+			if teller.qrpSent == nil {
+				teller.qrpSent = make(map[ipaddr.IPAddr]uint64)
+			}
+			teller.qrpSent[addr] = version
+			teller.qrpMutex.Unlock()
+		}
+	}
+}
+
+// Forgets the route table of a neighbor, and that it was sent ours
+func (teller *GoTeller) forgetRouteTable(neighbor ipaddr.IPAddr) {
+	teller.qrpMutex.Lock()
+	defer teller.qrpMutex.Unlock()
+	delete(teller.neighborTables, neighbor)
+	delete(teller.qrpSent, neighbor)
+}
+
+func (teller *GoTeller) onRouteTableUpdate(payload []byte, from ipaddr.IPAddr) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("Empty ROUTE_TABLE_UPDATE from %s", from.String())
+	}
+	teller.qrpMutex.Lock()
+	defer teller.qrpMutex.Unlock()
+	switch payload[0] {
+	case messages.QRP_RESET:
+		reset, err := messages.ParseResetTableBytes(payload)
+		if err != nil {
+			return err
+		}
+		bits := uint(0)
+		for uint32(1)<<bits < reset.TableLength {
+			bits++
+		}
+		if reset.TableLength != uint32(1)<<bits || reset.TableLength > QRP_MAX_TABLE_LEN || bits == 0 {
+			return fmt.Errorf("Route table length %d from %s must be a power of 2 no larger than %d", reset.TableLength, from.String(), QRP_MAX_TABLE_LEN)
+		}
+		table := &routeTable{
+			bits:     bits,
+			infinity: reset.Infinity,
+			entries:  make([]byte, reset.TableLength),
+		}
+		for i := range table.entries {
+			table.entries[i] = reset.Infinity
+		}
+		if teller.neighborTables == nil {
+			teller.neighborTables = make(map[ipaddr.IPAddr]*routeTable)
+		}
+		teller.neighborTables[from] = table
+	case messages.QRP_PATCH:
+		patch, err := messages.ParsePatchTableBytes(payload)
+		if err != nil {
+			return err
+		}
+		table, ok := teller.neighborTables[from]
+		if !ok {
+			return fmt.Errorf("PATCH from %s before RESET", from.String())
+		}
+		return table.addPatch(patch)
+	default:
+		return fmt.Errorf("Unknown ROUTE_TABLE_UPDATE variant %#x from %s", payload[0], from.String())
+	}
+	return nil
+}
+
+// Adds a PATCH message to the sequence being received and applies the sequence
+// once it is complete
+func (table *routeTable) addPatch(patch *messages.PatchTableMsg) error {
+	if patch.SeqNo == 1 {
+		table.patchData = nil
+		table.patchSeqSize = patch.SeqSize
+		table.patchEntryBits = patch.EntryBits
+		table.compressor = patch.Compressor
+	} else if patch.SeqNo != table.patchSeqNo+1 || patch.SeqSize != table.patchSeqSize {
+		table.patchData = nil
+		table.patchSeqNo = 0
+		return fmt.Errorf("PATCH %d/%d out of sequence", patch.SeqNo, patch.SeqSize)
+	}
+	table.patchSeqNo = patch.SeqNo
+	table.patchData = append(table.patchData, patch.Data...)
+	if patch.SeqNo < patch.SeqSize {
+		return nil
+	}
+	maxLen := (len(table.entries)*int(table.patchEntryBits) + 7) / 8
+	data, err := messages.PatchData(table.patchData, table.compressor, maxLen)
+	table.patchData = nil
+	table.patchSeqNo = 0
+	if err != nil {
+		return err
+	}
+	if len(data)*8 < len(table.entries)*int(table.patchEntryBits) {
+		return fmt.Errorf("PATCH has %d bytes of data for %d entries of %d bits", len(data), len(table.entries), table.patchEntryBits)
+	}
+	for i := range table.entries {
+		var delta int8
+		if table.patchEntryBits == 8 {
+			delta = int8(data[i])
+		} else if i%2 == 0 {
+			delta = int8(data[i/2]) >> 4 // Arithmetic shift keeps the sign
+		} else {
+			delta = int8(data[i/2]<<4) >> 4
+		}
+		table.entries[i] = byte(int8(table.entries[i]) + delta)
+	}
+	return nil
+}
+
+// True if every keyword of the query (or its URN) is in the table
+func (table *routeTable) matches(query messages.QueryMsg) bool {
+	present := func(keyword string) bool {
+		return table.entries[messages.QRPHash(keyword, table.bits)] < table.infinity
+	}
+	if query.URN != "" && present(messages.NormalizeURN(query.URN)) {
+		return true
+	}
+	keywords := messages.QRPKeywords(query.SearchQuery)
+	if len(keywords) == 0 {
+		return query.URN == "" // Can't tell without keywords
+	}
+	for _, keyword := range keywords {
+		if !present(keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+// True if a query should be routed to a neighbor. Last hop queries (with a TTL
+// of 0) only go to neighbors without a route table or whose table matches.
+func (teller *GoTeller) routeQueryTo(neighbor ipaddr.IPAddr, query messages.QueryMsg, ttl byte) bool {
+	if ttl > 0 {
+		return true
+	}
+	teller.qrpMutex.RLock()
+	defer teller.qrpMutex.RUnlock()
+	table, ok := teller.neighborTables[neighbor]
+	return !ok || table.matches(query)
+}
+
+// send a query to all neighbors except for from that it should be routed to
+func (teller *GoTeller) routeQuery(msg []byte, query messages.QueryMsg, ttl byte, from ipaddr.IPAddr) {
+	for _, addr := range teller.neighborsFor(from) { // in ultrapeer.go
+		if teller.routeQueryTo(addr, query, ttl) {
+			teller.sendToNeighbor(msg, addr)
+		}
+	}
+	teller.routeQueryToLeaves(msg, query, from)
+}
+
+// send a query to the leaves whose route table matches it
+func (teller *GoTeller) routeQueryToLeaves(msg []byte, query messages.QueryMsg, from ipaddr.IPAddr) {
+	for _, leaf := range teller.leavesFor(from) { // in ultrapeer.go
+		teller.qrpMutex.RLock()
+		table, ok := teller.neighborTables[leaf]
+		matches := ok && table.matches(query)
+		teller.qrpMutex.RUnlock()
+		if matches && !teller.sendToNeighbor(msg, leaf) {
+			teller.removeLeaf(leaf)
+		}
+	}
+}
@@ -1,15 +1,21 @@
 package goteller
 
 import (
+	"../messages"
 	"net/http"
 )
 
 type Query struct {
-	TTL         byte
-	MinSpeed    uint16
-	SearchQuery string
-	onHit       func([]QueryResult, uint32, string) []QueryResult
-	onResponse  func(error, uint32, string, *http.Response)
+	TTL           byte
+	MinSpeed      uint16
+	SearchQuery   string
+	URN           string         // If set, also searches for files with this "urn:sha1:" URN. SearchQuery may then be empty
+	GGEP          messages.GGEP  // Extensions attached to the query. Optional
+	DownloadDir   string         // If set, results chosen by OnHit are queued with the download manager into this directory instead of being passed to OnResponse
+	TargetResults int            // If set on an ultrapeer, the query is sent by dynamic querying until OnHit has kept this many results. TTL is then ignored. On a leaf, ultrapeers are told to stop once OnHit has kept this many
+	Strategy      SearchStrategy // How the query is sent. Defaults to flooding with TTL
+	onHit         func([]QueryResult, uint32, string) []QueryResult
+	onResponse    func(error, uint32, string, *http.Response)
 }
 
 func (query *Query) OnHit(onhit func([]QueryResult, uint32, string) []QueryResult) {
@@ -4,6 +4,7 @@ import (
 	"../ipaddr"
 	"../messages"
 	"fmt"
+	"sync/atomic"
 )
 
 func (teller *GoTeller) onQuery(header messages.DescHeader, query messages.QueryMsg, from ipaddr.IPAddr) {
@@ -18,21 +19,16 @@ func (teller *GoTeller) onQuery(header messages.DescHeader, query messages.Query
 	} else { // Haven't seen it.
 		teller.queryMapMutex.RUnlock()
 	}
+	if !teller.filterQuery(header, &query, from) { // in spamfilter.go
+		return
+	}
 
-	if teller.NetworkSpeed >= uint32(query.MinSpeed) {
+	if teller.NetworkSpeed >= uint32(query.Speed()) {
 		// This node meets speed requirements for query
-		hitResults := teller.queryFunc(query.SearchQuery)
+		hitResults := teller.answerQuery(query) // in urn.go
 		if len(hitResults) > 0 {
 			// Found results for given query
-			var id [16]byte
-			copy(id[:], []byte(teller.servantID))
-			queryHit := messages.QueryHitMsg{
-				NumHits:   byte(len(hitResults)),
-				Addr:      teller.addr,
-				Speed:     teller.NetworkSpeed,
-				ResultSet: []messages.HitResult(hitResults),
-				ServantID: id,
-			}
+			queryHit := teller.queryHitFor(header.DescID, hitResults)
 			queryHitBuffer := queryHit.ToBytes()
 			queryHitHeader := messages.DescHeader{
 				DescID:      header.DescID,
@@ -43,48 +39,74 @@ func (teller *GoTeller) onQuery(header messages.DescHeader, query messages.Query
 			}
 			headerBuffer := queryHitHeader.ToBytes()
 			msgBuffer := append(headerBuffer, queryHitBuffer...)
-			sent := teller.sendToNeighbor(msgBuffer, from) // Send hit to neighbor
-			if !sent {
+			// Hits for an out of band query are sent over UDP once its sender claims them
+			offered := query.IsOOB() && teller.offerOOBHits(header.DescID, queryHit, msgBuffer, from) // in oob.go
+			if !offered && !teller.sendToNeighbor(msgBuffer, from) {                                  // Send hit to neighbor
 				if teller.debugFile != nil {
 					fmt.Fprintln(teller.debugFile, "Couldn't send QueryHitMsg to neighbor at "+from.String())
 				}
 			}
 		}
 	}
-	// Forward query to neighbors if TTL > 0
-	if header.TTL > 0 {
+	walker := query.GGEP.Has(RANDOM_WALK_GGEP_ID)
+	if teller.isUltrapeer() && teller.isLeafPeer(from) && !walker {
+		// Query from a leaf. Send it on by dynamic querying whatever its TTL
+		header.Hops++
+		teller.queryMapMutex.Lock()
+		teller.savedQueries[header.DescID] = from // Save to savedQueries map
+		teller.queryMapMutex.Unlock()
+		go teller.dynamicQuery(header, query, from, DEFAULT_TARGET_RESULTS, nil) // in dynamicquery.go
+		return
+	}
+	// Forward query to neighbors if TTL > 0. Leaves never forward queries
+	if header.TTL > 0 && !teller.isLeaf() {
 		header.TTL--
 		header.Hops++
-		msgBuffer := append(header.ToBytes(), query.ToBytes()...)
+		queryBuffer := query.ToBytes()
+		header.PayloadLen = uint32(len(queryBuffer)) // Filters may have changed the query's length
+		msgBuffer := append(header.ToBytes(), queryBuffer...)
 		teller.queryMapMutex.Lock()
 		teller.savedQueries[header.DescID] = from // Save to savedQueries map
 		teller.queryMapMutex.Unlock()
-		teller.floodToNeighbors(msgBuffer, from)
-	} else {
-		teller.queryMapMutex.RUnlock()
+		if walker {
+			teller.forwardWalker(msgBuffer, query, header.TTL, from) // in searchstrategy.go
+		} else {
+			teller.routeQuery(msgBuffer, query, header.TTL, from) // in qrp.go
+		}
+	}
+}
+
+// Returns this servant's query hit for the given results of a query
+func (teller *GoTeller) queryHitFor(descID [16]byte, hitResults []messages.HitResult) messages.QueryHitMsg {
+	queryHit := messages.QueryHitMsg{
+		NumHits:   byte(len(hitResults)),
+		Addr:      teller.addr,
+		Speed:     teller.NetworkSpeed,
+		ResultSet: hitResults,
+		Trailer:   teller.hitTrailer(),
+		ServantID: teller.servantGUID(), // in push.go
 	}
+	teller.signQueryHit(&queryHit, descID) // in identity.go
+	// Hits may be sent over UDP
+	teller.tagGGEP(&queryHit.Trailer.GGEP, descID, queryHit.Addr, queryHit.ToBytes) // in private.go
+	return queryHit
 }
 
-func (teller *GoTeller) sendQuery(searchQuery string, ttl byte, minSpeed uint16, from ipaddr.IPAddr) [16]byte {
-	query := messages.QueryMsg{
-		MinSpeed:    minSpeed,
-		SearchQuery: searchQuery,
+// Returns the extended query hit descriptor for this servant's query hits
+func (teller *GoTeller) hitTrailer() *messages.QHDTrailer {
+	trailer := &messages.QHDTrailer{
+		VendorCode:  VENDOR_CODE,
+		PrivateData: teller.HitPrivateData,
 	}
-	queryBuffer := query.ToBytes()
-	header := messages.DescHeader{
-		DescID:      teller.newID(),
-		PayloadDesc: messages.QUERY,
-		TTL:         ttl,
-		Hops:        0,
-		PayloadLen:  uint32(len(queryBuffer)),
+	trailer.SetFlag(messages.EQHD_PUSH_FLAG, teller.Firewalled)
+	if teller.tlsConfig != nil {
+		trailer.GGEP.Set(messages.GGEP_TLS_ID, nil)
 	}
-	headerBuffer := header.ToBytes()
-	msgBuffer := append(headerBuffer, queryBuffer...)
-	if from != teller.addr {
-		teller.queryMapMutex.Lock()
-		teller.savedQueries[header.DescID] = from // Save to savedQueries map
-		teller.queryMapMutex.Unlock()
+	if proxies := teller.currentPushProxies(); teller.Firewalled && len(proxies) > 0 { // in push.go
+		trailer.GGEP.Set(messages.GGEP_PUSH_ID, messages.PackIPPorts(proxies))
 	}
-	teller.floodToNeighbors(msgBuffer, from)
-	return header.DescID
+	trailer.SetFlag(messages.EQHD_BUSY_FLAG, teller.uploadsBusy()) // in uploadqueue.go
+	trailer.SetFlag(messages.EQHD_UPLOADED_FLAG, atomic.LoadUint64(&teller.uploadCount) > 0)
+	trailer.SetFlag(messages.EQHD_SPEED_FLAG, false) // NetworkSpeed is set by the user
+	return trailer
 }
@@ -1,18 +1,59 @@
 package goteller
 
 import (
+	"../ipaddr"
 	"../messages"
+	"crypto/ed25519"
+	"fmt"
+	"path/filepath"
+	"strings"
 )
 
-func (teller *GoTeller) onQueryHit(header messages.DescHeader, queryHit messages.QueryHitMsg) {
+func (teller *GoTeller) onQueryHit(header messages.DescHeader, queryHit messages.QueryHitMsg, from ipaddr.IPAddr) {
+	// The signature of a hit for this node's query is checked before filters
+	// can change the hit
+	var signer ed25519.PublicKey
+	teller.myQueryMapMutex.RLock()
+	_, mine := teller.myQueries[header.DescID]
+	teller.myQueryMapMutex.RUnlock()
+	if mine {
+		signer, _ = queryHit.Signer(header.DescID)
+	}
+	if !teller.filterQueryHit(header, &queryHit, from) { // in spamfilter.go
+		return
+	}
+	teller.notePushRoute(queryHit, from) // in push.go
 	teller.myQueryMapMutex.RLock()
 	if query, ok := teller.myQueries[header.DescID]; ok {
 		// Query was from this node
 		teller.myQueryMapMutex.RUnlock()
+		teller.noteHitTLS(queryHit)     // in tls.go
+		teller.notePushTarget(queryHit) // in push.go
 		results := resultsFromHit(queryHit)
+		teller.noteSigner(results, signer)                 // in identity.go
+		teller.countSearchHit(header.DescID, len(results)) // in searchstrategy.go
 		chosenResults := query.onHit(results, queryHit.Speed, string(queryHit.ServantID[:]))
+		// Only results OnHit kept count towards the query's target
+		teller.myQueryMapMutex.Lock()
+		teller.myQueryResults[header.DescID] += len(chosenResults)
+		teller.myQueryMapMutex.Unlock()
+		teller.countDynamicHits(header.DescID, len(chosenResults)) // in dynamicquery.go
 		for _, result := range chosenResults {
-			go teller.sendRequest(result.fileIndex, result.filename, result.addr, query.onResponse)
+			if query.DownloadDir != "" {
+				if !safeFilename(result.filename) {
+					if teller.debugFile != nil {
+						fmt.Fprintf(teller.debugFile, "Not downloading result with unsafe filename \"%s\"\n", result.filename)
+					}
+					continue
+				}
+				path := teller.downloadPathFor(query.DownloadDir, result.DownloadSource()) // in downloadmanager.go
+				_, err := teller.EnqueueDownload(path, result.DownloadSource())
+				if err != nil && teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
+				}
+			} else {
+				go teller.sendRequest(result.fileIndex, result.filename, result.addr, query.onResponse)
+			}
 		}
 	} else {
 		// Is not your own query... must forward to appropriate neighbor
@@ -20,14 +61,38 @@ func (teller *GoTeller) onQueryHit(header messages.DescHeader, queryHit messages
 		teller.queryMapMutex.RLock()
 		if querySrc, ok := teller.savedQueries[header.DescID]; ok {
 			teller.queryMapMutex.RUnlock()
+			teller.countDynamicHits(header.DescID, int(queryHit.NumHits))
 			if header.TTL > 0 { // Only forward if TTL > 0
 				header.TTL--
 				header.Hops++
-				msgBuffer := append(header.ToBytes(), queryHit.ToBytes()...)
-				teller.sendToNeighbor(msgBuffer, querySrc)
+				guess := teller.isGUESSQuery(header.DescID) // in guess.go
+				if guess && queryHit.Trailer != nil {
+					// Filters may have changed the hit since its sender tagged it
+					teller.tagGGEP(&queryHit.Trailer.GGEP, header.DescID, queryHit.Addr, queryHit.ToBytes) // in private.go
+				}
+				// Filters and tags may have changed the hit's length
+				queryHitBuffer := queryHit.ToBytes()
+				header.PayloadLen = uint32(len(queryHitBuffer))
+				if guess {
+					err := teller.sendUDP(append(header.ToBytes(), queryHitBuffer...), querySrc)
+					if err != nil && teller.debugFile != nil {
+						fmt.Fprintln(teller.debugFile, err)
+					}
+				} else {
+					teller.sendToNeighbor(append(header.ToBytes(), queryHitBuffer...), querySrc)
+				}
 			}
 		} else {
 			teller.queryMapMutex.RUnlock()
 		}
 	}
 }
+
+// True if a filename from a query hit can be used as the name of a file in a
+// download directory without reaching outside of it
+func safeFilename(name string) bool {
+	if name == "" || name == "." || name == ".." || filepath.VolumeName(name) != "" {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\\x00")
+}
@@ -3,13 +3,20 @@ package goteller
 import (
 	"../ipaddr"
 	"../messages"
+	"crypto/ed25519"
 )
 
 type QueryResult struct {
-	fileIndex uint32
-	fileSize  uint32
-	filename  string
-	addr      ipaddr.IPAddr
+	fileIndex   uint32
+	fileSize    uint32
+	filename    string
+	urn         string
+	ggep        messages.GGEP
+	addr        ipaddr.IPAddr
+	trailer     *messages.QHDTrailer
+	signer      ed25519.PublicKey
+	trusted     bool
+	trustedName string
 }
 
 func (qr *QueryResult) GetFileIndex() uint32 {
@@ -24,6 +31,135 @@ func (qr *QueryResult) GetFilename() string {
 	return qr.filename
 }
 
+// Returns the "urn:sha1:" URN of the file's contents, or "" if the servant
+// didn't give one
+func (qr *QueryResult) GetURN() string {
+	return qr.urn
+}
+
+// Returns the GGEP extensions the servant attached to this result
+func (qr *QueryResult) GetGGEP() messages.GGEP {
+	return qr.ggep
+}
+
+// Returns the vendor code of the responding servant's implementation, or "" if
+// the query hit didn't have an extended query hit descriptor
+func (qr *QueryResult) GetVendorCode() string {
+	if qr.trailer == nil {
+		return ""
+	}
+	return qr.trailer.VendorCode
+}
+
+// True if the servant is firewalled, so the file must be fetched with a push
+func (qr *QueryResult) IsPushNeeded() bool {
+	return qr.trailerFlag(messages.EQHD_PUSH_FLAG)
+}
+
+// True if all of the servant's upload slots were in use
+func (qr *QueryResult) IsBusy() bool {
+	return qr.trailerFlag(messages.EQHD_BUSY_FLAG)
+}
+
+// True if the servant has completed at least one upload
+func (qr *QueryResult) HasUploaded() bool {
+	return qr.trailerFlag(messages.EQHD_UPLOADED_FLAG)
+}
+
+// True if the servant's speed was measured rather than set by its user
+func (qr *QueryResult) IsSpeedMeasured() bool {
+	return qr.trailerFlag(messages.EQHD_SPEED_FLAG)
+}
+
+// Returns the extended query hit descriptor of the query hit, with its private
+// data, or nil if it didn't have one
+func (qr *QueryResult) GetTrailer() *messages.QHDTrailer {
+	return qr.trailer
+}
+
+// Flags the servant didn't give a value for are false
+func (qr *QueryResult) trailerFlag(flag byte) bool {
+	if qr.trailer == nil {
+		return false
+	}
+	value, known := qr.trailer.Flag(flag)
+	return value && known
+}
+
+// Returns the push proxies the servant gave in its query hit. Downloads from a
+// firewalled servant ask them to push to it.
+func (qr *QueryResult) GetPushProxies() []ipaddr.IPAddr {
+	return pushProxiesOf(qr.trailer) // in push.go
+}
+
+// True if the servant accepts TLS connections, which downloads from it then use
+func (qr *QueryResult) SupportsTLS() bool {
+	return qr.trailer != nil && qr.trailer.GGEP.Has(messages.GGEP_TLS_ID)
+}
+
+// Returns the identity key whose signature of the query hit verified, and false
+// if the hit wasn't signed or its signature didn't verify
+func (qr *QueryResult) GetSigner() (ed25519.PublicKey, bool) {
+	return qr.signer, qr.signer != nil
+}
+
+// True if the query hit was signed by a key in the trust store
+func (qr *QueryResult) IsTrusted() bool {
+	return qr.trusted
+}
+
+// Returns the name the key that signed the query hit is trusted under, or "" if
+// it isn't trusted
+func (qr *QueryResult) GetTrustedName() string {
+	return qr.trustedName
+}
+
+func (qr *QueryResult) GetAddr() ipaddr.IPAddr {
+	return qr.addr
+}
+
+// Returns this result as a source for the download manager
+func (qr *QueryResult) DownloadSource() DownloadSource {
+	return DownloadSource{Addr: qr.addr.String(), FileIndex: qr.fileIndex, Filename: qr.filename, URN: qr.urn, Size: int64(qr.fileSize)}
+}
+
+// Groups results that are the same content, i.e. have the same size and URN,
+// but come from different servants. Results without a URN are grouped by size
+// and filename instead. Each group can be passed to SwarmDownload or
+// EnqueueDownload as the sources of one file.
+func GroupResults(results []QueryResult) [][]QueryResult {
+	type contentKey struct {
+		urn      string
+		filename string
+		size     uint32
+	}
+	var groups [][]QueryResult
+	groupIdx := make(map[contentKey]int)
+	for _, result := range results {
+		key := contentKey{urn: result.urn, size: result.fileSize}
+		if result.urn == "" {
+			key.filename = result.filename
+		}
+		idx, ok := groupIdx[key]
+		if !ok {
+			groupIdx[key] = len(groups)
+			groups = append(groups, []QueryResult{result})
+			continue
+		}
+		sameServant := false
+		for _, other := range groups[idx] {
+			if other.addr == result.addr {
+				sameServant = true
+				break
+			}
+		}
+		if !sameServant {
+			groups[idx] = append(groups[idx], result)
+		}
+	}
+	return groups
+}
+
 func resultsFromHit(queryHit messages.QueryHitMsg) []QueryResult {
 	numResults := len(queryHit.ResultSet)
 	if numResults == 0 {
@@ -35,7 +171,10 @@ func resultsFromHit(queryHit messages.QueryHitMsg) []QueryResult {
 			fileIndex: hit.FileIndex,
 			fileSize:  hit.FileSize,
 			filename:  hit.Filename,
+			urn:       hit.URN,
+			ggep:      hit.GetGGEP(),
 			addr:      queryHit.Addr,
+			trailer:   queryHit.Trailer,
 		}
 	}
 	return results
@@ -3,43 +3,33 @@ package goteller
 import (
 	"../ipaddr"
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"net"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-func (teller *GoTeller) sendRequest(fileIndex uint32, filename string, to ipaddr.IPAddr, onResponse func(error, uint32, string, *http.Response)) {
-	endpoint := to.String()
-	path := fmt.Sprintf("/get/%d/%s", fileIndex, filename)
-	req, err := http.NewRequest("GET", "http://"+endpoint+path, nil)
-	if err != nil {
-		onResponse(err, fileIndex, filename, nil)
-		return
-	}
-	conn, err := net.Dial("tcp", endpoint)
-	if err != nil {
-		onResponse(err, fileIndex, filename, nil)
-		return
-	}
-	err = req.Write(conn)
-	if err != nil {
-		onResponse(err, fileIndex, filename, nil)
-		return
-	}
+const N2R_PATH string = "/uri-res/N2R"
 
-	connReader := bufio.NewReader(conn)
-	res, err := http.ReadResponse(connReader, req)
+func (teller *GoTeller) sendRequest(fileIndex uint32, filename string, to ipaddr.IPAddr, onResponse func(error, uint32, string, *http.Response)) {
+	res, err := teller.openRequest(context.Background(), to, requestPath(fileIndex, filename, ""), nil) // in download.go
 	if err != nil {
 		onResponse(err, fileIndex, filename, nil)
 		return
 	}
-
 	onResponse(nil, fileIndex, filename, res)
 }
 
-func (teller *GoTeller) handleRequest(connIO *bufio.ReadWriter) {
+func (teller *GoTeller) handleRequest(connIO *bufio.ReadWriter, from ipaddr.IPAddr) {
 	req, err := http.ReadRequest(connIO.Reader)
+	if err == nil {
+		req, err = teller.authorizeRequest(req, connIO, from) // in private.go
+	}
 	if err != nil {
 		if teller.debugFile != nil {
 			fmt.Fprintln(teller.debugFile, err)
@@ -47,18 +37,33 @@ func (teller *GoTeller) handleRequest(connIO *bufio.ReadWriter) {
 		return
 	}
 
-	path := req.URL.Path[1:] // drop the leading '/'
+	if req.URL.Path == PUSH_PROXY_PATH {
+		teller.onPushProxyRequest(req, connIO) // in push.go
+		return
+	}
+
 	var fileIdx uint32
 	var filename string
-	n, err := fmt.Sscanf(path, "get/%d/%s", &fileIdx, &filename)
+	var n int
+	if req.URL.Path == N2R_PATH {
+		// Request by URN: /uri-res/N2R?urn:sha1:...
+		hit, ok := teller.lookupURN(req.URL.RawQuery) // in urn.go
+		if ok {
+			fileIdx, filename, n = hit.FileIndex, hit.Filename, 2
+		} else {
+			err = fmt.Errorf("No shared file with URN \"%s\"", req.URL.RawQuery)
+		}
+	} else {
+		path := req.URL.Path[1:] // drop the leading '/'
+		n, err = fmt.Sscanf(path, "get/%d/%s", &fileIdx, &filename)
+		if err == nil && n != 2 && teller.debugFile != nil {
+			fmt.Fprintf(teller.debugFile, "Scanned %d out of 2 values in path \"%s\"", n, path)
+		}
+	}
 	if err != nil {
 		if teller.debugFile != nil {
 			fmt.Fprintln(teller.debugFile, err)
 		}
-	} else if n != 2 {
-		if teller.debugFile != nil {
-			fmt.Fprintf(teller.debugFile, "Scanned %d out of 2 values in path \"%s\"", n, path)
-		}
 	}
 	if err != nil || n != 2 {
 		res := buildNotFoundResponse(req)
@@ -70,28 +75,188 @@ func (teller *GoTeller) handleRequest(connIO *bufio.ReadWriter) {
 			}
 		}
 	} else {
-		// Valid request
-		bodyReader, length := teller.requestFunc(fileIdx, filename)
-		if length < 0 {
-			res := buildNotFoundResponse(req)
-			res.Write(connIO.Writer)
-			err = connIO.Writer.Flush()
-			if err != nil {
-				if teller.debugFile != nil {
+		// Valid request. Requests refused by the OnUploadRequest callback don't take a place in the upload queue
+		var res http.Response
+		if teller.uploadRequestFunc != nil {
+			res = buildUploadResponse(req, teller.uploadRequestFunc(teller.uploadRequest(req, from, fileIdx, filename))) // in upload.go
+			if res.StatusCode >= 300 {
+				err = teller.writeUpload(connIO, res, from)
+				if err != nil && teller.debugFile != nil {
 					fmt.Fprintln(teller.debugFile, err)
 				}
+				return
 			}
-		} else {
-			res := buildResponse("200 OK", 200, bodyReader, length, req)
-			res.Write(connIO.Writer)
-			err = connIO.Writer.Flush()
-			if err != nil {
-				if teller.debugFile != nil {
-					fmt.Fprintln(teller.debugFile, err)
-				}
+		}
+		entry, granted := teller.reserveUploadSlot(req, from, fileIdx, filename) // in uploadqueue.go
+		if !granted {
+			if res.Body != nil {
+				res.Body.Close()
+			}
+			err = teller.writeUpload(connIO, teller.buildBusyResponse(req, entry), from)
+			if err != nil && teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		defer teller.releaseUploadSlot()
+		if teller.uploadRequestFunc == nil {
+			var body io.Reader
+			var length int64
+			if teller.rangeRequestFunc != nil {
+				body, length = teller.rangeRequestFunc(fileIdx, filename)
+			} else {
+				body, length = teller.requestFunc(fileIdx, filename)
 			}
+			res = buildFileResponse(req, body, length)
+		}
+		urn := teller.urnOf(fileIdx, filename)
+		if urn != "" && res.StatusCode < 300 && res.Header.Get("X-Gnutella-Content-URN") == "" {
+			res.Header.Set("X-Gnutella-Content-URN", urn)
+		}
+		err = teller.writeUpload(connIO, res, from)
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+		} else if res.StatusCode < 300 {
+			atomic.AddUint64(&teller.uploadCount, 1)
+		}
+	}
+}
+
+// Sends the response to a request for a file within the upload bandwidth limits
+func (teller *GoTeller) writeUpload(connIO *bufio.ReadWriter, res http.Response, to ipaddr.IPAddr) error {
+	if res.Body != nil {
+		// Response.Write doesn't close empty bodies or ones it fails before sending
+		body := &onceCloser{ReadCloser: res.Body}
+		res.Body = body
+		defer body.Close()
+	}
+	err := res.Write(&throttledWriter{writer: connIO.Writer, teller: teller, class: TRAFFIC_UPLOAD, peer: to}) // in bandwidth.go
+	if err != nil {
+		return err
+	}
+	return connIO.Writer.Flush()
+}
+
+// Builds the response for a file of the given length, honoring the request's
+// Range header. Seeks to the start of a range if body is an io.Seeker and
+// otherwise skips over the preceding bytes.
+func buildFileResponse(req *http.Request, body io.Reader, length int64) http.Response {
+	closer, ok := body.(io.Closer)
+	if !ok {
+		closer = ioutil.NopCloser(nil)
+	}
+	if length < 0 {
+		closer.Close()
+		return buildNotFoundResponse(req)
+	}
+	start, end, ranged, err := parseRange(req.Header.Get("Range"), length)
+	if err != nil {
+		closer.Close()
+		res := buildResponse("416 Requested Range Not Satisfiable", 416, nil, 0, req)
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+		return res
+	}
+	if !ranged {
+		res := buildResponse("200 OK", 200, readCloser{body, closer}, length, req)
+		res.Header.Set("Accept-Ranges", "bytes")
+		return res
+	}
+	if seeker, ok := body.(io.Seeker); ok {
+		_, err = seeker.Seek(start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, body, start)
+	}
+	if err != nil {
+		closer.Close()
+		return buildNotFoundResponse(req)
+	}
+	rangeLen := end - start + 1
+	res := buildResponse("206 Partial Content", 206, readCloser{io.LimitReader(body, rangeLen), closer}, rangeLen, req)
+	res.Header.Set("Accept-Ranges", "bytes")
+	res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, length))
+	return res
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// A body that is closed at most once
+type onceCloser struct {
+	io.ReadCloser
+	once sync.Once
+}
+
+func (body *onceCloser) Close() error {
+	var err error
+	body.once.Do(func() {
+		err = body.ReadCloser.Close()
+	})
+	return err
+}
+
+// Parses a single range "bytes=start-end" header value into inclusive offsets.
+// ranged is false if there is no range or it can't be parsed (or has multiple
+// ranges), in which case the whole file should be sent. err is non nil if the
+// range can't be satisfied for a file of the given length.
+func parseRange(spec string, length int64) (start int64, end int64, ranged bool, err error) {
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	bounds := strings.SplitN(strings.TrimSpace(spec[len("bytes="):]), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false, nil
+	}
+	if bounds[0] == "" { // Suffix range: last n bytes
+		n, perr := strconv.ParseInt(bounds[1], 10, 64)
+		if perr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || length == 0 {
+			return 0, 0, false, fmt.Errorf("Range \"%s\" not satisfiable for length %d", spec, length)
+		}
+		if n > length {
+			n = length
+		}
+		return length - n, length - 1, true, nil
+	}
+	start, perr := strconv.ParseInt(bounds[0], 10, 64)
+	if perr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = length - 1
+	if bounds[1] != "" {
+		end, perr = strconv.ParseInt(bounds[1], 10, 64)
+		if perr != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= length {
+			end = length - 1
 		}
 	}
+	if start >= length {
+		return 0, 0, false, fmt.Errorf("Range \"%s\" not satisfiable for length %d", spec, length)
+	}
+	return start, end, true, nil
+}
+
+// Parses a Content-Range header value of the form "bytes start-end/length" or
+// "bytes */length". start and end are -1 for the latter.
+func parseContentRange(spec string) (start int64, end int64, length int64, err error) {
+	if n, _ := fmt.Sscanf(spec, "bytes */%d", &length); n == 1 {
+		return -1, -1, length, nil
+	}
+	n, err := fmt.Sscanf(spec, "bytes %d-%d/%d", &start, &end, &length)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if n != 3 || end < start {
+		return 0, 0, 0, fmt.Errorf("Malformed Content-Range \"%s\"", spec)
+	}
+	return start, end, length, nil
 }
 
 func buildNotFoundResponse(req *http.Request) http.Response {
@@ -108,9 +273,8 @@ func buildResponse(status string, statuscode int, body io.ReadCloser, bodyLen in
 		ContentLength: bodyLen,
 		Close:         true,
 		Request:       req,
-	}
-	if bodyLen > int64(0) {
-		res.Body = body
+		Header:        make(http.Header),
+		Body:          body, // Kept even if empty so it gets closed
 	}
 	return res
 }
@@ -0,0 +1,313 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const RANDOM_WALK_GGEP_ID string = "GTRW" // Marks a query as a random walker
+const DEFAULT_MAX_RING_TTL byte = 3
+const DEFAULT_RING_TARGET_RESULTS int = 50
+const DEFAULT_WALKERS int = 4
+const DEFAULT_WALK_TTL byte = 16
+const MAX_SEARCHES_KEPT int = 100 // Searches whose stats are kept
+
+// Decides how a query is sent over the network. Set on a Query to use it
+// instead of flooding.
+type SearchStrategy interface {
+	Name() string
+	// Sends the query with the methods of search. Runs on its own goroutine and
+	// the search is finished once it returns.
+	Search(search *Search)
+}
+
+// Traffic and recall of one of this servant's queries
+type SearchStats struct {
+	SearchQuery string
+	Strategy    string
+	Rounds      int // Descriptor IDs the query was sent under
+	Messages    int // Query descriptors sent by this servant
+	Hits        int // Query hit descriptors received
+	Results     int // Results in those hits
+	Started     time.Time
+	Finished    time.Time // Zero while the strategy is running
+}
+
+// A query being sent by a SearchStrategy
+type Search struct {
+	teller   *GoTeller
+	query    Query
+	queryMsg messages.QueryMsg
+	descID   [16]byte // ID of the current round
+	stats    SearchStats
+	mutex    sync.Mutex
+}
+
+// Sends the query to all neighbors with the query's TTL
+type Flood struct{}
+
+func (Flood) Name() string {
+	return "flood"
+}
+
+func (Flood) Search(search *Search) {
+	search.Flood(search.TTL())
+}
+
+// Floods the query with a TTL of StartTTL, and again with a TTL one higher in
+// each round while there are fewer than TargetResults results after Wait
+type ExpandingRing struct {
+	StartTTL      byte
+	MaxTTL        byte          // Defaults to DEFAULT_MAX_RING_TTL
+	TargetResults int           // Defaults to DEFAULT_RING_TARGET_RESULTS
+	Wait          time.Duration // Wait per hop of a round's TTL. Defaults to the servant's QueryWait
+}
+
+func (ExpandingRing) Name() string {
+	return "expanding ring"
+}
+
+func (ring ExpandingRing) Search(search *Search) {
+	if ring.MaxTTL == 0 {
+		ring.MaxTTL = DEFAULT_MAX_RING_TTL
+	}
+	if ring.TargetResults == 0 {
+		ring.TargetResults = DEFAULT_RING_TARGET_RESULTS
+	}
+	if ring.Wait == 0 {
+		ring.Wait = search.teller.QueryWait
+	}
+	for ttl := int(ring.StartTTL); ttl <= int(ring.MaxTTL); ttl++ { // An int so a MaxTTL of 255 doesn't wrap around
+		if ttl > int(ring.StartTTL) {
+			search.NewRound() // Servants that saw the last round would drop it as a duplicate
+		}
+		search.Flood(byte(ttl))
+		if !search.Wait(ring.Wait*time.Duration(ttl+1)) || search.Results() >= ring.TargetResults {
+			return
+		}
+	}
+}
+
+// Sends Walkers copies of the query to random neighbors. Each servant passes
+// a walker on to one random neighbor of its own until its TTL runs out.
+type RandomWalk struct {
+	Walkers int  // Defaults to DEFAULT_WALKERS
+	TTL     byte // Hops each walker takes. Defaults to DEFAULT_WALK_TTL
+}
+
+func (RandomWalk) Name() string {
+	return "random walk"
+}
+
+func (walk RandomWalk) Search(search *Search) {
+	if walk.Walkers == 0 {
+		walk.Walkers = DEFAULT_WALKERS
+	}
+	if walk.TTL == 0 {
+		walk.TTL = DEFAULT_WALK_TTL
+	}
+	queryMsg := search.Message()
+	queryMsg.GGEP = append(messages.GGEP(nil), queryMsg.GGEP...) // Don't change the caller's extensions
+	queryMsg.GGEP.Set(RANDOM_WALK_GGEP_ID, nil)
+	neighbors := search.Neighbors()
+	if len(neighbors) == 0 {
+		return
+	}
+	order := search.teller.randPerm(len(neighbors))
+	for i := 0; i < walk.Walkers; i++ {
+		if i > 0 {
+			search.NewRound() // Walkers have their own IDs so they don't drop each other
+		}
+		search.Send(neighbors[order[i%len(order)]], walk.TTL)
+	}
+}
+
+// Returns the stats of this servant's most recent queries
+func (teller *GoTeller) SearchStats() []SearchStats {
+	teller.searchMutex.Lock()
+	searches := append([]*Search(nil), teller.searchList...)
+	teller.searchMutex.Unlock()
+	stats := make([]SearchStats, 0, len(searches))
+	for _, search := range searches {
+		stats = append(stats, search.Stats())
+	}
+	return stats
+}
+
+// Registers a query of this servant under a new ID
+func (teller *GoTeller) newSearch(query Query, queryMsg messages.QueryMsg, strategy string) *Search {
+	search := &Search{
+		teller:   teller,
+		query:    query,
+		queryMsg: queryMsg,
+		stats: SearchStats{
+			SearchQuery: query.SearchQuery,
+			Strategy:    strategy,
+			Started:     time.Now(),
+		},
+	}
+	teller.searchMutex.Lock()
+	if teller.searches == nil {
+		teller.searches = make(map[[16]byte]*Search)
+	}
+	teller.searchList = append(teller.searchList, search)
+	if len(teller.searchList) > MAX_SEARCHES_KEPT {
+		old := teller.searchList[0]
+		teller.searchList = teller.searchList[1:]
+		for id, s := range teller.searches {
+			if s == old {
+				delete(teller.searches, id)
+			}
+		}
+	}
+	teller.searchMutex.Unlock()
+	search.NewRound()
+	return search
+}
+
+// Runs the strategy on the search
+func (search *Search) run(strategy SearchStrategy) {
+	defer func() {
+		if r := recover(); r != nil {
+			if search.teller.debugFile != nil {
+				fmt.Fprintln(search.teller.debugFile, r)
+			}
+		}
+		search.finish()
+	}()
+	strategy.Search(search)
+}
+
+func (search *Search) finish() {
+	search.mutex.Lock()
+	defer search.mutex.Unlock()
+	search.stats.Finished = time.Now()
+}
+
+// Counts a query hit for one of this servant's queries
+func (teller *GoTeller) countSearchHit(descID [16]byte, numResults int) {
+	teller.searchMutex.Lock()
+	search, ok := teller.searches[descID]
+	teller.searchMutex.Unlock()
+	if ok {
+		search.mutex.Lock()
+		search.stats.Hits++
+		search.stats.Results += numResults
+		search.mutex.Unlock()
+	}
+}
+
+// Gives the query a new ID for the messages sent after it. Results for all of
+// the search's IDs go to the same query.
+func (search *Search) NewRound() {
+	descID := search.teller.newID()
+	if search.queryMsg.IsOOB() {
+		descID = messages.OOBGUID(descID, search.teller.addr) // Hits are delivered to this servant over UDP
+	}
+	search.mutex.Lock()
+	search.descID = descID
+	search.stats.Rounds++
+	search.mutex.Unlock()
+	teller := search.teller
+	teller.myQueryMapMutex.Lock()
+	teller.myQueries[descID] = search.query
+	teller.myQueryMapMutex.Unlock()
+	teller.searchMutex.Lock()
+	teller.searches[descID] = search
+	teller.searchMutex.Unlock()
+}
+
+// Returns the query message sent by the search, which may be changed before
+// sending it
+func (search *Search) Message() *messages.QueryMsg {
+	return &search.queryMsg
+}
+
+// Returns the TTL set on the Query
+func (search *Search) TTL() byte {
+	return search.query.TTL
+}
+
+// Returns the neighbors the query can be sent to
+func (search *Search) Neighbors() []ipaddr.IPAddr {
+	return search.teller.neighborsFor(search.teller.addr) // in ultrapeer.go
+}
+
+// Sends the current round of the query to a neighbor with the given TTL.
+// Returns false if it couldn't be sent or the neighbor's route table doesn't
+// match a last hop query.
+func (search *Search) Send(to ipaddr.IPAddr, ttl byte) bool {
+	if !search.teller.routeQueryTo(to, search.queryMsg, ttl) { // in qrp.go
+		return false
+	}
+	if !search.teller.sendToNeighbor(search.msg(ttl), to) {
+		return false
+	}
+	search.countMessage()
+	return true
+}
+
+// Sends the current round of the query to all neighbors with the given TTL,
+// and to the leaves whose route table matches it
+func (search *Search) Flood(ttl byte) {
+	for _, addr := range search.Neighbors() {
+		search.Send(addr, ttl)
+	}
+	search.teller.routeQueryToLeaves(search.msg(ttl), search.queryMsg, search.teller.addr) // in qrp.go
+}
+
+// Waits for results. Returns false if the servant was stopped.
+func (search *Search) Wait(duration time.Duration) bool {
+	time.Sleep(duration)
+	return search.teller.alive
+}
+
+// Returns the number of results received so far
+func (search *Search) Results() int {
+	search.mutex.Lock()
+	defer search.mutex.Unlock()
+	return search.stats.Results
+}
+
+// Returns the traffic and results of the search so far
+func (search *Search) Stats() SearchStats {
+	search.mutex.Lock()
+	defer search.mutex.Unlock()
+	return search.stats
+}
+
+func (search *Search) countMessage() {
+	search.mutex.Lock()
+	defer search.mutex.Unlock()
+	search.stats.Messages++
+}
+
+func (search *Search) msg(ttl byte) []byte {
+	queryBuffer := search.queryMsg.ToBytes()
+	search.mutex.Lock()
+	descID := search.descID
+	search.mutex.Unlock()
+	header := messages.DescHeader{
+		DescID:      descID,
+		PayloadDesc: messages.QUERY,
+		TTL:         ttl,
+		Hops:        0,
+		PayloadLen:  uint32(len(queryBuffer)),
+	}
+	return append(header.ToBytes(), queryBuffer...)
+}
+
+// Passes a random walker on to one random neighbor, and to leaves whose route
+// table matches it
+func (teller *GoTeller) forwardWalker(msg []byte, query messages.QueryMsg, ttl byte, from ipaddr.IPAddr) {
+	teller.routeQueryToLeaves(msg, query, from) // in qrp.go
+	neighbors := teller.neighborsFor(from)
+	for _, i := range teller.randPerm(len(neighbors)) {
+		if teller.routeQueryTo(neighbors[i], query, ttl) && teller.sendToNeighbor(msg, neighbors[i]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Extensions of files spammers commonly pass off as what was searched for
+var SUSPICIOUS_EXTENSIONS = []string{".exe", ".scr", ".pif", ".com", ".bat", ".cmd", ".vbs", ".js", ".wsf", ".lnk"}
+
+// Inspects a query before it is answered or forwarded. The filter may rewrite
+// the query, and returns false to drop it.
+type QueryFilter func(header messages.DescHeader, query *messages.QueryMsg, from ipaddr.IPAddr) bool
+
+// Inspects a query hit before it reaches the application or is forwarded. The
+// filter may rewrite the hit, for example removing some of its results, and
+// returns false to drop it. Hits left without results are dropped.
+type HitFilter func(header messages.DescHeader, queryHit *messages.QueryHitMsg, from ipaddr.IPAddr) bool
+
+// Adds a filter that queries received from other servants go through, in the
+// order filters were added
+func (teller *GoTeller) AddQueryFilter(filter QueryFilter) {
+	teller.filtersMutex.Lock()
+	defer teller.filtersMutex.Unlock()
+	teller.queryFilters = append(teller.queryFilters, filter)
+}
+
+// Adds a filter that query hits received from other servants go through, in
+// the order filters were added
+func (teller *GoTeller) AddHitFilter(filter HitFilter) {
+	teller.filtersMutex.Lock()
+	defer teller.filtersMutex.Unlock()
+	teller.hitFilters = append(teller.hitFilters, filter)
+}
+
+// Drops queries whose search contains any of the given words or phrases.
+// Matching ignores case and punctuation.
+func KeywordQueryFilter(blocked ...string) QueryFilter {
+	return func(header messages.DescHeader, query *messages.QueryMsg, from ipaddr.IPAddr) bool {
+		return !containsKeywords(query.SearchQuery, blocked)
+	}
+}
+
+// Removes results whose filename contains any of the given words or phrases
+func KeywordHitFilter(blocked ...string) HitFilter {
+	return resultFilter(func(hit messages.HitResult) bool {
+		return !containsKeywords(hit.Filename, blocked)
+	})
+}
+
+// Removes results whose filename ends with one of the given extensions, or one
+// of SUSPICIOUS_EXTENSIONS if none are given
+func ExtensionHitFilter(extensions ...string) HitFilter {
+	if len(extensions) == 0 {
+		extensions = SUSPICIOUS_EXTENSIONS
+	}
+	suspicious := make(map[string]bool)
+	for _, extension := range extensions {
+		suspicious[strings.ToLower(extension)] = true
+	}
+	return resultFilter(func(hit messages.HitResult) bool {
+		return !suspicious[strings.ToLower(filepath.Ext(hit.Filename))]
+	})
+}
+
+// Removes results once more than maxCount results with the same filename have
+// been seen within window, as spammers answer every query with the same file
+// from many made up servants
+func DuplicateFilenameHitFilter(maxCount int, window time.Duration) HitFilter {
+	type filenameCount struct {
+		count int
+		start time.Time
+	}
+	var mutex sync.Mutex
+	counts := make(map[string]*filenameCount)
+	return resultFilter(func(hit messages.HitResult) bool {
+		now := time.Now()
+		filename := strings.ToLower(hit.Filename)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(counts) > MAX_KNOWN_HOSTS {
+			for name, seen := range counts {
+				if now.Sub(seen.start) >= window {
+					delete(counts, name)
+				}
+			}
+		}
+		seen, ok := counts[filename]
+		if !ok || now.Sub(seen.start) >= window {
+			seen = &filenameCount{start: now}
+			counts[filename] = seen
+		}
+		seen.count++
+		return seen.count <= maxCount
+	})
+}
+
+// Drops hits that come straight from the servant that sent them, i.e. with no
+// hops, whose address isn't the IP address the hit came from. Hits with the
+// push flag are let through, as firewalled servants often don't know their
+// address.
+func AddressMismatchHitFilter() HitFilter {
+	return func(header messages.DescHeader, queryHit *messages.QueryHitMsg, from ipaddr.IPAddr) bool {
+		if header.Hops > 0 {
+			return true
+		}
+		if queryHit.Trailer != nil {
+			if push, known := queryHit.Trailer.Flag(messages.EQHD_PUSH_FLAG); push && known {
+				return true
+			}
+		}
+		return queryHit.Addr.IP == from.IP
+	}
+}
+
+// Returns a hit filter keeping the results keep returns true for
+func resultFilter(keep func(messages.HitResult) bool) HitFilter {
+	return func(header messages.DescHeader, queryHit *messages.QueryHitMsg, from ipaddr.IPAddr) bool {
+		var kept []messages.HitResult
+		for _, hit := range queryHit.ResultSet {
+			if keep(hit) {
+				kept = append(kept, hit)
+			}
+		}
+		queryHit.ResultSet = kept
+		return true
+	}
+}
+
+// True if every keyword of one of the phrases is a keyword of text
+func containsKeywords(text string, phrases []string) bool {
+	keywords := make(map[string]bool)
+	for _, keyword := range messages.QRPKeywords(text) {
+		keywords[keyword] = true
+	}
+	for _, phrase := range phrases {
+		phraseKeywords := messages.QRPKeywords(phrase)
+		matched := len(phraseKeywords) > 0
+		for _, keyword := range phraseKeywords {
+			matched = matched && keywords[keyword]
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Passes a query through the query filters. Returns false if it was dropped.
+func (teller *GoTeller) filterQuery(header messages.DescHeader, query *messages.QueryMsg, from ipaddr.IPAddr) bool {
+	teller.filtersMutex.RLock()
+	filters := teller.queryFilters
+	teller.filtersMutex.RUnlock()
+	for _, filter := range filters {
+		if !filter(header, query, from) {
+			return false
+		}
+	}
+	return true
+}
+
+// Passes a query hit through the hit filters. Returns false if it was dropped
+// or has no results left. A hit the filters changed loses its signature, as
+// it would no longer verify.
+func (teller *GoTeller) filterQueryHit(header messages.DescHeader, queryHit *messages.QueryHitMsg, from ipaddr.IPAddr) bool {
+	teller.filtersMutex.RLock()
+	filters := teller.hitFilters
+	teller.filtersMutex.RUnlock()
+	if len(filters) == 0 {
+		return true
+	}
+	original := queryHit.ToBytes()
+	queryHit.ResultSet = append([]messages.HitResult(nil), queryHit.ResultSet...) // Filters may change it in place
+	for _, filter := range filters {
+		if !filter(header, queryHit, from) || len(queryHit.ResultSet) == 0 {
+			return false
+		}
+	}
+	queryHit.NumHits = byte(len(queryHit.ResultSet))
+	if queryHit.Trailer != nil && !bytes.Equal(original, queryHit.ToBytes()) {
+		trailer := *queryHit.Trailer
+		trailer.GGEP = append(messages.GGEP(nil), trailer.GGEP...)
+		trailer.GGEP.Remove(messages.GGEP_SIG_ID)
+		queryHit.Trailer = &trailer
+	}
+	return true
+}
@@ -0,0 +1,473 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SWARM_CHUNK_SIZE int64 = 256 * 1024
+const SWARM_MAX_SOURCE_FAILURES int = 3
+const SWARM_STALL_TIMEOUT time.Duration = 10 * time.Second // Chunks without progress for this long are reassigned
+const SWARM_MIN_REASSIGN int64 = 32 * 1024                 // Don't reassign chunks with less than this left
+const SWARM_READ_SIZE int = 32 * 1024
+
+// Describes a file to fetch in parallel from several servants sharing the same
+// content. The file is split into chunks which are requested with Range
+// requests from whichever source is free, so every source must support them.
+// Swarming from several sources requires the file's SHA1 URN, which every
+// source must share the file under, and a destination the assembled file can
+// be read back from to check it.
+type SwarmRequest struct {
+	Sources    []DownloadSource
+	Size       int64       // Length of the file. Required
+	URN        string      // Expected "urn:sha1:" URN. Required with several sources. Checked once assembled if writing to Path or Writer is also an io.ReaderAt
+	Writer     io.WriterAt // Destination of the file's contents
+	Path       string      // If Writer is nil, the file is assembled at Path + PARTIAL_SUFFIX and renamed to Path once complete. The partial file is removed if the download fails
+	Resume     bool        // Keep the bytes already at Path + PARTIAL_SUFFIX and fetch only the rest. If the download fails, the partial file is cut at its first missing byte instead of being removed
+	ChunkSize  int64       // Defaults to DEFAULT_SWARM_CHUNK_SIZE
+	OnProgress func(written int64, total int64)
+}
+
+// Transfer statistics for one of the sources of a swarmed download
+type SourceStats struct {
+	Source        DownloadSource
+	BytesReceived int64
+	Chunks        int           // Number of chunks completed by this source
+	Failures      int           // Number of failed requests. The source is dropped after SWARM_MAX_SOURCE_FAILURES
+	Reassigned    int           // Number of chunks taken away from this source for being slow
+	Active        time.Duration // Time spent receiving chunks
+	LastError     string
+}
+
+// Bytes per second received while active
+func (stats *SourceStats) Throughput() float64 {
+	if stats.Active <= 0 {
+		return 0
+	}
+	return float64(stats.BytesReceived) / stats.Active.Seconds()
+}
+
+// Outcome of a call to GoTeller.SwarmDownload
+type SwarmResult struct {
+	Size     int64
+	Written  int64
+	Duration time.Duration
+	Sources  []SourceStats
+}
+
+type swarmChunk struct {
+	start  int64 // First byte of the chunk
+	next   int64 // Next byte to be written
+	end    int64 // Last byte of the chunk. Lowered when the rest is reassigned
+	owner  *swarmSource
+	begun  time.Time // When owner last made progress on the chunk
+	cancel context.CancelFunc
+}
+
+type swarmSource struct {
+	addr       ipaddr.IPAddr
+	stats      SourceStats
+	fetchStart time.Time // Start of the current request. Zero if idle
+}
+
+// Bytes per second, counting the current request
+func (src *swarmSource) rate(now time.Time) float64 {
+	active := src.stats.Active
+	if !src.fetchStart.IsZero() {
+		active += now.Sub(src.fetchStart)
+	}
+	if active <= 0 {
+		return 0
+	}
+	return float64(src.stats.BytesReceived) / active.Seconds()
+}
+
+type swarm struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	writer     io.WriterAt
+	size       int64
+	urn        string // Expected URN, or "" if unknown
+	pending    []*swarmChunk
+	inFlight   map[*swarmChunk]bool
+	remaining  int // Chunks not yet complete
+	workers    int // Sources still in use
+	written    int64
+	onProgress func(int64, int64)
+}
+
+// Fetches a file from several sources at once. Blocks until the file has been
+// assembled, every source has failed or ctx is done. Chunks are taken away
+// from sources that stall or are much slower than an idle source.
+func (teller *GoTeller) SwarmDownload(ctx context.Context, sreq SwarmRequest) (*SwarmResult, error) {
+	if sreq.Size <= 0 {
+		return nil, fmt.Errorf("Must set Size on SwarmRequest")
+	}
+	if len(sreq.Sources) == 0 {
+		return nil, fmt.Errorf("Must give at least one source on SwarmRequest")
+	}
+	if sreq.Writer == nil && sreq.Path == "" {
+		return nil, fmt.Errorf("Must set either Writer or Path on SwarmRequest")
+	}
+	if len(sreq.Sources) > 1 {
+		err := checkSwarmURN(sreq)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sources := make([]*swarmSource, 0, len(sreq.Sources))
+	for _, source := range sreq.Sources {
+		addr, err := ipaddr.ParseAddrString(source.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if !teller.isBlocked(*addr) { // in ipfilter.go
+			sources = append(sources, &swarmSource{addr: *addr, stats: SourceStats{Source: source}})
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("Every source on SwarmRequest is blocked by the IP filter or banned")
+	}
+	chunkSize := sreq.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_SWARM_CHUNK_SIZE
+	}
+
+	writer := sreq.Writer
+	var file *os.File
+	var have int64 // Bytes kept from an earlier attempt
+	if writer == nil {
+		var err error
+		file, err = os.OpenFile(sreq.Path+PARTIAL_SUFFIX, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		writer = file
+		if info, err := file.Stat(); err == nil && sreq.Resume && info.Size() < sreq.Size {
+			have = info.Size()
+		}
+	}
+
+	sw := &swarm{
+		writer:     writer,
+		size:       sreq.Size,
+		urn:        messages.NormalizeURN(sreq.URN),
+		inFlight:   make(map[*swarmChunk]bool),
+		workers:    len(sources),
+		written:    have,
+		onProgress: sreq.OnProgress,
+	}
+	if file != nil {
+		defer func() {
+			if sw.remaining == 0 {
+				return
+			}
+			// Chunks are written out of order, so only the bytes before the first
+			// missing one can be resumed from
+			if sreq.Resume && file.Truncate(sw.firstMissing()) == nil {
+				return
+			}
+			file.Close()
+			os.Remove(sreq.Path + PARTIAL_SUFFIX)
+		}()
+	}
+	sw.cond = sync.NewCond(&sw.mutex)
+	for start := have; start < sreq.Size; start += chunkSize {
+		end := start + chunkSize - 1
+		if end >= sreq.Size {
+			end = sreq.Size - 1
+		}
+		sw.pending = append(sw.pending, &swarmChunk{start: start, next: start, end: end})
+	}
+	sw.remaining = len(sw.pending)
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { // Wakes idle workers so they can check for stalled chunks
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				sw.cond.Broadcast()
+				return
+			case <-ticker.C:
+				sw.cond.Broadcast()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src *swarmSource) {
+			defer wg.Done()
+			teller.swarmWorker(ctx, sw, src)
+		}(src)
+	}
+	wg.Wait()
+
+	result := &SwarmResult{Size: sreq.Size, Written: sw.written, Duration: time.Since(start)}
+	for _, src := range sources {
+		result.Sources = append(result.Sources, src.stats)
+	}
+	if sw.remaining > 0 {
+		if ctx.Err() != nil && sw.workers > 0 {
+			return result, ctx.Err()
+		}
+		return result, fmt.Errorf("All %d sources failed with %d chunks left", len(sources), sw.remaining)
+	}
+	if reader, ok := writer.(io.ReaderAt); ok && sreq.URN != "" {
+		urn, err := messages.ComputeSHA1URN(io.NewSectionReader(reader, 0, sreq.Size))
+		if err != nil {
+			return result, err
+		}
+		if urn != messages.NormalizeURN(sreq.URN) {
+			if file != nil {
+				file.Close()
+				os.Remove(sreq.Path + PARTIAL_SUFFIX)
+			}
+			return result, fmt.Errorf("Swarmed contents have URN %s instead of %s", urn, sreq.URN)
+		}
+	}
+	if file != nil {
+		err := file.Close()
+		if err != nil {
+			return result, err
+		}
+		err = os.Rename(sreq.Path+PARTIAL_SUFFIX, sreq.Path)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (teller *GoTeller) swarmWorker(ctx context.Context, sw *swarm, src *swarmSource) {
+	for {
+		chunk := sw.nextChunk(ctx, src)
+		if chunk == nil {
+			return
+		}
+		err := teller.fetchChunk(ctx, sw, src, chunk)
+		if !sw.finishChunk(src, chunk, err) {
+			if teller.debugFile != nil {
+				fmt.Fprintf(teller.debugFile, "Dropped swarm source %s: %s\n", src.addr, src.stats.LastError)
+			}
+			return
+		}
+	}
+}
+
+// Blocks until there is a chunk for src to fetch. Returns nil once the file is
+// complete or ctx is done.
+func (sw *swarm) nextChunk(ctx context.Context, src *swarmSource) *swarmChunk {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	for {
+		if sw.remaining == 0 || ctx.Err() != nil {
+			return nil
+		}
+		var chunk *swarmChunk
+		if len(sw.pending) > 0 {
+			chunk = sw.pending[0]
+			sw.pending = sw.pending[1:]
+		} else {
+			chunk = sw.reassignSlowChunk(src)
+		}
+		if chunk != nil {
+			chunk.owner = src
+			chunk.begun = time.Now()
+			sw.inFlight[chunk] = true
+			return chunk
+		}
+		sw.cond.Wait()
+	}
+}
+
+// Splits off the rest of an in flight chunk whose owner has stalled or is less
+// than half as fast as src. The old owner stops once it reaches the chunk's new
+// end. Must be called with sw.mutex held.
+func (sw *swarm) reassignSlowChunk(src *swarmSource) *swarmChunk {
+	now := time.Now()
+	srcRate := src.rate(now)
+	for chunk := range sw.inFlight {
+		if chunk.owner == src || chunk.end-chunk.next+1 < SWARM_MIN_REASSIGN {
+			continue
+		}
+		stalled := now.Sub(chunk.begun) > SWARM_STALL_TIMEOUT
+		slow := srcRate > 0 && chunk.owner.rate(now) < srcRate/2
+		if !stalled && !slow {
+			continue
+		}
+		rest := &swarmChunk{start: chunk.next, next: chunk.next, end: chunk.end}
+		chunk.end = chunk.next - 1
+		chunk.owner.stats.Reassigned++
+		if chunk.cancel != nil {
+			chunk.cancel()
+		}
+		sw.remaining++ // rest is a new chunk. The old one completes once its owner notices
+		return rest
+	}
+	return nil
+}
+
+// Checks that a swarm from several sources has a SHA1 URN that all of them
+// agree on, and a destination whose contents can be checked against it
+func checkSwarmURN(sreq SwarmRequest) error {
+	if !messages.IsSHA1URN(sreq.URN) {
+		return fmt.Errorf("Must set a SHA1 URN on SwarmRequest to swarm from several sources")
+	}
+	urn := messages.NormalizeURN(sreq.URN)
+	for _, source := range sreq.Sources {
+		if source.URN != "" && messages.NormalizeURN(source.URN) != urn {
+			return fmt.Errorf("Source %s has URN %s instead of %s", source.Addr, source.URN, sreq.URN)
+		}
+	}
+	if _, ok := sreq.Writer.(io.ReaderAt); sreq.Writer != nil && !ok {
+		return fmt.Errorf("Writer on SwarmRequest must also be an io.ReaderAt to check the contents of several sources")
+	}
+	return nil
+}
+
+// Requests the unwritten part of chunk from src and writes it as it arrives
+func (teller *GoTeller) fetchChunk(ctx context.Context, sw *swarm, src *swarmSource, chunk *swarmChunk) error {
+	chunkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sw.mutex.Lock()
+	chunk.cancel = cancel
+	from, to := chunk.next, chunk.end
+	src.fetchStart = time.Now()
+	sw.mutex.Unlock()
+	defer func() {
+		sw.mutex.Lock()
+		src.stats.Active += time.Since(src.fetchStart)
+		src.fetchStart = time.Time{}
+		sw.mutex.Unlock()
+	}()
+	if from > to { // Reassigned before it started
+		return nil
+	}
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", from, to)}}
+	source := src.stats.Source
+	res, err := teller.openRequest(chunkCtx, src.addr, requestPath(source.FileIndex, source.Filename, source.URN), header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Servant at %s responded to range request with status \"%s\"", src.addr, res.Status)
+	}
+	start, _, length, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != from || length != sw.size {
+		return fmt.Errorf("Servant at %s sent bytes %d-/%d instead of %d-/%d", src.addr, start, length, from, sw.size)
+	}
+	if urn := res.Header.Get("X-Gnutella-Content-URN"); sw.urn != "" && messages.IsSHA1URN(urn) && messages.NormalizeURN(urn) != sw.urn {
+		return fmt.Errorf("Servant at %s is sharing %s instead of %s", src.addr, messages.NormalizeURN(urn), sw.urn)
+	}
+
+	buffer := make([]byte, SWARM_READ_SIZE)
+	for {
+		n, readErr := res.Body.Read(buffer)
+		if n > 0 {
+			done, err := sw.write(src, chunk, buffer[:n])
+			if err != nil || done {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	if chunk.next <= chunk.end {
+		return fmt.Errorf("Servant at %s ended range early at byte %d", src.addr, chunk.next)
+	}
+	return nil
+}
+
+// Writes data received for chunk, dropping anything past its end. Returns true
+// once the chunk is complete.
+func (sw *swarm) write(src *swarmSource, chunk *swarmChunk, data []byte) (bool, error) {
+	sw.mutex.Lock()
+	if left := chunk.end - chunk.next + 1; int64(len(data)) > left {
+		data = data[:left]
+	}
+	var err error
+	if len(data) > 0 {
+		_, err = sw.writer.WriteAt(data, chunk.next)
+	}
+	if err == nil {
+		chunk.next += int64(len(data))
+		chunk.begun = time.Now()
+		src.stats.BytesReceived += int64(len(data))
+		sw.written += int64(len(data))
+	}
+	done := chunk.next > chunk.end
+	written := sw.written
+	sw.mutex.Unlock()
+	if sw.onProgress != nil && len(data) > 0 {
+		sw.onProgress(written, sw.size)
+	}
+	return done, err
+}
+
+// Returns the offset of the first byte not yet written. Every byte before it
+// has been.
+func (sw *swarm) firstMissing() int64 {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	missing := sw.size
+	for _, chunk := range sw.pending {
+		if chunk.next <= chunk.end && chunk.next < missing {
+			missing = chunk.next
+		}
+	}
+	for chunk := range sw.inFlight {
+		if chunk.next <= chunk.end && chunk.next < missing {
+			missing = chunk.next
+		}
+	}
+	return missing
+}
+
+// Records the outcome of fetching chunk. Whatever is left of a failed chunk is
+// queued for another source. Returns false if src should be dropped.
+func (sw *swarm) finishChunk(src *swarmSource, chunk *swarmChunk, err error) bool {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	defer sw.cond.Broadcast()
+	delete(sw.inFlight, chunk)
+	if chunk.next > chunk.end {
+		sw.remaining--
+		src.stats.Chunks++
+		return true
+	}
+	chunk.owner = nil
+	sw.pending = append([]*swarmChunk{chunk}, sw.pending...)
+	if err == nil {
+		return true
+	}
+	src.stats.Failures++
+	src.stats.LastError = err.Error()
+	if src.stats.Failures >= SWARM_MAX_SOURCE_FAILURES {
+		sw.workers--
+		return false
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+const TLS_RECORD_HANDSHAKE byte = 0x16 // First byte of a connection opened with TLS
+const TLS_CERT_VALIDITY time.Duration = 10 * 365 * 24 * time.Hour
+const TLS_FAILURE_TIMEOUT time.Duration = time.Hour // How long a servant TLS failed with is connected to in plaintext
+
+// Loads the servant's certificate, or generates a self-signed one if there
+// isn't one at TLSCertPath yet
+func (teller *GoTeller) initTLS() error {
+	if !teller.TLS {
+		return nil
+	}
+	var cert tls.Certificate
+	data, err := ioutil.ReadFile(teller.TLSCertPath)
+	if teller.TLSCertPath != "" && err == nil {
+		cert, err = tls.X509KeyPair(data, data)
+	} else {
+		data, err = selfSignedCertificate()
+		if err == nil {
+			cert, err = tls.X509KeyPair(data, data)
+		}
+		if err == nil && teller.TLSCertPath != "" {
+			err = ioutil.WriteFile(teller.TLSCertPath, data, 0600)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	teller.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// Returns the PEM encoded certificate and private key of a new self-signed
+// certificate
+func selfSignedCertificate() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: USER_AGENT},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(TLS_CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...), nil
+}
+
+// Dials a servant, over TLS if both this servant and it support it. Falls back
+// to plaintext if the TLS handshake fails, and doesn't try TLS with that
+// servant again for TLS_FAILURE_TIMEOUT.
+func (teller *GoTeller) dial(ctx context.Context, to ipaddr.IPAddr) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if teller.tlsConfig != nil && teller.supportsTLS(to) {
+		conn, err := dialer.DialContext(ctx, "tcp", to.String())
+		if err != nil {
+			return nil, err // The servant can't be reached at all, which says nothing about TLS
+		}
+		// Servants' certificates are self-signed, so they can't be verified
+		config := &tls.Config{Certificates: teller.tlsConfig.Certificates, InsecureSkipVerify: true}
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err == nil {
+			return tlsConn, nil
+		}
+		conn.Close()
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		if !handshakeFailed(ctx, err) {
+			return nil, err
+		}
+		teller.noteTLSFailure(to)
+	}
+	return dialer.DialContext(ctx, "tcp", to.String())
+}
+
+// True if a TLS handshake failed because the servant doesn't speak TLS or
+// refused ours, rather than because it timed out or was cancelled
+func handshakeFailed(ctx context.Context, err error) bool {
+	var netErr net.Error
+	if ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return false
+	}
+	return true
+}
+
+// True if a servant is known to accept TLS connections and a TLS handshake
+// with it hasn't failed in the last TLS_FAILURE_TIMEOUT
+func (teller *GoTeller) supportsTLS(addr ipaddr.IPAddr) bool {
+	teller.tlsMutex.Lock()
+	defer teller.tlsMutex.Unlock()
+	if failed, ok := teller.tlsFailures[addr]; ok {
+		if time.Since(failed) < TLS_FAILURE_TIMEOUT {
+			return false
+		}
+		delete(teller.tlsFailures, addr)
+	}
+	return teller.tlsHosts[addr]
+}
+
+// Records whether a servant accepts TLS connections
+func (teller *GoTeller) setTLSHost(addr ipaddr.IPAddr, supported bool) {
+	teller.tlsMutex.Lock()
+	defer teller.tlsMutex.Unlock()
+	if teller.tlsHosts == nil {
+		teller.tlsHosts = make(map[ipaddr.IPAddr]bool)
+	}
+	if len(teller.tlsHosts) >= MAX_KNOWN_HOSTS {
+		for host := range teller.tlsHosts {
+			delete(teller.tlsHosts, host) // Forget any one of them
+			break
+		}
+	}
+	teller.tlsHosts[addr] = supported
+}
+
+// Notes that a TLS handshake with a servant failed, so that it's connected to
+// in plaintext for a while even if it advertises TLS again
+func (teller *GoTeller) noteTLSFailure(addr ipaddr.IPAddr) {
+	teller.tlsMutex.Lock()
+	defer teller.tlsMutex.Unlock()
+	if teller.tlsFailures == nil {
+		teller.tlsFailures = make(map[ipaddr.IPAddr]time.Time)
+	}
+	if len(teller.tlsFailures) >= MAX_KNOWN_HOSTS {
+		for host := range teller.tlsFailures {
+			delete(teller.tlsFailures, host) // Forget any one of them
+			break
+		}
+	}
+	teller.tlsFailures[addr] = time.Now()
+}
+
+// Notes a servant that advertised TLS in its handshake headers
+func (teller *GoTeller) noteHandshakeTLS(peer ipaddr.IPAddr, headers textproto.MIMEHeader) {
+	if supported, ok := parseBoolHeader(headers, "TLS"); ok && supported { // in handshake.go
+		teller.setTLSHost(peer, true)
+	}
+}
+
+// Notes the servant of one of our query hits if it advertised TLS
+func (teller *GoTeller) noteHitTLS(queryHit messages.QueryHitMsg) {
+	if queryHit.Trailer != nil && queryHit.Trailer.GGEP.Has(messages.GGEP_TLS_ID) {
+		teller.setTLSHost(queryHit.Addr, true)
+	}
+}
+
+// A connection whose first bytes were read into a bufio.Reader while peeking
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
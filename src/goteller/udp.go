@@ -0,0 +1,385 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"../messages"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const MAX_DATAGRAM_LEN int = 65535
+const MAX_KNOWN_HOSTS int = 1000
+const MAX_IPP_HOSTS int = 10 // Hosts sent in a pong answering a ping with SCP
+const MIN_NEIGHBORS int = 3  // Neighbors are added from known hosts while there are fewer
+const UDP_PING_TIMEOUT time.Duration = time.Minute
+
+// Sets the UDP host caches pinged for hosts when the servant has no neighbors.
+// With host caches, initial neighbors are optional.
+func (teller *GoTeller) SetHostCaches(addrs []string) error {
+	for _, address := range addrs {
+		addr, err := ipaddr.ParseAddrString(address)
+		if err != nil {
+			return err
+		}
+		teller.hostCaches = append(teller.hostCaches, *addr)
+	}
+	return nil
+}
+
+// Sends a ping over UDP asking for cached hosts. The pong's hosts are added to
+// KnownHosts and the pong is passed to the OnPong callback.
+func (teller *GoTeller) PingUDP(addr string) error {
+	to, err := ipaddr.ParseAddrString(addr)
+	if err != nil {
+		return err
+	}
+	return teller.pingUDP(*to, messages.GGEP_SCP_ID)
+}
+
+// Returns the servants this one has heard of from pongs
+func (teller *GoTeller) KnownHosts() []ipaddr.IPAddr {
+	teller.udpMutex.Lock()
+	defer teller.udpMutex.Unlock()
+	hosts := make([]ipaddr.IPAddr, 0, len(teller.knownHosts))
+	for host := range teller.knownHosts {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// True once a pong has answered one of this servant's UDP pings
+func (teller *GoTeller) CanReceiveSolicitedUDP() bool {
+	teller.udpMutex.Lock()
+	defer teller.udpMutex.Unlock()
+	return teller.solicitedUDP
+}
+
+// True once a UDP ping has arrived from a servant this one hadn't pinged, so
+// other servants can reach it over UDP
+func (teller *GoTeller) CanReceiveUnsolicitedUDP() bool {
+	teller.udpMutex.Lock()
+	defer teller.udpMutex.Unlock()
+	return teller.unsolicitedUDP
+}
+
+func (teller *GoTeller) startUDP() error {
+	udpAddr, err := net.ResolveUDPAddr("udp", teller.addr.String())
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	teller.udpConn = conn
+	go func() {
+		defer conn.Close()
+		buffer := make([]byte, MAX_DATAGRAM_LEN)
+		for teller.alive {
+			n, remote, err := conn.ReadFromUDP(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				return // Stopped
+			} else if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					continue
+				}
+				return
+			}
+			from := ipaddr.IPAddr{Port: uint16(remote.Port)}
+			copy(from.IP[:], remote.IP.To4())
+			teller.handleDatagram(append([]byte(nil), buffer[:n]...), from)
+		}
+	}()
+	return nil
+}
+
+// Closes the UDP socket, which ends the loop reading from it
+func (teller *GoTeller) stopUDP() {
+	if teller.udpConn != nil {
+		teller.udpConn.Close()
+	}
+}
+
+func (teller *GoTeller) sendUDP(msg []byte, to ipaddr.IPAddr) error {
+	if teller.udpConn == nil {
+		return fmt.Errorf("UDP isn't started")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", to.String())
+	if err != nil {
+		return err
+	}
+	teller.throttle(TRAFFIC_PROTOCOL, to, len(msg)) // in bandwidth.go
+	_, err = teller.udpConn.WriteToUDP(msg, udpAddr)
+	return err
+}
+
+// Handles a datagram, which holds a single descriptor
+func (teller *GoTeller) handleDatagram(buffer []byte, from ipaddr.IPAddr) {
+	defer func() {
+		if r := recover(); r != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, "Recovered a Panic in handleDatagram: ", r)
+			}
+		}
+	}()
+	if len(buffer) < HEADER_LEN {
+		return
+	}
+	header, err := messages.ParseHeaderBytes(buffer[:HEADER_LEN])
+	if err == nil && int(header.PayloadLen) != len(buffer)-HEADER_LEN {
+		err = fmt.Errorf("Datagram from %s has %d bytes of payload for a payload length of %d", from.String(), len(buffer)-HEADER_LEN, header.PayloadLen)
+	}
+	if err != nil {
+		if teller.debugFile != nil {
+			fmt.Fprintln(teller.debugFile, err)
+		}
+		return
+	}
+	if teller.isBlocked(from) { // in ipfilter.go
+		return
+	}
+	payloadBuffer := buffer[HEADER_LEN:]
+	switch header.PayloadDesc {
+	case messages.PING:
+		teller.onUDPPing(*header, payloadBuffer, from)
+	case messages.PONG:
+		pong, err := messages.ParsePongBytes(payloadBuffer)
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		teller.onUDPPong(*header, *pong, from)
+	case messages.QUERY:
+		query, err := messages.ParseQueryBytes(payloadBuffer)
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		if teller.isMember(&query.GGEP, header.DescID, from, query.ToBytes) { // in private.go
+			teller.onGUESSQuery(*header, *query, from) // in guess.go
+		}
+	case messages.VENDOR:
+		vendor, err := messages.ParseVendorBytes(payloadBuffer)
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		teller.onUDPVendorMsg(*header, *vendor, from) // in oob.go
+	case messages.QUERYHIT:
+		queryHit, err := messages.ParseQueryHitBytes(payloadBuffer)
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+			return
+		}
+		// Out of band or GUESS hit. Only taken for queries this servant sent, from
+		// servants whose offered hits it claimed or that it sent a GUESS query
+		teller.myQueryMapMutex.RLock()
+		_, mine := teller.myQueries[header.DescID]
+		teller.myQueryMapMutex.RUnlock()
+		var trailer messages.GGEP
+		trailerGGEP := &trailer
+		if queryHit.Trailer != nil {
+			trailerGGEP = &queryHit.Trailer.GGEP
+		}
+		if mine && teller.expectsUDPHits(header.DescID, from) && teller.isMember(trailerGGEP, header.DescID, queryHit.Addr, queryHit.ToBytes) { // in private.go
+			teller.ackGUESSQuery(header.DescID, from)   // in guess.go
+			teller.onQueryHit(*header, *queryHit, from) // in queryhithandler.go
+		}
+	}
+}
+
+// Sends a ping over UDP with an empty GGEP extension asking for something in
+// the pong
+func (teller *GoTeller) pingUDP(to ipaddr.IPAddr, extension string) error {
+	descID := teller.newID()
+	var ggep messages.GGEP
+	ggep.Set(extension, nil)
+	teller.tagGGEP(&ggep, descID, teller.addr, func() []byte { return ggep.ToBytes() }) // in private.go
+	pingBuffer := ggep.ToBytes()
+	header := messages.DescHeader{
+		DescID:      descID,
+		PayloadDesc: messages.PING,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(pingBuffer)),
+	}
+	teller.udpMutex.Lock()
+	if teller.udpPings == nil {
+		teller.udpPings = make(map[[16]byte]udpPing)
+	}
+	teller.udpPings[header.DescID] = udpPing{to, time.Now()}
+	teller.udpMutex.Unlock()
+	return teller.sendUDP(append(header.ToBytes(), pingBuffer...), to)
+}
+
+type udpPing struct {
+	to   ipaddr.IPAddr
+	sent time.Time
+}
+
+// Answers a UDP ping with a pong. Pings aren't forwarded over UDP.
+func (teller *GoTeller) onUDPPing(header messages.DescHeader, payload []byte, from ipaddr.IPAddr) {
+	var ping messages.GGEP
+	if len(payload) > 0 {
+		ping, _, _ = messages.ParseGGEP(payload)
+	}
+	if !teller.isMember(&ping, header.DescID, from, func() []byte { return ping.ToBytes() }) { // in private.go
+		return
+	}
+	teller.udpMutex.Lock()
+	solicited := false
+	for _, sent := range teller.udpPings {
+		solicited = solicited || sent.to == from
+	}
+	if !solicited {
+		teller.unsolicitedUDP = true
+	}
+	teller.udpMutex.Unlock()
+
+	pong := messages.PongMsg{Addr: teller.addr, NumShared: teller.NumShared, NumKB: teller.NumKB}
+	pong.GGEP = append(pong.GGEP, teller.PongGGEP...)
+	if ping.Has(messages.GGEP_SCP_ID) {
+		pong.GGEP.Set(messages.GGEP_IPP_ID, messages.PackIPPorts(teller.hostsFor(from)))
+	}
+	if teller.HostCache {
+		pong.GGEP.Set(messages.GGEP_UDPHC_ID, nil)
+	}
+	teller.addGUESSExtensions(&pong, ping, from) // in guess.go
+	teller.tagGGEP(&pong.GGEP, header.DescID, pong.Addr, pong.ToBytes)
+	pongBuffer := pong.ToBytes()
+	pongHeader := messages.DescHeader{
+		DescID:      header.DescID,
+		PayloadDesc: messages.PONG,
+		TTL:         1,
+		Hops:        0,
+		PayloadLen:  uint32(len(pongBuffer)),
+	}
+	err := teller.sendUDP(append(pongHeader.ToBytes(), pongBuffer...), from)
+	if err != nil && teller.debugFile != nil {
+		fmt.Fprintln(teller.debugFile, err)
+	}
+}
+
+func (teller *GoTeller) onUDPPong(header messages.DescHeader, pong messages.PongMsg, from ipaddr.IPAddr) {
+	teller.udpMutex.Lock()
+	sent, ok := teller.udpPings[header.DescID]
+	if ok && sent.to.IP == from.IP {
+		delete(teller.udpPings, header.DescID)
+		teller.solicitedUDP = true
+	}
+	teller.udpMutex.Unlock()
+	if !ok || sent.to.IP != from.IP {
+		if teller.isMember(&pong.GGEP, header.DescID, pong.Addr, pong.ToBytes) { // in private.go
+			teller.ackGUESSQuery(header.DescID, from) // in guess.go
+		}
+		return // Not an answer to one of our pings
+	}
+	if !teller.isMember(&pong.GGEP, header.DescID, pong.Addr, pong.ToBytes) { // in private.go
+		return
+	}
+	hosts := []ipaddr.IPAddr{pong.Addr}
+	if ipp, ok := pong.GGEP.Get(messages.GGEP_IPP_ID); ok {
+		packed, err := messages.UnpackIPPorts(ipp)
+		if err != nil {
+			if teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+		}
+		hosts = append(hosts, packed...)
+	}
+	for _, host := range hosts {
+		teller.addKnownHost(host)
+	}
+	teller.onGUESSPong(pong, from) // in guess.go
+	if teller.pongFunc != nil {
+		teller.pongFunc(pong)
+	}
+}
+
+// Returns up to MAX_IPP_HOSTS hosts to tell a servant about
+func (teller *GoTeller) hostsFor(requester ipaddr.IPAddr) []ipaddr.IPAddr {
+	var hosts []ipaddr.IPAddr
+	candidates := append(teller.neighborsFor(requester), teller.KnownHosts()...)
+	seen := make(map[ipaddr.IPAddr]bool)
+	for _, host := range candidates {
+		if len(hosts) == MAX_IPP_HOSTS {
+			break
+		}
+		if host != requester && host != teller.addr && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Remembers a servant heard of from a pong. The host heard of least recently
+// is forgotten once there are MAX_KNOWN_HOSTS.
+func (teller *GoTeller) addKnownHost(host ipaddr.IPAddr) {
+	if host == teller.addr || host.Port == 0 || teller.isBlocked(host) { // in ipfilter.go
+		return
+	}
+	teller.udpMutex.Lock()
+	defer teller.udpMutex.Unlock()
+	if teller.knownHosts == nil {
+		teller.knownHosts = make(map[ipaddr.IPAddr]time.Time)
+	}
+	if _, ok := teller.knownHosts[host]; !ok && len(teller.knownHosts) >= MAX_KNOWN_HOSTS {
+		var oldest ipaddr.IPAddr
+		var oldestTime time.Time
+		for known, heard := range teller.knownHosts {
+			if oldestTime.IsZero() || heard.Before(oldestTime) {
+				oldest, oldestTime = known, heard
+			}
+		}
+		delete(teller.knownHosts, oldest)
+	}
+	teller.knownHosts[host] = time.Now()
+}
+
+// Run on every ping interval. Adds known hosts as neighbors while there are
+// fewer than MIN_NEIGHBORS, pings the host caches if there are none and forgets
+// UDP pings that went unanswered.
+func (teller *GoTeller) refillNeighbors() {
+	teller.udpMutex.Lock()
+	for id, sent := range teller.udpPings {
+		if time.Since(sent.sent) > UDP_PING_TIMEOUT {
+			delete(teller.udpPings, id)
+		}
+	}
+	teller.udpMutex.Unlock()
+
+	teller.neighborsMutex.RLock()
+	numNeighbors := len(teller.Neighbors)
+	teller.neighborsMutex.RUnlock()
+	for _, host := range teller.KnownHosts() {
+		if numNeighbors >= MIN_NEIGHBORS || !teller.wantsNeighbors() { // in ultrapeer.go
+			break
+		}
+		if !teller.isNeighbor(host) && !teller.isLeafPeer(host) {
+			teller.addNeighbor(host)
+			numNeighbors++
+		}
+	}
+	if numNeighbors == 0 {
+		for _, hostCache := range teller.hostCaches {
+			err := teller.pingUDP(hostCache, messages.GGEP_SCP_ID)
+			if err != nil && teller.debugFile != nil {
+				fmt.Fprintln(teller.debugFile, err)
+			}
+		}
+	}
+}
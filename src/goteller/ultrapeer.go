@@ -0,0 +1,378 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"net/textproto"
+	"time"
+)
+
+type Mode int
+
+const (
+	MODE_NORMAL    Mode = iota // Flat servant that forwards all traffic to all neighbors
+	MODE_LEAF                  // Connects to a few ultrapeers and never forwards traffic
+	MODE_ULTRAPEER             // Accepts leaves and forwards traffic on their behalf
+	MODE_AUTO                  // Leaf until elected ultrapeer
+)
+
+const DEFAULT_MAX_LEAVES int = 30
+const DEFAULT_MAX_ULTRAPEERS int = 3 // Ultrapeers a leaf stays connected to
+const DEFAULT_ULTRAPEER_MIN_UPTIME time.Duration = 10 * time.Minute
+const ULTRAPEER_MIN_SPEED uint32 = 256 // kb/s of NetworkSpeed needed to be elected ultrapeer
+const ULTRAPEER_TARGET_PEERS int = 6   // Ultrapeer connections after which more ultrapeers aren't needed
+const LEAF_GUIDANCE_PERIOD time.Duration = 30 * time.Minute
+const LEAF_TIMEOUT_PINGS int = 10 // Ping intervals after which a silent leaf is dropped
+
+func (mode Mode) String() string {
+	switch mode {
+	case MODE_NORMAL:
+		return "normal"
+	case MODE_LEAF:
+		return "leaf"
+	case MODE_ULTRAPEER:
+		return "ultrapeer"
+	case MODE_AUTO:
+		return "auto"
+	}
+	return "unknown"
+}
+
+// What is known of another servant from its handshakes
+type peerInfo struct {
+	ultrapeer bool // Sent X-Ultrapeer: True
+	legacy    bool // Only speaks the 0.4 handshake
+}
+
+// Returns MODE_LEAF, MODE_ULTRAPEER or MODE_NORMAL. In MODE_AUTO this is the
+// role the servant was elected to.
+func (teller *GoTeller) CurrentMode() Mode {
+	switch {
+	case teller.isUltrapeer():
+		return MODE_ULTRAPEER
+	case teller.isLeaf():
+		return MODE_LEAF
+	}
+	return MODE_NORMAL
+}
+
+// Returns the leaves of this ultrapeer
+func (teller *GoTeller) Leaves() []ipaddr.IPAddr {
+	teller.peersMutex.RLock()
+	defer teller.peersMutex.RUnlock()
+	leaves := make([]ipaddr.IPAddr, 0, len(teller.leaves))
+	for leaf := range teller.leaves {
+		leaves = append(leaves, leaf)
+	}
+	return leaves
+}
+
+// Returns the neighbors known to be ultrapeers
+func (teller *GoTeller) Ultrapeers() []ipaddr.IPAddr {
+	teller.neighborsMutex.RLock()
+	defer teller.neighborsMutex.RUnlock()
+	teller.peersMutex.RLock()
+	defer teller.peersMutex.RUnlock()
+	var ultrapeers []ipaddr.IPAddr
+	for _, addr := range teller.Neighbors {
+		if info, ok := teller.peers[addr]; ok && info.ultrapeer {
+			ultrapeers = append(ultrapeers, addr)
+		}
+	}
+	return ultrapeers
+}
+
+func (teller *GoTeller) isUltrapeer() bool {
+	if teller.Mode == MODE_AUTO {
+		teller.peersMutex.RLock()
+		defer teller.peersMutex.RUnlock()
+		return teller.elected
+	}
+	return teller.Mode == MODE_ULTRAPEER
+}
+
+func (teller *GoTeller) isLeaf() bool {
+	if teller.Mode == MODE_AUTO {
+		return !teller.isUltrapeer()
+	}
+	return teller.Mode == MODE_LEAF
+}
+
+func (teller *GoTeller) initPeers() {
+	if teller.MaxLeaves == 0 {
+		teller.MaxLeaves = DEFAULT_MAX_LEAVES
+	}
+	if teller.MaxUltrapeers == 0 {
+		teller.MaxUltrapeers = DEFAULT_MAX_ULTRAPEERS
+	}
+	if teller.UltrapeerMinUptime == 0 {
+		teller.UltrapeerMinUptime = DEFAULT_ULTRAPEER_MIN_UPTIME
+	}
+	teller.startTime = time.Now()
+	teller.peers = make(map[ipaddr.IPAddr]*peerInfo)
+	teller.leaves = make(map[ipaddr.IPAddr]time.Time)
+}
+
+// Must hold peersMutex
+func (teller *GoTeller) peer(addr ipaddr.IPAddr) *peerInfo {
+	info, ok := teller.peers[addr]
+	if !ok {
+		info = new(peerInfo)
+		teller.peers[addr] = info
+	}
+	return info
+}
+
+func (teller *GoTeller) isLegacyPeer(addr ipaddr.IPAddr) bool {
+	teller.peersMutex.RLock()
+	defer teller.peersMutex.RUnlock()
+	info, ok := teller.peers[addr]
+	return ok && info.legacy
+}
+
+func (teller *GoTeller) setLegacyPeer(addr ipaddr.IPAddr) {
+	teller.peersMutex.Lock()
+	defer teller.peersMutex.Unlock()
+	teller.peer(addr).legacy = true
+}
+
+func (teller *GoTeller) isUltrapeerPeer(addr ipaddr.IPAddr) bool {
+	teller.peersMutex.RLock()
+	defer teller.peersMutex.RUnlock()
+	info, ok := teller.peers[addr]
+	return ok && info.ultrapeer
+}
+
+func (teller *GoTeller) isLeafPeer(addr ipaddr.IPAddr) bool {
+	teller.peersMutex.RLock()
+	defer teller.peersMutex.RUnlock()
+	_, ok := teller.leaves[addr]
+	return ok
+}
+
+// Number of neighbors known to be ultrapeers. Must hold neighborsMutex.
+func (teller *GoTeller) numUltrapeers() int {
+	n := 0
+	for _, addr := range teller.Neighbors {
+		if teller.isUltrapeerPeer(addr) {
+			n++
+		}
+	}
+	return n
+}
+
+// True if this ultrapeer wants more ultrapeer connections rather than have
+// other ultrapeers become its leaves
+func (teller *GoTeller) ultrapeersNeeded() bool {
+	teller.peersMutex.RLock()
+	numLeaves := len(teller.leaves)
+	teller.peersMutex.RUnlock()
+	if numLeaves >= teller.MaxLeaves {
+		return true
+	}
+	teller.neighborsMutex.RLock()
+	defer teller.neighborsMutex.RUnlock()
+	return teller.numUltrapeers() < ULTRAPEER_TARGET_PEERS
+}
+
+// Decides whether to accept a 0.6 handshake. Returns the reason for rejecting
+// it, or "" to accept.
+func (teller *GoTeller) acceptPeer(from ipaddr.IPAddr, headers textproto.MIMEHeader) string {
+	teller.setReachable()
+	ultrapeer, hasRole := parseBoolHeader(headers, "X-Ultrapeer")
+	switch {
+	case teller.isLeaf():
+		// Shielded from everyone but the leaf's ultrapeers
+		if teller.isNeighbor(from) {
+			teller.notePeerRole(from, ultrapeer && hasRole)
+			return ""
+		}
+		if !ultrapeer {
+			return "Shielded leaf"
+		}
+		teller.neighborsMutex.RLock()
+		full := teller.numUltrapeers() >= teller.MaxUltrapeers
+		teller.neighborsMutex.RUnlock()
+		if full {
+			return "Shielded leaf"
+		}
+		teller.addNeighbor(from)
+		teller.notePeerRole(from, true)
+	case teller.isUltrapeer() && hasRole && !ultrapeer:
+		if !teller.addLeaf(from) {
+			return "Leaf slots full"
+		}
+	case hasRole:
+		teller.notePeerRole(from, ultrapeer)
+	}
+	return ""
+}
+
+// Records the role a servant sent in its response to our handshake. Returns
+// the headers of our final response, which take up the servant's guidance to
+// become its leaf if this servant is an elected ultrapeer without leaves.
+func (teller *GoTeller) onHandshakeResponse(to ipaddr.IPAddr, headers textproto.MIMEHeader) textproto.MIMEHeader {
+	final := make(textproto.MIMEHeader)
+	ultrapeer, hasRole := parseBoolHeader(headers, "X-Ultrapeer")
+	if !hasRole {
+		return final
+	}
+	teller.notePeerRole(to, ultrapeer)
+	needed, hasNeeded := parseBoolHeader(headers, "X-Ultrapeer-Needed")
+	if ultrapeer && hasNeeded && !needed && teller.Mode == MODE_AUTO && teller.isUltrapeer() && len(teller.Leaves()) == 0 {
+		teller.peersMutex.Lock()
+		teller.elected = false
+		teller.guidedUntil = time.Now().Add(LEAF_GUIDANCE_PERIOD)
+		teller.peersMutex.Unlock()
+		final.Set("X-Ultrapeer", boolHeader(false))
+	}
+	return final
+}
+
+// Handles the final response of a 0.6 handshake, in which an ultrapeer may
+// accept our guidance and become our leaf
+func (teller *GoTeller) onHandshakeFinal(from ipaddr.IPAddr, headers textproto.MIMEHeader) {
+	ultrapeer, hasRole := parseBoolHeader(headers, "X-Ultrapeer")
+	if hasRole && !ultrapeer && teller.isUltrapeer() && !teller.isLeafPeer(from) {
+		teller.addLeaf(from)
+	}
+}
+
+// Records whether a servant is an ultrapeer. Ultrapeers that were leaves are
+// made neighbors.
+func (teller *GoTeller) notePeerRole(addr ipaddr.IPAddr, ultrapeer bool) {
+	teller.peersMutex.Lock()
+	teller.peer(addr).ultrapeer = ultrapeer
+	_, wasLeaf := teller.leaves[addr]
+	if ultrapeer {
+		delete(teller.leaves, addr)
+	}
+	teller.peersMutex.Unlock()
+	if wasLeaf && ultrapeer && !teller.isNeighbor(addr) {
+		teller.addNeighbor(addr)
+	}
+}
+
+// Adds a leaf (or notes that it is still alive). A leaf isn't a neighbor and
+// only gets the queries its route table matches. Returns false if all leaf
+// slots are taken.
+func (teller *GoTeller) addLeaf(addr ipaddr.IPAddr) bool {
+	if teller.isNeighbor(addr) {
+		teller.removeNeighbor(addr)
+	}
+	teller.peersMutex.Lock()
+	defer teller.peersMutex.Unlock()
+	if _, ok := teller.leaves[addr]; !ok && len(teller.leaves) >= teller.MaxLeaves {
+		return false
+	}
+	teller.leaves[addr] = time.Now()
+	teller.peer(addr).ultrapeer = false
+	return true
+}
+
+func (teller *GoTeller) removeLeaf(addr ipaddr.IPAddr) {
+	teller.peersMutex.Lock()
+	delete(teller.leaves, addr)
+	teller.peersMutex.Unlock()
+	teller.forgetRouteTable(addr) // in qrp.go
+}
+
+func (teller *GoTeller) setReachable() {
+	teller.peersMutex.Lock()
+	defer teller.peersMutex.Unlock()
+	teller.reachable = true
+}
+
+// Returns the neighbors traffic from from should be sent on to. A leaf only
+// talks to its ultrapeers, or to all neighbors while it hasn't found any.
+func (teller *GoTeller) neighborsFor(from ipaddr.IPAddr) []ipaddr.IPAddr {
+	teller.neighborsMutex.RLock()
+	defer teller.neighborsMutex.RUnlock()
+	leaf := teller.isLeaf()
+	hasUltrapeers := leaf && teller.numUltrapeers() > 0
+	var neighbors []ipaddr.IPAddr
+	for _, addr := range teller.Neighbors {
+		if addr != from && (!hasUltrapeers || teller.isUltrapeerPeer(addr)) {
+			neighbors = append(neighbors, addr)
+		}
+	}
+	return neighbors
+}
+
+// Returns the leaves traffic from from should be sent on to
+func (teller *GoTeller) leavesFor(from ipaddr.IPAddr) []ipaddr.IPAddr {
+	if !teller.isUltrapeer() {
+		return nil
+	}
+	var leaves []ipaddr.IPAddr
+	for _, leaf := range teller.Leaves() {
+		if leaf != from {
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves
+}
+
+// True if a leaf should add a servant it heard of to its neighbors
+func (teller *GoTeller) wantsNeighbors() bool {
+	if !teller.isLeaf() {
+		return true
+	}
+	teller.neighborsMutex.RLock()
+	defer teller.neighborsMutex.RUnlock()
+	return teller.numUltrapeers() < teller.MaxUltrapeers
+}
+
+// Run on every ping interval. Holds the ultrapeer election in MODE_AUTO, drops
+// silent leaves and has leaves with enough ultrapeers drop other neighbors.
+func (teller *GoTeller) maintainPeers() {
+	if teller.Mode == MODE_AUTO {
+		teller.electUltrapeer()
+	}
+	if teller.isUltrapeer() {
+		timeout := time.Duration(LEAF_TIMEOUT_PINGS) * teller.PingInterval
+		var silent []ipaddr.IPAddr
+		teller.peersMutex.RLock()
+		for leaf, lastSeen := range teller.leaves {
+			if time.Since(lastSeen) > timeout {
+				silent = append(silent, leaf)
+			}
+		}
+		teller.peersMutex.RUnlock()
+		for _, leaf := range silent {
+			teller.removeLeaf(leaf)
+		}
+	} else if teller.isLeaf() {
+		var extra []ipaddr.IPAddr
+		kept := 0
+		teller.neighborsMutex.RLock()
+		if teller.numUltrapeers() >= teller.MaxUltrapeers {
+			for _, addr := range teller.Neighbors {
+				if teller.isUltrapeerPeer(addr) && kept < teller.MaxUltrapeers {
+					kept++
+				} else {
+					extra = append(extra, addr)
+				}
+			}
+		}
+		teller.neighborsMutex.RUnlock()
+		for _, addr := range extra {
+			teller.removeNeighbor(addr)
+		}
+	}
+}
+
+// A servant is elected ultrapeer once it has been up long enough, is fast
+// enough and has been reached by other servants, unless an ultrapeer guided it
+// to be a leaf. An ultrapeer with leaves keeps its role.
+func (teller *GoTeller) electUltrapeer() {
+	teller.peersMutex.Lock()
+	defer teller.peersMutex.Unlock()
+	capable := time.Since(teller.startTime) >= teller.UltrapeerMinUptime &&
+		teller.NetworkSpeed >= ULTRAPEER_MIN_SPEED &&
+		!teller.Firewalled &&
+		teller.reachable &&
+		time.Now().After(teller.guidedUntil)
+	if capable || len(teller.leaves) == 0 {
+		teller.elected = capable
+	}
+}
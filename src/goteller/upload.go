@@ -0,0 +1,97 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const SERVANT_ID_HEADER string = "X-Servant-ID" // Hex servant ID sent with this servant's downloads
+
+// A request for a shared file, given to the OnUploadRequest callback
+type UploadRequest struct {
+	Addr      ipaddr.IPAddr // Address the request came from
+	ServantID string        // Hex servant ID the requester sent in an X-Servant-ID header. "" if unknown. Unauthenticated, so any requester can claim any ID
+	FileIndex uint32
+	Filename  string
+	URN       string // "urn:sha1:" URN of the file if known
+	UserAgent string
+	Range     string // Value of the Range header. "" for the whole file
+	Header    http.Header
+}
+
+// Answer of the OnUploadRequest callback. Body is served for a StatusCode of 0
+// or 200, honoring the request's Range header. Any other status (such as 403,
+// 404 or 503) is sent without a body.
+type UploadResponse struct {
+	StatusCode  int
+	Status      string        // Reason phrase, e.g. "Forbidden". Defaults to the standard one for StatusCode
+	Header      http.Header   // Added to the response (Optional)
+	ContentType string        // (Optional)
+	Body        io.ReadSeeker // Its length is found by seeking to its end. Closed after the response is sent if it is also an io.Closer
+}
+
+// Sets a callback deciding how to answer each request for a file, given who is
+// asking and the headers they sent. Takes precedence over OnRequest and
+// OnRangeRequest. A nil response is sent as 404 Not Found.
+func (teller *GoTeller) OnUploadRequest(reqFunc func(*UploadRequest) *UploadResponse) {
+	teller.uploadRequestFunc = reqFunc
+}
+
+func (teller *GoTeller) uploadRequest(req *http.Request, from ipaddr.IPAddr, fileIndex uint32, filename string) *UploadRequest {
+	ureq := &UploadRequest{
+		Addr:      from,
+		FileIndex: fileIndex,
+		Filename:  filename,
+		URN:       teller.urnOf(fileIndex, filename), // in urn.go
+		UserAgent: req.Header.Get("User-Agent"),
+		Range:     req.Header.Get("Range"),
+		Header:    req.Header,
+	}
+	if id, err := hex.DecodeString(req.Header.Get(SERVANT_ID_HEADER)); err == nil && len(id) == 16 {
+		ureq.ServantID = strings.ToUpper(hex.EncodeToString(id))
+	}
+	return ureq
+}
+
+// Builds the HTTP response for the answer of the OnUploadRequest callback
+func buildUploadResponse(req *http.Request, ures *UploadResponse) http.Response {
+	if ures == nil {
+		return buildNotFoundResponse(req)
+	}
+	var res http.Response
+	if ures.StatusCode == 0 || ures.StatusCode == http.StatusOK {
+		length := int64(-1)
+		var body io.Reader
+		if ures.Body != nil {
+			body = ures.Body
+			end, err := ures.Body.Seek(0, io.SeekEnd)
+			if err == nil {
+				_, err = ures.Body.Seek(0, io.SeekStart)
+			}
+			if err == nil {
+				length = end
+			}
+		}
+		res = buildFileResponse(req, body, length) // in requesthandler.go
+	} else {
+		if closer, ok := ures.Body.(io.Closer); ok {
+			closer.Close()
+		}
+		status := ures.Status
+		if status == "" {
+			status = http.StatusText(ures.StatusCode)
+		}
+		res = buildResponse(fmt.Sprintf("%d %s", ures.StatusCode, status), ures.StatusCode, nil, 0, req)
+	}
+	for key, values := range ures.Header {
+		res.Header[http.CanonicalHeaderKey(key)] = values
+	}
+	if ures.ContentType != "" && res.StatusCode < 300 {
+		res.Header.Set("Content-Type", ures.ContentType)
+	}
+	return res
+}
@@ -0,0 +1,251 @@
+package goteller
+
+import (
+	"../ipaddr"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_UPLOAD_QUEUE_LENGTH int = 32
+const UPLOAD_QUEUE_POLL_MIN time.Duration = 30 * time.Second  // Queued downloaders are asked to wait this long before asking again
+const UPLOAD_QUEUE_POLL_MAX time.Duration = 120 * time.Second // Queued downloaders that don't ask again within this long lose their place
+const PARQ_VERSION string = "1.0"                             // Sent in the X-Queue header by downloaders that support active queueing
+
+// A request waiting for an upload slot
+type QueuedUpload struct {
+	ID        string // Sent back by downloaders that support active queueing to keep their place
+	Addr      ipaddr.IPAddr
+	FileIndex uint32
+	Filename  string
+	Position  int // 1 is given the next free slot
+	Enqueued  time.Time
+	LastPoll  time.Time // Last time the downloader asked for the file
+}
+
+// Returns the requests waiting for an upload slot, next first
+func (teller *GoTeller) UploadQueue() []QueuedUpload {
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	teller.expireUploadQueue()
+	queue := make([]QueuedUpload, len(teller.uploadQueue))
+	for i, entry := range teller.uploadQueue {
+		queue[i] = *entry
+		queue[i].Position = i + 1
+	}
+	return queue
+}
+
+// Returns the number of files being uploaded
+func (teller *GoTeller) ActiveUploads() int {
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	return teller.activeUploads
+}
+
+// Removes a request from the upload queue. The downloader is told the servant
+// is busy the next time it asks.
+func (teller *GoTeller) RemoveQueuedUpload(id string) error {
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	for i, entry := range teller.uploadQueue {
+		if entry.ID == id {
+			teller.uploadQueue = append(teller.uploadQueue[:i], teller.uploadQueue[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No queued upload with ID %s", id)
+}
+
+// Moves a request to the front of the upload queue so that it gets the next
+// free slot
+func (teller *GoTeller) PrioritizeQueuedUpload(id string) error {
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	for i, entry := range teller.uploadQueue {
+		if entry.ID == id {
+			copy(teller.uploadQueue[1:i+1], teller.uploadQueue[:i])
+			teller.uploadQueue[0] = entry
+			return nil
+		}
+	}
+	return fmt.Errorf("No queued upload with ID %s", id)
+}
+
+// True if all upload slots are in use
+func (teller *GoTeller) uploadsBusy() bool {
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	return teller.UploadSlots > 0 && teller.activeUploads >= teller.UploadSlots
+}
+
+// Takes an upload slot for a request if one is free and no request queued
+// before it is waiting for it. Otherwise the request keeps or gets a place in
+// the queue, which is returned. The entry is nil if the queue is full. Slots
+// taken must be given back with releaseUploadSlot.
+func (teller *GoTeller) reserveUploadSlot(req *http.Request, from ipaddr.IPAddr, fileIndex uint32, filename string) (*QueuedUpload, bool) {
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	teller.expireUploadQueue()
+	now := time.Now()
+	position := len(teller.uploadQueue) + 1
+	var entry *QueuedUpload
+	id := parseQueuedID(req.Header.Get("X-Queued"))
+	for i, queued := range teller.uploadQueue {
+		// Downloaders that don't support active queueing are recognized by what they ask for
+		sameRequest := queued.Addr.IP == from.IP && queued.FileIndex == fileIndex && queued.Filename == filename
+		if (id != "" && queued.ID == id) || (id == "" && sameRequest) {
+			entry, position = queued, i+1
+			break
+		}
+	}
+	if teller.UploadSlots <= 0 || position <= teller.UploadSlots-teller.activeUploads {
+		if entry != nil {
+			teller.uploadQueue = append(teller.uploadQueue[:position-1], teller.uploadQueue[position:]...)
+		}
+		teller.activeUploads++
+		return nil, true
+	}
+	if entry == nil {
+		queueLength := teller.UploadQueueLength
+		if queueLength == 0 {
+			queueLength = DEFAULT_UPLOAD_QUEUE_LENGTH
+		}
+		if len(teller.uploadQueue) >= queueLength {
+			return nil, false
+		}
+		descID := teller.newID()
+		entry = &QueuedUpload{
+			ID:        strings.ToUpper(hex.EncodeToString(descID[:])),
+			FileIndex: fileIndex,
+			Filename:  filename,
+			Enqueued:  now,
+		}
+		teller.uploadQueue = append(teller.uploadQueue, entry)
+	}
+	entry.Addr = from
+	entry.LastPoll = now
+	queued := *entry
+	queued.Position = position
+	return &queued, false
+}
+
+func (teller *GoTeller) releaseUploadSlot() {
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	teller.activeUploads--
+}
+
+// Drops the queued requests whose downloaders stopped asking. Must be called
+// with uploadMutex held.
+func (teller *GoTeller) expireUploadQueue() {
+	queue := teller.uploadQueue[:0]
+	for _, entry := range teller.uploadQueue {
+		if time.Since(entry.LastPoll) < UPLOAD_QUEUE_POLL_MAX {
+			queue = append(queue, entry)
+		}
+	}
+	for i := len(queue); i < len(teller.uploadQueue); i++ {
+		teller.uploadQueue[i] = nil
+	}
+	teller.uploadQueue = queue
+}
+
+// Builds the 503 response to a request that didn't get an upload slot. Queued
+// requests are given their position in both the X-Queue header and the active
+// queueing X-Queued header.
+func (teller *GoTeller) buildBusyResponse(req *http.Request, entry *QueuedUpload) http.Response {
+	pollMin, pollMax := int(UPLOAD_QUEUE_POLL_MIN/time.Second), int(UPLOAD_QUEUE_POLL_MAX/time.Second)
+	if entry == nil {
+		res := buildResponse("503 Busy", 503, nil, 0, req)
+		res.Header.Set("Retry-After", fmt.Sprint(pollMax))
+		return res
+	}
+	teller.uploadMutex.Lock()
+	length := len(teller.uploadQueue)
+	teller.uploadMutex.Unlock()
+	res := buildResponse("503 Queued", 503, nil, 0, req)
+	res.Header.Set("Retry-After", fmt.Sprint(pollMin))
+	res.Header.Set("X-Queue", fmt.Sprintf("position=%d,length=%d,limit=%d,pollMin=%d,pollMax=%d", entry.Position, length, teller.UploadSlots, pollMin, pollMax))
+	res.Header.Set("X-Queued", fmt.Sprintf("position=%d; length=%d; ID=%s; retry=%d; lifetime=%d", entry.Position, length, entry.ID, pollMin, pollMax))
+	return res
+}
+
+// Returns the ID in an X-Queued header, or "" if there is none
+func parseQueuedID(queued string) string {
+	return queuedField(queued, "ID")
+}
+
+// Returns the value of a field of an X-Queued header, or "" if there is none
+func queuedField(queued string, name string) string {
+	prefix := name + "="
+	for _, field := range strings.Split(queued, ";") {
+		field = strings.TrimSpace(field)
+		if len(field) > len(prefix) && strings.EqualFold(field[:len(prefix)], prefix) {
+			return field[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// Returns how long to wait before asking again a servant whose response queued
+// the request, and the request's place in its queue. ok is false if the
+// response didn't queue the request.
+func queuedRetry(statusCode int, header http.Header) (retry time.Duration, position int, ok bool) {
+	queued := header.Get("X-Queued")
+	if statusCode != http.StatusServiceUnavailable || parseQueuedID(queued) == "" {
+		return 0, 0, false
+	}
+	position, _ = strconv.Atoi(queuedField(queued, "position"))
+	seconds, err := strconv.Atoi(queuedField(queued, "retry"))
+	if err != nil {
+		seconds, err = strconv.Atoi(header.Get("Retry-After"))
+	}
+	retry = time.Duration(seconds) * time.Second
+	if err != nil || retry <= 0 {
+		retry = UPLOAD_QUEUE_POLL_MIN
+	} else if retry > UPLOAD_QUEUE_POLL_MAX {
+		retry = UPLOAD_QUEUE_POLL_MAX
+	}
+	return retry, position, true
+}
+
+// Adds the active queueing headers to a request, with the ID this servant was
+// given if an earlier request for the same path was queued
+func (teller *GoTeller) addQueueHeaders(req *http.Request, to ipaddr.IPAddr, path string) {
+	req.Header.Set("X-Queue", PARQ_VERSION)
+	teller.uploadMutex.Lock()
+	id := teller.queuedIDs[queuedRequest{to, path}]
+	teller.uploadMutex.Unlock()
+	if id != "" {
+		req.Header.Set("X-Queued", "ID="+id)
+	}
+}
+
+// Remembers the ID given by a servant that queued a request, so that asking
+// again keeps its place
+func (teller *GoTeller) noteQueueResponse(res *http.Response, to ipaddr.IPAddr, path string) {
+	key := queuedRequest{to, path}
+	id := ""
+	if res.StatusCode == http.StatusServiceUnavailable {
+		id = parseQueuedID(res.Header.Get("X-Queued"))
+	}
+	teller.uploadMutex.Lock()
+	defer teller.uploadMutex.Unlock()
+	if id == "" {
+		delete(teller.queuedIDs, key)
+		return
+	}
+	if teller.queuedIDs == nil {
+		teller.queuedIDs = make(map[queuedRequest]string)
+	}
+	teller.queuedIDs[key] = id
+}
+
+type queuedRequest struct {
+	addr ipaddr.IPAddr
+	path string
+}
@@ -0,0 +1,81 @@
+package goteller
+
+import (
+	"../messages"
+	"fmt"
+)
+
+type sharedFileKey struct {
+	fileIndex uint32
+	filename  string
+}
+
+// Registers the URN of a shared file, given as a result with URN set. Such
+// files can be requested by URN with "/uri-res/N2R?<urn>", are given as a hit
+// to queries for their URN and are served with an X-Gnutella-Content-URN
+// header. Results with a URN returned by the OnQuery callback are registered
+// automatically.
+func (teller *GoTeller) ShareURN(hit messages.HitResult) error {
+	if !messages.IsSHA1URN(hit.URN) {
+		return fmt.Errorf("\"%s\" isn't a valid urn:sha1: URN", hit.URN)
+	}
+	hit.URN = messages.NormalizeURN(hit.URN)
+	teller.urnMutex.Lock()
+	defer teller.urnMutex.Unlock()
+	if teller.sharedURNs == nil {
+		teller.sharedURNs = make(map[string]messages.HitResult)
+		teller.fileURNs = make(map[sharedFileKey]string)
+	}
+	teller.sharedURNs[hit.URN] = hit
+	teller.fileURNs[sharedFileKey{hit.FileIndex, hit.Filename}] = hit.URN
+	return nil
+}
+
+// Returns the shared file with the given URN
+func (teller *GoTeller) lookupURN(urn string) (messages.HitResult, bool) {
+	teller.urnMutex.RLock()
+	defer teller.urnMutex.RUnlock()
+	hit, ok := teller.sharedURNs[messages.NormalizeURN(urn)]
+	return hit, ok
+}
+
+// Returns the URN of a shared file, or "" if it isn't known
+func (teller *GoTeller) urnOf(fileIndex uint32, filename string) string {
+	teller.urnMutex.RLock()
+	defer teller.urnMutex.RUnlock()
+	return teller.fileURNs[sharedFileKey{fileIndex, filename}]
+}
+
+// Returns the results for a query. Queries for a URN are answered from the
+// registered URNs, and only passed on to the OnQuery (or OnQueryMsg) callback
+// if they also have search terms.
+func (teller *GoTeller) answerQuery(query messages.QueryMsg) []messages.HitResult {
+	var hitResults []messages.HitResult
+	if query.URN != "" {
+		if hit, ok := teller.lookupURN(query.URN); ok {
+			hitResults = append(hitResults, hit)
+		}
+		if query.SearchQuery == "" || query.SearchQuery == "\\" { // "\" is sent by some servants for URN only queries
+			return hitResults
+		}
+	}
+	var appResults []messages.HitResult
+	if teller.queryMsgFunc != nil {
+		appResults = teller.queryMsgFunc(query)
+	} else {
+		appResults = teller.queryFunc(query.SearchQuery)
+	}
+	for _, hit := range appResults {
+		if hit.URN != "" {
+			err := teller.ShareURN(hit)
+			if err != nil {
+				if teller.debugFile != nil {
+					fmt.Fprintln(teller.debugFile, err)
+				}
+				hit.URN = ""
+			}
+		}
+		hitResults = append(hitResults, hit)
+	}
+	return hitResults
+}
@@ -0,0 +1,49 @@
+package messages
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Codes of a bye. 2xx means a normal shutdown, 4xx that the other servant did
+// something wrong and 5xx that the sender did
+const BYE_CODE_SHUTDOWN uint16 = 200
+const BYE_CODE_ABUSE uint16 = 400
+
+// Sent as the last descriptor on a connection before closing it
+type ByeMsg struct {
+	Code    uint16
+	Message string
+}
+
+func parseByeBytes(buffer []byte, bye *ByeMsg) error {
+	if len(buffer) < 2 {
+		return fmt.Errorf("Expected buffer of length >= 2. Got buffer of length %d", len(buffer))
+	}
+	bye.Code = binary.LittleEndian.Uint16(buffer[:2])
+	message := buffer[2:]
+	if end := indexNullByte(message); end != -1 {
+		message = message[:end]
+	}
+	bye.Message = string(message)
+	return nil
+}
+
+func ParseByeBytes(buffer []byte) (*ByeMsg, error) {
+	bye := new(ByeMsg)
+	err := parseByeBytes(buffer, bye)
+	return bye, err
+}
+
+func (bye *ByeMsg) ParseBytes(buffer []byte) error {
+	err := parseByeBytes(buffer, bye)
+	return err
+}
+
+// The message is null terminated
+func (bye *ByeMsg) ToBytes() []byte {
+	buffer := make([]byte, 2, 3+len(bye.Message))
+	binary.LittleEndian.PutUint16(buffer, bye.Code)
+	buffer = append(buffer, bye.Message...)
+	return append(buffer, 0x00)
+}
@@ -11,6 +11,9 @@ import (
 
 const PING byte = 0x00
 const PONG byte = 0x01
+const BYE byte = 0x02
+const ROUTE_TABLE_UPDATE byte = 0x30
+const VENDOR byte = 0x31
 const PUSH byte = 0x40
 const QUERY byte = 0x80
 const QUERYHIT byte = 0x81
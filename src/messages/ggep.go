@@ -0,0 +1,332 @@
+package messages
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const GGEP_MAGIC byte = 0xC3
+const GGEP_MAX_DATA_LEN int = 1<<18 - 1 // Data length is at most three 6 bit groups
+
+// Flags in the first byte of a GGEP extension header
+const GGEP_LAST_FLAG byte = 0x80     // Last extension of the block
+const GGEP_COBS_FLAG byte = 0x40     // Data is COBS encoded
+const GGEP_DEFLATE_FLAG byte = 0x20  // Data is deflated
+const GGEP_RESERVED_FLAG byte = 0x10 // Must be 0
+const GGEP_ID_LEN_MASK byte = 0x0F
+
+// Flags in each byte of a GGEP data length
+const GGEP_LEN_LAST byte = 0x80
+const GGEP_LEN_MORE byte = 0x40
+
+// A single extension of a GGEP block
+type GGEPExtension struct {
+	ID      string // 1 to 15 bytes, none of them null
+	Data    []byte // Decoded value. At most GGEP_MAX_DATA_LEN bytes once encoded
+	COBS    bool   // Encode Data so it has no null bytes. Set automatically where nulls aren't allowed
+	Deflate bool   // Compress Data
+}
+
+// A GGEP extension block, as carried in the extension blocks of queries and
+// query hit results, and after the payloads of pongs and pushes
+type GGEP []GGEPExtension
+
+// Returns the data of the extension with the given ID
+func (ggep GGEP) Get(id string) ([]byte, bool) {
+	for _, ext := range ggep {
+		if ext.ID == id {
+			return ext.Data, true
+		}
+	}
+	return nil, false
+}
+
+// True if there is an extension with the given ID
+func (ggep GGEP) Has(id string) bool {
+	_, ok := ggep.Get(id)
+	return ok
+}
+
+// Adds an extension with the given ID, replacing any existing one
+func (ggep *GGEP) Set(id string, data []byte) error {
+	ext := GGEPExtension{ID: id, Data: data}
+	err := ext.validate()
+	if err != nil {
+		return err
+	}
+	for i := range *ggep {
+		if (*ggep)[i].ID == id {
+			(*ggep)[i] = ext
+			return nil
+		}
+	}
+	*ggep = append(*ggep, ext)
+	return nil
+}
+
+// Removes the extension with the given ID, if any
+func (ggep *GGEP) Remove(id string) {
+	for i := range *ggep {
+		if (*ggep)[i].ID == id {
+			*ggep = append((*ggep)[:i], (*ggep)[i+1:]...)
+			return
+		}
+	}
+}
+
+func (ext *GGEPExtension) validate() error {
+	if len(ext.ID) == 0 || len(ext.ID) > int(GGEP_ID_LEN_MASK) {
+		return fmt.Errorf("GGEP extension ID \"%s\" must be 1 to 15 bytes long", ext.ID)
+	}
+	if indexNullByte([]byte(ext.ID)) != -1 {
+		return fmt.Errorf("GGEP extension ID \"%s\" can't contain null bytes", ext.ID)
+	}
+	if len(ext.Data) > GGEP_MAX_DATA_LEN {
+		return fmt.Errorf("GGEP extension \"%s\" has %d bytes of data. Max is %d", ext.ID, len(ext.Data), GGEP_MAX_DATA_LEN)
+	}
+	return nil
+}
+
+// Encodes the block, starting with GGEP_MAGIC. Invalid extensions are left out.
+// Returns nil if there are no valid extensions.
+func (ggep GGEP) ToBytes() []byte {
+	return ggep.encode(false)
+}
+
+// Encodes the block. If noNulls is set, extensions whose data would contain a
+// null byte are COBS encoded.
+func (ggep GGEP) encode(noNulls bool) []byte {
+	var encoded [][]byte
+	var headers []byte
+	for _, ext := range ggep {
+		if ext.validate() != nil {
+			continue
+		}
+		flags := byte(len(ext.ID))
+		data := ext.Data
+		if ext.Deflate {
+			data = deflate(data)
+			flags |= GGEP_DEFLATE_FLAG
+		}
+		if ext.COBS || (noNulls && indexNullByte(data) != -1) {
+			data = cobsEncode(data)
+			flags |= GGEP_COBS_FLAG
+		}
+		if len(data) > GGEP_MAX_DATA_LEN {
+			continue
+		}
+		headers = append(headers, flags)
+		encoded = append(encoded, append([]byte(ext.ID), append(encodeGGEPLen(len(data)), data...)...))
+	}
+	if len(encoded) == 0 {
+		return nil
+	}
+	headers[len(headers)-1] |= GGEP_LAST_FLAG
+	buffer := []byte{GGEP_MAGIC}
+	for i, ext := range encoded {
+		buffer = append(buffer, headers[i])
+		buffer = append(buffer, ext...)
+	}
+	return buffer
+}
+
+// Parses a GGEP block from the start of buffer and returns the number of bytes
+// it took up
+func ParseGGEP(buffer []byte) (GGEP, int, error) {
+	if len(buffer) == 0 || buffer[0] != GGEP_MAGIC {
+		return nil, 0, fmt.Errorf("GGEP block must start with %#x", GGEP_MAGIC)
+	}
+	var ggep GGEP
+	idx := 1
+	for {
+		if idx >= len(buffer) {
+			return nil, 0, fmt.Errorf("GGEP block ended before its last extension")
+		}
+		flags := buffer[idx]
+		idx++
+		if flags&GGEP_RESERVED_FLAG != 0 {
+			return nil, 0, fmt.Errorf("GGEP extension header has reserved bit set")
+		}
+		idLen := int(flags & GGEP_ID_LEN_MASK)
+		if idLen == 0 || idx+idLen > len(buffer) {
+			return nil, 0, fmt.Errorf("GGEP extension has bad ID length %d", idLen)
+		}
+		ext := GGEPExtension{
+			ID:      string(buffer[idx : idx+idLen]),
+			COBS:    flags&GGEP_COBS_FLAG != 0,
+			Deflate: flags&GGEP_DEFLATE_FLAG != 0,
+		}
+		idx += idLen
+		dataLen, n, err := parseGGEPLen(buffer[idx:])
+		if err != nil {
+			return nil, 0, err
+		}
+		idx += n
+		if idx+dataLen > len(buffer) {
+			return nil, 0, fmt.Errorf("GGEP extension \"%s\" has %d bytes of data but only %d remain", ext.ID, dataLen, len(buffer)-idx)
+		}
+		data := buffer[idx : idx+dataLen]
+		idx += dataLen
+		if ext.COBS {
+			data, err = cobsDecode(data)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		if ext.Deflate {
+			data, err = inflate(data, GGEP_MAX_DATA_LEN)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		ext.Data = append([]byte(nil), data...) // Don't keep a reference to buffer
+		ggep = append(ggep, ext)
+		if flags&GGEP_LAST_FLAG != 0 {
+			return ggep, idx, nil
+		}
+	}
+}
+
+// Data lengths are big endian groups of 6 bits, each in a byte flagged with
+// either GGEP_LEN_MORE or GGEP_LEN_LAST
+func encodeGGEPLen(length int) []byte {
+	switch {
+	case length < 1<<6:
+		return []byte{GGEP_LEN_LAST | byte(length)}
+	case length < 1<<12:
+		return []byte{GGEP_LEN_MORE | byte(length>>6), GGEP_LEN_LAST | byte(length&0x3F)}
+	}
+	return []byte{GGEP_LEN_MORE | byte(length>>12), GGEP_LEN_MORE | byte((length>>6)&0x3F), GGEP_LEN_LAST | byte(length&0x3F)}
+}
+
+func parseGGEPLen(buffer []byte) (int, int, error) {
+	length := 0
+	for i := 0; i < 3 && i < len(buffer); i++ {
+		length = length<<6 | int(buffer[i]&0x3F)
+		if buffer[i]&GGEP_LEN_LAST != 0 {
+			return length, i + 1, nil
+		}
+		if buffer[i]&GGEP_LEN_MORE == 0 {
+			return 0, 0, fmt.Errorf("GGEP data length byte %#x has neither flag set", buffer[i])
+		}
+	}
+	return 0, 0, fmt.Errorf("GGEP data length isn't terminated within 3 bytes")
+}
+
+// Consistent Overhead Byte Stuffing. Removes null bytes from data at a cost of
+// at most one byte in every 254
+func cobsEncode(data []byte) []byte {
+	encoded := make([]byte, 1, len(data)+len(data)/254+2)
+	codeIdx := 0
+	code := byte(1)
+	for _, b := range data {
+		if b == 0x00 {
+			encoded[codeIdx] = code
+			codeIdx = len(encoded)
+			encoded = append(encoded, 0)
+			code = 1
+			continue
+		}
+		encoded = append(encoded, b)
+		code++
+		if code == 0xFF {
+			encoded[codeIdx] = code
+			codeIdx = len(encoded)
+			encoded = append(encoded, 0)
+			code = 1
+		}
+	}
+	encoded[codeIdx] = code
+	return encoded
+}
+
+func cobsDecode(encoded []byte) ([]byte, error) {
+	data := make([]byte, 0, len(encoded))
+	for idx := 0; idx < len(encoded); {
+		code := int(encoded[idx])
+		if code == 0 || idx+code > len(encoded) {
+			return nil, fmt.Errorf("Malformed COBS data")
+		}
+		data = append(data, encoded[idx+1:idx+code]...)
+		idx += code
+		if code < 0xFF && idx < len(encoded) {
+			data = append(data, 0x00)
+		}
+	}
+	return data, nil
+}
+
+// GGEP's deflate encoding is the zlib stream format used by most servants
+func deflate(data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	writer.Write(data)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+// Fails if the data inflates to more than maxLen bytes, so that a small
+// deflated message can't exhaust memory
+func inflate(data []byte, maxLen int) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	inflated, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > maxLen {
+		return nil, fmt.Errorf("Deflated data inflates to more than %d bytes", maxLen)
+	}
+	return inflated, nil
+}
+
+// Parses an extension block, whose items are separated by EXTENSION_SEPARATOR
+// and which ends at a null byte or the end of buffer. Items are GGEP blocks or
+// plain strings such as HUGE URNs. Returns the number of bytes taken up, not
+// counting the null byte.
+func parseExtensionBlock(buffer []byte) ([]string, GGEP, int, error) {
+	var items []string
+	var ggep GGEP
+	idx := 0
+	for idx < len(buffer) && buffer[idx] != 0x00 {
+		if buffer[idx] == EXTENSION_SEPARATOR {
+			idx++
+			continue
+		}
+		if buffer[idx] == GGEP_MAGIC {
+			block, n, err := ParseGGEP(buffer[idx:])
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			ggep = append(ggep, block...)
+			idx += n
+			continue
+		}
+		end := idx
+		for end < len(buffer) && buffer[end] != 0x00 && buffer[end] != EXTENSION_SEPARATOR {
+			end++
+		}
+		items = append(items, string(buffer[idx:end]))
+		idx = end
+	}
+	return items, ggep, idx, nil
+}
+
+// Encodes an extension block from a URN and an encoded GGEP block, either of
+// which may be empty. The GGEP block must not contain null bytes.
+func extensionBlock(urn string, ggepBlock string) []byte {
+	block := []byte(urn)
+	if ggepBlock != "" {
+		if len(block) > 0 {
+			block = append(block, EXTENSION_SEPARATOR)
+		}
+		block = append(block, ggepBlock...)
+	}
+	return block
+}
@@ -0,0 +1,25 @@
+package messages
+
+import (
+	"../ipaddr"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+)
+
+// GGEP extensions used by GUESS
+const GGEP_QK_ID string = "QK"   // On a ping: asks for a query key. On a pong or query: the key
+const GGEP_GUE_ID string = "GUE" // On a pong: the sender answers GUESS queries. Data is the version
+const GUESS_VERSION byte = 0x01
+const QUERY_KEY_LEN int = 8
+
+// Returns the query key of a GUESS client, which is only valid for queries
+// from its address. secret is kept by the servant issuing keys.
+func QueryKey(secret []byte, addr ipaddr.IPAddr) []byte {
+	mac := hmac.New(sha1.New, secret)
+	var port [2]byte
+	binary.LittleEndian.PutUint16(port[:], addr.Port)
+	mac.Write(addr.IP[:])
+	mac.Write(port[:])
+	return mac.Sum(nil)[:QUERY_KEY_LEN]
+}
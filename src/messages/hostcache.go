@@ -0,0 +1,39 @@
+package messages
+
+import (
+	"../ipaddr"
+	"encoding/binary"
+	"fmt"
+)
+
+// GGEP extensions used by UDP host caches
+const GGEP_SCP_ID string = "SCP"     // On a ping: send cached hosts in the pong
+const GGEP_IPP_ID string = "IPP"     // On a pong: packed IP:port list of hosts
+const GGEP_UDPHC_ID string = "UDPHC" // On a pong: the sender is a UDP host cache
+
+// Packs addresses into 6 byte entries of a big endian IP and little endian port
+func PackIPPorts(addrs []ipaddr.IPAddr) []byte {
+	buffer := make([]byte, 0, 6*len(addrs))
+	for _, addr := range addrs {
+		var port [2]byte
+		binary.LittleEndian.PutUint16(port[:], addr.Port)
+		buffer = append(buffer, addr.IP[:]...)
+		buffer = append(buffer, port[:]...)
+	}
+	return buffer
+}
+
+// Unpacks addresses packed by PackIPPorts
+func UnpackIPPorts(buffer []byte) ([]ipaddr.IPAddr, error) {
+	if len(buffer)%6 != 0 {
+		return nil, fmt.Errorf("Packed IP:port list has length %d, which isn't a multiple of 6", len(buffer))
+	}
+	addrs := make([]ipaddr.IPAddr, 0, len(buffer)/6)
+	for i := 0; i < len(buffer); i += 6 {
+		var addr ipaddr.IPAddr
+		copy(addr.IP[:], buffer[i:i+4])
+		addr.Port = binary.LittleEndian.Uint16(buffer[i+4 : i+6])
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,26 @@
+package messages
+
+import (
+	"../ipaddr"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+)
+
+const GGEP_NETWORK_TAG_ID string = "PN" // On UDP pings, pongs, queries and query hits: proves the sender is a member of a private network
+const NETWORK_TAG_LEN int = 8
+
+// Returns the tag a member of the private network with the given key sets on
+// a descriptor it sends. addr is the sender's address, which is the one in the
+// payload of pongs and query hits. payload is the descriptor's payload without
+// the tag, so that the tag can't be reused on a different payload.
+func NetworkTag(key []byte, guid [16]byte, addr ipaddr.IPAddr, payload []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	var port [2]byte
+	binary.LittleEndian.PutUint16(port[:], addr.Port)
+	mac.Write(guid[:])
+	mac.Write(addr.IP[:])
+	mac.Write(port[:])
+	mac.Write(payload)
+	return mac.Sum(nil)[:NETWORK_TAG_LEN]
+}
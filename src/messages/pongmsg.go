@@ -10,18 +10,27 @@ type PongMsg struct {
 	Addr      ipaddr.IPAddr
 	NumShared uint32
 	NumKB     uint32
+	GGEP      GGEP // Extensions following the pong's fields. Optional
 }
 
 func parsePongBytes(buffer []byte, pong *PongMsg) error {
-	if len(buffer) != 14 {
-		return fmt.Errorf("Expected buffer of length 14. Received buffer of length %d", len(buffer))
+	if len(buffer) < 14 {
+		return fmt.Errorf("Expected buffer of length >= 14. Received buffer of length %d", len(buffer))
 	}
 	err0 := pong.Addr.ParseBytes(buffer[:6])
 	if err0 != nil {
 		return err0
 	}
 	pong.NumShared = binary.LittleEndian.Uint32(buffer[6:10])
-	pong.NumKB = binary.LittleEndian.Uint32(buffer[10:])
+	pong.NumKB = binary.LittleEndian.Uint32(buffer[10:14])
+	pong.GGEP = nil
+	if len(buffer) > 14 && buffer[14] == GGEP_MAGIC {
+		ggep, _, err := ParseGGEP(buffer[14:])
+		if err != nil {
+			return err
+		}
+		pong.GGEP = ggep
+	}
 	return nil
 }
 
@@ -42,5 +51,5 @@ func (pong *PongMsg) ToBytes() []byte {
 	copy(buffer[:6], addrBytes)
 	binary.LittleEndian.PutUint32(buffer[6:10], pong.NumShared)
 	binary.LittleEndian.PutUint32(buffer[10:], pong.NumKB)
-	return buffer[:]
+	return append(buffer[:], pong.GGEP.ToBytes()...)
 }
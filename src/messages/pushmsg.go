@@ -6,15 +6,18 @@ import (
 	"fmt"
 )
 
+const GGEP_PUSH_ID string = "PUSH" // In a query hit's EQHD: packed IP:port list of the servant's push proxies
+
 type PushMsg struct {
 	ServantID string
 	FileIndex uint32
 	Addr      ipaddr.IPAddr
+	GGEP      GGEP // Extensions following the push's fields. Optional
 }
 
 func parsePushBytes(buffer []byte, push *PushMsg) error {
-	if len(buffer) != 26 {
-		return fmt.Errorf("Expected buffer of length 26. Got buffer of length %d", len(buffer))
+	if len(buffer) < 26 {
+		return fmt.Errorf("Expected buffer of length >= 26. Got buffer of length %d", len(buffer))
 	}
 	push.ServantID = string(buffer[:16])
 	push.FileIndex = binary.LittleEndian.Uint32(buffer[16:20])
@@ -22,6 +25,13 @@ func parsePushBytes(buffer []byte, push *PushMsg) error {
 	copy(addrBuffer[:2], buffer[24:])
 	copy(addrBuffer[2:], buffer[20:24])
 	err := push.Addr.ParseBytes(addrBuffer)
+	if err != nil {
+		return err
+	}
+	push.GGEP = nil
+	if len(buffer) > 26 && buffer[26] == GGEP_MAGIC {
+		push.GGEP, _, err = ParseGGEP(buffer[26:])
+	}
 	return err // could be nil
 }
 
@@ -43,5 +53,5 @@ func (push *PushMsg) ToBytes() []byte {
 	addrBuffer := push.Addr.ToBytes()
 	copy(buffer[20:24], addrBuffer[2:])
 	copy(buffer[24:], addrBuffer[:2])
-	return buffer
+	return append(buffer, push.GGEP.ToBytes()...)
 }
@@ -0,0 +1,131 @@
+package messages
+
+import (
+	"fmt"
+)
+
+// Flags of the open data area of an extended query hit descriptor (EQHD)
+const EQHD_PUSH_FLAG byte = 0x01     // Servant is firewalled and needs a push to upload
+const EQHD_BUSY_FLAG byte = 0x04     // All of the servant's upload slots are in use
+const EQHD_UPLOADED_FLAG byte = 0x08 // Servant has completed at least one upload
+const EQHD_SPEED_FLAG byte = 0x10    // Speed in the query hit was measured rather than set by the user
+const EQHD_GGEP_FLAG byte = 0x20     // Private data area holds a GGEP block
+
+const EQHD_OPEN_DATA_LEN byte = 2
+
+const GGEP_TLS_ID string = "TLS" // In the EQHD's GGEP block: the servant accepts TLS connections
+
+// The extended query hit descriptor (EQHD) found between a query hit's result
+// set and its servant ID. Parsed trailers are encoded again as they were
+// received, apart from the changes made to them, so that hits are forwarded
+// unchanged.
+type QHDTrailer struct {
+	VendorCode  string // 4 character vendor code, e.g. "GTLA". Shorter if the servant sent fewer than 4 bytes
+	Flags       byte   // EQHD_*_FLAG bits that are set
+	KnownFlags  byte   // EQHD_*_FLAG bits the servant gave a value for. Flags outside of it are meaningless
+	PrivateData []byte // Vendor specific data, before the GGEP block
+	GGEP        GGEP   // Extensions in the private data area. EQHD_GGEP_FLAG is set automatically when encoding
+
+	parsed   bool   // Came from a received hit, so openData holds what the servant sent
+	openData []byte // Open data area as received. nil if the trailer ended after the vendor code
+}
+
+// Returns the value of one of the EQHD_*_FLAG flags, and whether the servant
+// gave a value for it
+func (trailer *QHDTrailer) Flag(flag byte) (bool, bool) {
+	return trailer.Flags&flag != 0, trailer.KnownFlags&flag != 0
+}
+
+// Sets the value of one of the EQHD_*_FLAG flags and marks it as known
+func (trailer *QHDTrailer) SetFlag(flag byte, value bool) {
+	trailer.KnownFlags |= flag
+	if value {
+		trailer.Flags |= flag
+	} else {
+		trailer.Flags &^= flag
+	}
+}
+
+// Parses the bytes between a query hit's result set and its servant ID. The
+// open data's first byte holds the enable bits and the second byte the flag
+// values, except for EQHD_PUSH_FLAG whose bits are the other way around.
+// Trailers shorter than a vendor code are kept in VendorCode.
+func parseQHDTrailer(buffer []byte, trailer *QHDTrailer) error {
+	*trailer = QHDTrailer{parsed: true}
+	if len(buffer) <= 4 {
+		trailer.VendorCode = string(buffer)
+		return nil
+	}
+	trailer.VendorCode = string(buffer[:4])
+	openDataLen := int(buffer[4])
+	if 5+openDataLen > len(buffer) {
+		return fmt.Errorf("EQHD open data of length %d doesn't fit in %d bytes", openDataLen, len(buffer)-5)
+	}
+	openData := buffer[5 : 5+openDataLen]
+	trailer.openData = append([]byte{}, openData...)
+	if openDataLen >= 2 {
+		trailer.KnownFlags, trailer.Flags = decodeEQHDFlags(openData[0], openData[1])
+	}
+	private := buffer[5+openDataLen:]
+	if hasGGEP, known := trailer.Flag(EQHD_GGEP_FLAG); hasGGEP && known {
+		// The GGEP block follows any vendor specific data and runs to the servant ID
+		for i := range private {
+			if private[i] != GGEP_MAGIC {
+				continue
+			}
+			ggep, n, err := ParseGGEP(private[i:])
+			if err == nil && i+n == len(private) {
+				trailer.GGEP = ggep
+				private = private[:i]
+				break
+			}
+		}
+	}
+	if len(private) > 0 {
+		trailer.PrivateData = append([]byte(nil), private...)
+	}
+	return nil
+}
+
+// Returns the known flags and the flags set given the open data's first two
+// bytes
+func decodeEQHDFlags(enablers byte, values byte) (byte, byte) {
+	known := enablers&^EQHD_PUSH_FLAG | values&EQHD_PUSH_FLAG
+	return known, (values&^EQHD_PUSH_FLAG | enablers&EQHD_PUSH_FLAG) & known
+}
+
+// Encodes the trailer. A parsed trailer keeps the length and bytes of its open
+// data, and its flag bytes are only rewritten if the flags were changed.
+// Trailers built locally get EQHD_OPEN_DATA_LEN bytes of open data.
+func (trailer *QHDTrailer) ToBytes() []byte {
+	flags, known := trailer.Flags&trailer.KnownFlags, trailer.KnownFlags
+	ggep := trailer.GGEP.ToBytes()
+	if ggep != nil {
+		flags |= EQHD_GGEP_FLAG
+		known |= EQHD_GGEP_FLAG
+	} else {
+		flags &^= EQHD_GGEP_FLAG
+	}
+	openData := make([]byte, EQHD_OPEN_DATA_LEN)
+	if trailer.parsed {
+		if trailer.openData == nil && known == 0 && len(trailer.PrivateData) == 0 {
+			return []byte(trailer.VendorCode) // Nothing followed the vendor code
+		}
+		openData = append([]byte{}, trailer.openData...)
+	}
+	if len(openData) < 2 && known != 0 {
+		openData = append(openData, make([]byte, 2-len(openData))...)
+	}
+	if len(openData) >= 2 {
+		if oldKnown, oldFlags := decodeEQHDFlags(openData[0], openData[1]); oldKnown != known || oldFlags != flags {
+			openData[0] = known&^EQHD_PUSH_FLAG | flags&EQHD_PUSH_FLAG
+			openData[1] = flags&^EQHD_PUSH_FLAG | known&EQHD_PUSH_FLAG
+		}
+	}
+	buffer := make([]byte, 5, 5+len(openData)+len(trailer.PrivateData)+len(ggep))
+	WriteStringLE(buffer[:4], trailer.VendorCode)
+	buffer[4] = byte(len(openData))
+	buffer = append(buffer, openData...)
+	buffer = append(buffer, trailer.PrivateData...)
+	return append(buffer, ggep...)
+}
@@ -10,6 +10,8 @@ type HitResult struct {
 	FileIndex uint32
 	FileSize  uint32
 	Filename  string
+	URN       string // "urn:sha1:" URN of the file's contents. Optional
+	GGEPBlock string // Encoded GGEP block carried in the result's extension block, kept encoded so that results can be compared with ==. Use GetGGEP and SetGGEP. Optional
 }
 
 type QueryHitMsg struct {
@@ -17,32 +19,41 @@ type QueryHitMsg struct {
 	Addr      ipaddr.IPAddr
 	Speed     uint32
 	ResultSet []HitResult
+	Trailer   *QHDTrailer // Extended query hit descriptor. nil if the hit didn't have one
 	ServantID [16]byte
 }
 
-func findDoubleNullByte(buffer []byte) int {
-	for i := len(buffer) - 2; i >= 0; i-- {
-		if buffer[i] == 0x00 && buffer[i+1] == 0x00 {
-			return i
-		}
-	}
-	return -1
-}
-
-func parseHitResultBytes(buffer []byte, hit *HitResult) error {
-	if len(buffer) <= 10 {
-		return fmt.Errorf("Expected buffer of length > 10. Got input buffer of length %d", len(buffer))
+// Parses a result from the start of buffer and returns the number of bytes it
+// took up. Results are the file index and size followed by the null terminated
+// filename and a null terminated extension block.
+func parseHitResult(buffer []byte, hit *HitResult) (int, error) {
+	if len(buffer) < 10 {
+		return 0, fmt.Errorf("Expected buffer of length >= 10. Got input buffer of length %d", len(buffer))
 	}
 	hit.FileIndex = binary.LittleEndian.Uint32(buffer[:4])
 	hit.FileSize = binary.LittleEndian.Uint32(buffer[4:8])
 	filenameBuffer := buffer[8:]
-	nullIdx := findDoubleNullByte(filenameBuffer)
+	nullIdx := indexNullByte(filenameBuffer)
 	if nullIdx == -1 {
-		return fmt.Errorf("Couldn't find double null character in input buffer")
+		return 0, fmt.Errorf("Couldn't find null character terminating filename in input buffer")
 	}
-	var err error = nil
 	hit.Filename = ReadStringLE(filenameBuffer[:nullIdx])
-	return err // err might be nil
+	extensionBuffer := filenameBuffer[nullIdx+1:]
+	items, ggep, extensionLen, err := parseExtensionBlock(extensionBuffer)
+	if err != nil {
+		return 0, err
+	}
+	if extensionLen == len(extensionBuffer) {
+		return 0, fmt.Errorf("Couldn't find null character terminating extension block in input buffer")
+	}
+	hit.URN = urnFromExtensions(items)
+	hit.SetGGEP(ggep)
+	return 8 + nullIdx + 1 + extensionLen + 1, nil
+}
+
+func parseHitResultBytes(buffer []byte, hit *HitResult) error {
+	_, err := parseHitResult(buffer, hit)
+	return err
 }
 
 func ParseHitResultBytes(buffer []byte) (*HitResult, error) {
@@ -56,17 +67,38 @@ func (hit *HitResult) ParseBytes(buffer []byte) error {
 	return err
 }
 
+// Returns the extensions carried in the result's extension block
+func (hit *HitResult) GetGGEP() GGEP {
+	if hit.GGEPBlock == "" {
+		return nil
+	}
+	ggep, _, err := ParseGGEP([]byte(hit.GGEPBlock))
+	if err != nil {
+		return nil
+	}
+	return ggep
+}
+
+// Replaces the extensions carried in the result's extension block. Extensions
+// whose data contains a null byte are COBS encoded.
+func (hit *HitResult) SetGGEP(ggep GGEP) {
+	hit.GGEPBlock = string(ggep.encode(true))
+}
+
 func (hit *HitResult) ByteLength() int {
-	return 10 + len(hit.Filename) // 4 for Fileindex, 4 for Filesize, 2 for double null termination, len(hit.Filename)
+	return 10 + len(hit.Filename) + len(extensionBlock(hit.URN, hit.GGEPBlock)) // 4 for Fileindex, 4 for Filesize, 2 for null terminations, len(hit.Filename), extension block
 }
 
 func (hit *HitResult) ToBytes() []byte {
-	bufferLen := hit.ByteLength()
+	extensions := extensionBlock(hit.URN, hit.GGEPBlock)
+	bufferLen := 10 + len(hit.Filename) + len(extensions)
 	buffer := make([]byte, bufferLen)
 	binary.LittleEndian.PutUint32(buffer[:4], hit.FileIndex)
 	binary.LittleEndian.PutUint32(buffer[4:8], hit.FileSize)
-	WriteStringLE(buffer[8:bufferLen-2], hit.Filename)
-	buffer[bufferLen-2] = 0x00
+	filenameEnd := 8 + len(hit.Filename)
+	WriteStringLE(buffer[8:filenameEnd], hit.Filename)
+	buffer[filenameEnd] = 0x00
+	copy(buffer[filenameEnd+1:], extensions)
 	buffer[bufferLen-1] = 0x00
 	return buffer
 }
@@ -88,14 +120,23 @@ func parseQueryHitBytes(buffer []byte, queryHit *QueryHitMsg) error {
 		if hitIdx > len(buffer)-16 { // Last 16 bytes are for servent identifier
 			return fmt.Errorf("Number of Hits indicated doesn't match number of hits given")
 		}
-		hit, err1 := ParseHitResultBytes(buffer[hitIdx:])
+		var hit HitResult
+		hitLen, err1 := parseHitResult(buffer[hitIdx:len(buffer)-16], &hit)
 		if err1 != nil {
 			return err1
 		}
-		queryHit.ResultSet = append(queryHit.ResultSet, *hit)
-		hitIdx += hit.ByteLength()
+		queryHit.ResultSet = append(queryHit.ResultSet, hit)
+		hitIdx += hitLen
+	}
+	queryHit.Trailer = nil
+	if trailerLen := len(buffer) - 16 - hitIdx; trailerLen > 0 {
+		queryHit.Trailer = new(QHDTrailer)
+		err := parseQHDTrailer(buffer[hitIdx:len(buffer)-16], queryHit.Trailer)
+		if err != nil {
+			return err
+		}
 	}
-	copy(queryHit.ServantID[:], []byte(ReadStringLE(buffer[hitIdx:])))
+	copy(queryHit.ServantID[:], []byte(ReadStringLE(buffer[len(buffer)-16:])))
 	return nil
 }
 
@@ -115,6 +156,9 @@ func (queryHit *QueryHitMsg) ByteLength() int {
 	for _, hit := range queryHit.ResultSet {
 		hitResultsLength += hit.ByteLength()
 	}
+	if queryHit.Trailer != nil {
+		hitResultsLength += len(queryHit.Trailer.ToBytes())
+	}
 	return 27 + hitResultsLength
 }
 
@@ -131,6 +175,9 @@ func (queryHit *QueryHitMsg) ToBytes() []byte {
 		copy(buffer[hitIdx:], hitBytes)
 		hitIdx += len(hitBytes)
 	}
-	WriteStringLE(buffer[hitIdx:], string(queryHit.ServantID[:]))
+	if queryHit.Trailer != nil {
+		copy(buffer[hitIdx:], queryHit.Trailer.ToBytes())
+	}
+	WriteStringLE(buffer[bufferLen-16:], string(queryHit.ServantID[:]))
 	return buffer
 }
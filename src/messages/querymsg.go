@@ -1,6 +1,7 @@
 package messages
 
 import (
+	"../ipaddr"
 	"encoding/binary"
 	"fmt"
 )
@@ -8,16 +9,8 @@ import (
 type QueryMsg struct {
 	MinSpeed    uint16
 	SearchQuery string
-}
-
-func findNullByte(buffer []byte) int {
-	// Reverse iteration...chances are null char will be towards the end of the buffer
-	for i := len(buffer) - 1; i >= 0; i-- {
-		if buffer[i] == 0x00 {
-			return i
-		}
-	}
-	return -1
+	URN         string // If set, asks for files with this "urn:sha1:" URN. SearchQuery may then be empty
+	GGEP        GGEP   // Extensions carried in the query's extension block. Optional
 }
 
 func parseQueryBytes(buffer []byte, query *QueryMsg) error {
@@ -27,11 +20,18 @@ func parseQueryBytes(buffer []byte, query *QueryMsg) error {
 	query.MinSpeed = binary.LittleEndian.Uint16(buffer[:2])
 
 	queryBuffer := buffer[2:]
-	nullIdx := findNullByte(queryBuffer)
+	nullIdx := indexNullByte(queryBuffer)
 	if nullIdx == -1 {
 		return fmt.Errorf("Input buffer didn't have null terminating search query string")
 	}
 	query.SearchQuery = ReadStringLE(queryBuffer[:nullIdx]) // cut off null byte
+	// Anything after the search query is an extension block, itself possibly null terminated
+	items, ggep, _, err := parseExtensionBlock(queryBuffer[nullIdx+1:])
+	if err != nil {
+		return err
+	}
+	query.URN = urnFromExtensions(items)
+	query.GGEP = ggep
 	return nil
 }
 
@@ -48,9 +48,58 @@ func (query *QueryMsg) ParseBytes(buffer []byte) error {
 
 func (query *QueryMsg) ToBytes() []byte {
 	bufferLen := 3 + len(query.SearchQuery) // 2 bytes for MinSpeed, len(query.SearchQuery) bytes for query, 1 byte for null terminating char
+	extensions := extensionBlock(query.URN, string(query.GGEP.encode(true)))
+	if len(extensions) > 0 {
+		bufferLen += len(extensions) + 1 // Extension block and its null terminating char
+	}
 	buffer := make([]byte, bufferLen)
 	binary.LittleEndian.PutUint16(buffer[:2], query.MinSpeed)
-	WriteStringLE(buffer[2:], query.SearchQuery)
+	queryEnd := 2 + len(query.SearchQuery)
+	WriteStringLE(buffer[2:queryEnd], query.SearchQuery)
+	buffer[queryEnd] = 0x00
+	copy(buffer[queryEnd+1:], extensions)
 	buffer[bufferLen-1] = 0x00
 	return buffer
 }
+
+// MinSpeed flags. If QUERY_FLAGS_MARKER is set, the rest of MinSpeed holds flags
+// instead of a speed.
+const QUERY_FLAGS_MARKER uint16 = 0x8000
+const QUERY_OOB_FLAG uint16 = 0x0004 // Hits may be delivered out of band, to the address in the query's GUID
+
+// Returns the minimum speed asked for, or 0 if MinSpeed holds flags
+func (query *QueryMsg) Speed() uint16 {
+	if query.MinSpeed&QUERY_FLAGS_MARKER != 0 {
+		return 0
+	}
+	return query.MinSpeed
+}
+
+// True if the query asks for hits out of band
+func (query *QueryMsg) IsOOB() bool {
+	return query.MinSpeed&(QUERY_FLAGS_MARKER|QUERY_OOB_FLAG) == QUERY_FLAGS_MARKER|QUERY_OOB_FLAG
+}
+
+// Marks the query as asking for hits out of band. Any minimum speed is dropped.
+func (query *QueryMsg) SetOOB() {
+	if query.MinSpeed&QUERY_FLAGS_MARKER == 0 {
+		query.MinSpeed = QUERY_FLAGS_MARKER
+	}
+	query.MinSpeed |= QUERY_OOB_FLAG
+}
+
+// Returns the GUID with the address hits are delivered to out of band in its
+// first 4 bytes (the IP) and bytes 13 and 14 (the little endian port)
+func OOBGUID(guid [16]byte, addr ipaddr.IPAddr) [16]byte {
+	copy(guid[:4], addr.IP[:])
+	binary.LittleEndian.PutUint16(guid[13:15], addr.Port)
+	return guid
+}
+
+// Returns the address encoded in an OOB query's GUID by OOBGUID
+func OOBAddr(guid [16]byte) ipaddr.IPAddr {
+	var addr ipaddr.IPAddr
+	copy(addr.IP[:], guid[:4])
+	addr.Port = binary.LittleEndian.Uint16(guid[13:15])
+	return addr
+}
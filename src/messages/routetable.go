@@ -0,0 +1,154 @@
+package messages
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Variants of a ROUTE_TABLE_UPDATE descriptor
+const QRP_RESET byte = 0x00
+const QRP_PATCH byte = 0x01
+
+// Compressors of a QRP patch
+const QRP_COMPRESSOR_NONE byte = 0x00
+const QRP_COMPRESSOR_ZLIB byte = 0x01
+
+const qrpHashMultiplier uint64 = 0x4F1BBCDC
+
+// Tells the receiver to clear its copy of the sender's route table. Every entry
+// is set to Infinity, meaning "no match".
+type ResetTableMsg struct {
+	TableLength uint32 // Number of entries. Must be a power of 2
+	Infinity    byte
+}
+
+// One of SeqSize messages carrying changes to the sender's route table. The
+// concatenated Data of all of them, once decompressed, holds one signed
+// EntryBits wide value per table entry to add to it.
+type PatchTableMsg struct {
+	SeqNo      byte // 1 based
+	SeqSize    byte
+	Compressor byte // QRP_COMPRESSOR_NONE or QRP_COMPRESSOR_ZLIB
+	EntryBits  byte // 4 or 8
+	Data       []byte
+}
+
+func parseResetTableBytes(buffer []byte, reset *ResetTableMsg) error {
+	if len(buffer) != 6 || buffer[0] != QRP_RESET {
+		return fmt.Errorf("Expected RESET buffer of length 6. Got buffer of length %d", len(buffer))
+	}
+	reset.TableLength = binary.LittleEndian.Uint32(buffer[1:5])
+	reset.Infinity = buffer[5]
+	return nil
+}
+
+func ParseResetTableBytes(buffer []byte) (*ResetTableMsg, error) {
+	reset := new(ResetTableMsg)
+	err := parseResetTableBytes(buffer, reset)
+	return reset, err
+}
+
+func (reset *ResetTableMsg) ParseBytes(buffer []byte) error {
+	return parseResetTableBytes(buffer, reset)
+}
+
+func (reset *ResetTableMsg) ToBytes() []byte {
+	buffer := make([]byte, 6)
+	buffer[0] = QRP_RESET
+	binary.LittleEndian.PutUint32(buffer[1:5], reset.TableLength)
+	buffer[5] = reset.Infinity
+	return buffer
+}
+
+func parsePatchTableBytes(buffer []byte, patch *PatchTableMsg) error {
+	if len(buffer) < 5 || buffer[0] != QRP_PATCH {
+		return fmt.Errorf("Expected PATCH buffer of length >= 5. Got buffer of length %d", len(buffer))
+	}
+	patch.SeqNo = buffer[1]
+	patch.SeqSize = buffer[2]
+	patch.Compressor = buffer[3]
+	patch.EntryBits = buffer[4]
+	if patch.SeqNo == 0 || patch.SeqNo > patch.SeqSize {
+		return fmt.Errorf("PATCH sequence number %d out of range 1-%d", patch.SeqNo, patch.SeqSize)
+	}
+	if patch.EntryBits != 4 && patch.EntryBits != 8 {
+		return fmt.Errorf("PATCH entry bits must be 4 or 8. Got %d", patch.EntryBits)
+	}
+	patch.Data = append([]byte(nil), buffer[5:]...)
+	return nil
+}
+
+func ParsePatchTableBytes(buffer []byte) (*PatchTableMsg, error) {
+	patch := new(PatchTableMsg)
+	err := parsePatchTableBytes(buffer, patch)
+	return patch, err
+}
+
+func (patch *PatchTableMsg) ParseBytes(buffer []byte) error {
+	return parsePatchTableBytes(buffer, patch)
+}
+
+func (patch *PatchTableMsg) ToBytes() []byte {
+	buffer := []byte{QRP_PATCH, patch.SeqNo, patch.SeqSize, patch.Compressor, patch.EntryBits}
+	return append(buffer, patch.Data...)
+}
+
+// Splits a table's patch into PATCH messages carrying at most chunkSize bytes
+// of zlib compressed data each. Returns nil if the patch needs more than 255.
+func PatchMessages(patchData []byte, entryBits byte, chunkSize int) []PatchTableMsg {
+	compressed := deflate(patchData)
+	numChunks := (len(compressed) + chunkSize - 1) / chunkSize
+	if numChunks > 255 {
+		return nil
+	}
+	patches := make([]PatchTableMsg, 0, numChunks)
+	for i := 0; i < numChunks; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(compressed) {
+			end = len(compressed)
+		}
+		patches = append(patches, PatchTableMsg{
+			SeqNo:      byte(i + 1),
+			SeqSize:    byte(numChunks),
+			Compressor: QRP_COMPRESSOR_ZLIB,
+			EntryBits:  entryBits,
+			Data:       compressed[i*chunkSize : end],
+		})
+	}
+	return patches
+}
+
+// Decompresses the concatenated data of a sequence of PATCH messages, which
+// is at most maxLen bytes for the table it patches
+func PatchData(data []byte, compressor byte, maxLen int) ([]byte, error) {
+	switch compressor {
+	case QRP_COMPRESSOR_NONE:
+		if len(data) > maxLen {
+			return nil, fmt.Errorf("PATCH has %d bytes of data. Max is %d", len(data), maxLen)
+		}
+		return data, nil
+	case QRP_COMPRESSOR_ZLIB:
+		return inflate(data, maxLen)
+	}
+	return nil, fmt.Errorf("Unknown PATCH compressor %d", compressor)
+}
+
+// The QRP hash of a keyword into a table of 2^bits entries. Keywords are
+// compared case insensitively.
+func QRPHash(keyword string, bits uint) uint32 {
+	var xor uint32
+	for i, b := range []byte(strings.ToLower(keyword)) {
+		xor ^= uint32(b) << (uint(i%4) * 8)
+	}
+	product := uint64(xor) * qrpHashMultiplier
+	return uint32(product&0xFFFFFFFF) >> (32 - bits)
+}
+
+// Splits a filename or search query into the keywords used by QRP
+func QRPKeywords(str string) []string {
+	return strings.FieldsFunc(strings.ToLower(str), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
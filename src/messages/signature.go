@@ -0,0 +1,96 @@
+package messages
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+)
+
+const GGEP_SIG_ID string = "SIG" // In a query hit's EQHD: the servant's ed25519 public key followed by its signature of the hit
+
+// Returns the bytes a query hit's signature covers: the descriptor ID of the
+// query it answers, the servant's address, ID and speed, the index, size,
+// filename, URN and GGEP extensions of each result, and the EQHD's vendor
+// code, flags, private data and GGEP extensions. The signature itself and the
+// network tag, which is added after signing, are left out.
+func (queryHit *QueryHitMsg) SignedBytes(descID [16]byte) []byte {
+	buffer := append([]byte(nil), descID[:]...)
+	var number [4]byte
+	buffer = append(buffer, queryHit.Addr.IP[:]...)
+	binary.LittleEndian.PutUint16(number[:2], queryHit.Addr.Port)
+	buffer = append(buffer, number[:2]...)
+	buffer = append(buffer, queryHit.ServantID[:]...)
+	binary.LittleEndian.PutUint32(number[:], queryHit.Speed)
+	buffer = append(buffer, number[:]...)
+	for _, hit := range queryHit.ResultSet {
+		binary.LittleEndian.PutUint32(number[:], hit.FileIndex)
+		buffer = append(buffer, number[:]...)
+		binary.LittleEndian.PutUint32(number[:], hit.FileSize)
+		buffer = append(buffer, number[:]...)
+		buffer = append(buffer, hit.Filename...)
+		buffer = append(buffer, 0x00)
+		buffer = append(buffer, hit.URN...)
+		buffer = append(buffer, 0x00)
+		ggep := hit.GetGGEP()
+		binary.LittleEndian.PutUint32(number[:], uint32(len(ggep)))
+		buffer = append(buffer, number[:]...)
+		for _, ext := range ggep {
+			buffer = appendSignedExtension(buffer, ext)
+		}
+	}
+	if trailer := queryHit.Trailer; trailer != nil {
+		number = [4]byte{}
+		WriteStringLE(number[:], trailer.VendorCode)
+		buffer = append(buffer, number[:]...)
+		buffer = append(buffer, trailer.Flags&trailer.KnownFlags&^EQHD_GGEP_FLAG, trailer.KnownFlags&^EQHD_GGEP_FLAG)
+		binary.LittleEndian.PutUint32(number[:], uint32(len(trailer.PrivateData)))
+		buffer = append(buffer, number[:]...)
+		buffer = append(buffer, trailer.PrivateData...)
+		for _, ext := range trailer.GGEP {
+			if ext.ID == GGEP_SIG_ID || ext.ID == GGEP_NETWORK_TAG_ID {
+				continue
+			}
+			buffer = appendSignedExtension(buffer, ext)
+		}
+	}
+	return buffer
+}
+
+// Appends a GGEP extension's ID and data to the bytes covered by a signature
+func appendSignedExtension(buffer []byte, ext GGEPExtension) []byte {
+	var length [4]byte
+	buffer = append(buffer, ext.ID...)
+	buffer = append(buffer, 0x00)
+	binary.LittleEndian.PutUint32(length[:], uint32(len(ext.Data)))
+	buffer = append(buffer, length[:]...)
+	return append(buffer, ext.Data...)
+}
+
+// Signs the query hit for the query with the given descriptor ID. The trailer
+// is copied rather than changed in place, and one is added if there is none.
+func (queryHit *QueryHitMsg) Sign(descID [16]byte, key ed25519.PrivateKey) {
+	var trailer QHDTrailer
+	if queryHit.Trailer != nil {
+		trailer = *queryHit.Trailer
+	}
+	trailer.GGEP = append(GGEP(nil), trailer.GGEP...)
+	queryHit.Trailer = &trailer
+	signature := ed25519.Sign(key, queryHit.SignedBytes(descID))
+	trailer.GGEP.Set(GGEP_SIG_ID, append(append([]byte(nil), key.Public().(ed25519.PublicKey)...), signature...))
+}
+
+// Returns the public key whose signature of the query hit verifies, and false
+// if it isn't signed or the signature doesn't verify
+func (queryHit *QueryHitMsg) Signer(descID [16]byte) (ed25519.PublicKey, bool) {
+	if queryHit.Trailer == nil {
+		return nil, false
+	}
+	sig, ok := queryHit.Trailer.GGEP.Get(GGEP_SIG_ID)
+	if !ok || len(sig) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, false
+	}
+	key := ed25519.PublicKey(sig[:ed25519.PublicKeySize])
+	if !ed25519.Verify(key, queryHit.SignedBytes(descID), sig[ed25519.PublicKeySize:]) {
+		return nil, false
+	}
+	return key, true
+}
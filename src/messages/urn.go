@@ -0,0 +1,64 @@
+package messages
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"io"
+	"strings"
+)
+
+const URN_SHA1_PREFIX string = "urn:sha1:"
+const EXTENSION_SEPARATOR byte = 0x1C // Separates items of an extension block
+
+// Returns the HUGE "urn:sha1:" URN of a SHA1 digest
+func SHA1URN(digest []byte) string {
+	return URN_SHA1_PREFIX + base32.StdEncoding.EncodeToString(digest)
+}
+
+// Reads r to the end and returns the "urn:sha1:" URN of its contents
+func ComputeSHA1URN(r io.Reader) (string, error) {
+	hash := sha1.New()
+	_, err := io.Copy(hash, r)
+	if err != nil {
+		return "", err
+	}
+	return SHA1URN(hash.Sum(nil)), nil
+}
+
+// True if urn is a well formed "urn:sha1:" URN. The prefix is case insensitive
+func IsSHA1URN(urn string) bool {
+	if len(urn) != len(URN_SHA1_PREFIX)+32 || !strings.EqualFold(urn[:len(URN_SHA1_PREFIX)], URN_SHA1_PREFIX) {
+		return false
+	}
+	digest, err := base32.StdEncoding.DecodeString(strings.ToUpper(urn[len(URN_SHA1_PREFIX):]))
+	return err == nil && len(digest) == sha1.Size
+}
+
+// Returns urn with a lower case prefix and upper case digest so URNs can be
+// compared as strings
+func NormalizeURN(urn string) string {
+	if !IsSHA1URN(urn) {
+		return urn
+	}
+	return URN_SHA1_PREFIX + strings.ToUpper(urn[len(URN_SHA1_PREFIX):])
+}
+
+// Returns the first "urn:sha1:" URN among the items of an extension block
+func urnFromExtensions(items []string) string {
+	for _, item := range items {
+		if IsSHA1URN(item) {
+			return NormalizeURN(item)
+		}
+	}
+	return ""
+}
+
+// Returns the index of the first null byte in buffer, or -1 if there is none
+func indexNullByte(buffer []byte) int {
+	for i, b := range buffer {
+		if b == 0x00 {
+			return i
+		}
+	}
+	return -1
+}
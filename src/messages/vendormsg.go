@@ -0,0 +1,123 @@
+package messages
+
+import (
+	"../ipaddr"
+	"encoding/binary"
+	"fmt"
+)
+
+// Vendors and selectors of the vendor messages understood by goteller
+const VENDOR_BEAR string = "BEAR"
+const BEAR_QUERY_STATUS_REQUEST uint16 = 11  // Asks a leaf how many results it has kept for a query
+const BEAR_QUERY_STATUS_RESPONSE uint16 = 12 // The leaf's answer, with Data holding the count
+const QUERY_STATUS_STOP uint16 = 0xFFFF      // Count meaning the leaf wants no more results
+const VENDOR_LIME string = "LIME"
+const LIME_ACK uint16 = 11                // Claims out of band hits, with Data holding the number wanted
+const LIME_REPLY_NUMBER uint16 = 12       // Offers out of band hits, with Data holding their number
+const LIME_PUSH_PROXY_REQUEST uint16 = 21 // Asks an ultrapeer to be the push proxy of the leaf whose servant ID is the DescID
+const LIME_PUSH_PROXY_ACK uint16 = 22     // The ultrapeer's acceptance, with Data holding its address
+
+// A vendor specific message. Its header's DescID is that of the query it is
+// about, for those that are.
+type VendorMsg struct {
+	Vendor   string // 4 bytes
+	Selector uint16
+	Version  uint16
+	Data     []byte
+}
+
+func parseVendorBytes(buffer []byte, vendor *VendorMsg) error {
+	if len(buffer) < 8 {
+		return fmt.Errorf("Expected buffer of length >= 8. Got buffer of length %d", len(buffer))
+	}
+	vendor.Vendor = string(buffer[:4])
+	vendor.Selector = binary.LittleEndian.Uint16(buffer[4:6])
+	vendor.Version = binary.LittleEndian.Uint16(buffer[6:8])
+	vendor.Data = append([]byte(nil), buffer[8:]...)
+	return nil
+}
+
+func ParseVendorBytes(buffer []byte) (*VendorMsg, error) {
+	vendor := new(VendorMsg)
+	err := parseVendorBytes(buffer, vendor)
+	return vendor, err
+}
+
+func (vendor *VendorMsg) ParseBytes(buffer []byte) error {
+	return parseVendorBytes(buffer, vendor)
+}
+
+func (vendor *VendorMsg) ToBytes() []byte {
+	buffer := make([]byte, 8)
+	copy(buffer[:4], vendor.Vendor)
+	binary.LittleEndian.PutUint16(buffer[4:6], vendor.Selector)
+	binary.LittleEndian.PutUint16(buffer[6:8], vendor.Version)
+	return append(buffer, vendor.Data...)
+}
+
+// True if the message is the given vendor's message with the given selector
+func (vendor *VendorMsg) Is(vendorID string, selector uint16) bool {
+	return vendor.Vendor == vendorID && vendor.Selector == selector
+}
+
+// Returns a BEAR/12 message reporting the number of results a leaf has kept
+func QueryStatusResponse(numResults uint16) VendorMsg {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, numResults)
+	return VendorMsg{Vendor: VENDOR_BEAR, Selector: BEAR_QUERY_STATUS_RESPONSE, Version: 1, Data: data}
+}
+
+// Returns the number of results reported by a BEAR/12 message
+func (vendor *VendorMsg) QueryStatus() (uint16, error) {
+	if !vendor.Is(VENDOR_BEAR, BEAR_QUERY_STATUS_RESPONSE) || len(vendor.Data) < 2 {
+		return 0, fmt.Errorf("Not a BEAR/12 query status response")
+	}
+	return binary.LittleEndian.Uint16(vendor.Data[:2]), nil
+}
+
+// Returns a LIME/12 message offering numResults out of band hits
+func ReplyNumber(numResults byte, canReceiveUnsolicited bool) VendorMsg {
+	data := []byte{numResults, 0}
+	if canReceiveUnsolicited {
+		data[1] = 1
+	}
+	return VendorMsg{Vendor: VENDOR_LIME, Selector: LIME_REPLY_NUMBER, Version: 2, Data: data}
+}
+
+// Returns the number of hits offered by a LIME/12 message
+func (vendor *VendorMsg) ReplyNumber() (byte, error) {
+	if !vendor.Is(VENDOR_LIME, LIME_REPLY_NUMBER) || len(vendor.Data) < 1 {
+		return 0, fmt.Errorf("Not a LIME/12 reply number message")
+	}
+	return vendor.Data[0], nil
+}
+
+// Returns a LIME/11 message claiming numResults out of band hits
+func LimeAck(numResults byte) VendorMsg {
+	return VendorMsg{Vendor: VENDOR_LIME, Selector: LIME_ACK, Version: 2, Data: []byte{numResults}}
+}
+
+// Returns the number of hits claimed by a LIME/11 message
+func (vendor *VendorMsg) LimeAck() (byte, error) {
+	if !vendor.Is(VENDOR_LIME, LIME_ACK) || len(vendor.Data) < 1 {
+		return 0, fmt.Errorf("Not a LIME/11 ack message")
+	}
+	return vendor.Data[0], nil
+}
+
+// Returns a LIME/22 message accepting to be a push proxy at addr
+func PushProxyAck(addr ipaddr.IPAddr) VendorMsg {
+	return VendorMsg{Vendor: VENDOR_LIME, Selector: LIME_PUSH_PROXY_ACK, Version: 2, Data: PackIPPorts([]ipaddr.IPAddr{addr})}
+}
+
+// Returns the address of the push proxy given by a LIME/22 message
+func (vendor *VendorMsg) PushProxyAddr() (ipaddr.IPAddr, error) {
+	if !vendor.Is(VENDOR_LIME, LIME_PUSH_PROXY_ACK) || len(vendor.Data) < 6 {
+		return ipaddr.IPAddr{}, fmt.Errorf("Not a LIME/22 push proxy ack message")
+	}
+	addrs, err := UnpackIPPorts(vendor.Data[:6])
+	if err != nil {
+		return ipaddr.IPAddr{}, err
+	}
+	return addrs[0], nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"../goteller"
+	"./fixtures"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const FILE_SIZE int = 192 * 1024
+const RATE int64 = 64 * 1024
+
+var contents = bytes.Repeat([]byte("0123456789abcdef"), FILE_SIZE/16)
+
+func startTeller(id string, port uint16, neighbors []string) *goteller.GoTeller {
+	teller := fixtures.NewTeller(id)
+	fixtures.ServeBytes(teller, contents)
+	return fixtures.Start(teller, port, neighbors)
+}
+
+// Returns how long fetching the file from the uploader takes
+func timeUpload() time.Duration {
+	start := time.Now()
+	res, err := http.Get("http://" + fixtures.LocalAddr(5770) + "/get/1/file.txt")
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !bytes.Equal(body, contents) {
+		fmt.Printf("Got %d bytes... expected %d\n", len(body), len(contents))
+	}
+	return time.Since(start)
+}
+
+// Buckets start with a second's worth of bytes, so the rest of the file takes
+// (size - rate) / rate seconds
+func expectedTime(rate int64) time.Duration {
+	return time.Duration(int64(FILE_SIZE)-rate) * time.Second / time.Duration(rate)
+}
+
+// True if took is close to expected
+func near(took time.Duration, expected time.Duration) bool {
+	return took >= expected*3/4 && took <= expected*3/2+200*time.Millisecond
+}
+
+func TestBandwidthLimits() {
+	var teller goteller.GoTeller
+	teller.SetBandwidthLimit(goteller.TRAFFIC_PROTOCOL, 100)
+	teller.SetPeerBandwidthLimit(goteller.TRAFFIC_PROTOCOL, 10)
+	teller.SetBandwidthLimit(goteller.TrafficClass(-1), 5)
+	total, peer := teller.BandwidthLimit(goteller.TRAFFIC_PROTOCOL)
+	ok := total == 100 && peer == 10
+	total, peer = teller.BandwidthLimit(goteller.TRAFFIC_UPLOAD)
+	ok = ok && total == 0 && peer == 0
+	ok = ok && goteller.TRAFFIC_DOWNLOAD.String() == "Download" && goteller.TrafficClass(7).String() == "Unknown"
+	fmt.Printf("Bandwidth limits: %t\n", ok)
+}
+
+// Total and per servant limits slow uploads down to their rate, and removing
+// them lets uploads go at full speed again
+func TestUploadLimits() {
+	uploader := startTeller("uploader", 5770, []string{fixtures.LocalAddr(5771)})
+	ok := true
+	if took := timeUpload(); took > expectedTime(RATE)/2 {
+		fmt.Printf("Unlimited upload took %v\n", took)
+		ok = false
+	}
+	uploader.SetBandwidthLimit(goteller.TRAFFIC_UPLOAD, RATE)
+	if took := timeUpload(); !near(took, expectedTime(RATE)) {
+		fmt.Printf("Limited upload took %v... expected %v\n", took, expectedTime(RATE))
+		ok = false
+	}
+
+	// The lower of the two limits applies
+	uploader.SetPeerBandwidthLimit(goteller.TRAFFIC_UPLOAD, RATE/2)
+	time.Sleep(time.Second) // Refill the total bucket
+	if took := timeUpload(); !near(took, expectedTime(RATE/2)) {
+		fmt.Printf("Upload limited per servant took %v... expected %v\n", took, expectedTime(RATE/2))
+		ok = false
+	}
+
+	uploader.SetBandwidthLimit(goteller.TRAFFIC_UPLOAD, 0)
+	uploader.SetPeerBandwidthLimit(goteller.TRAFFIC_UPLOAD, 0)
+	if took := timeUpload(); took > expectedTime(RATE)/2 {
+		fmt.Printf("Upload after removing the limits took %v\n", took)
+		ok = false
+	}
+	fmt.Printf("Upload limits: %t\n", ok)
+}
+
+// Downloads are limited by the downloader's own download limit
+func TestDownloadLimits() {
+	downloader := startTeller("downloader", 5771, []string{fixtures.LocalAddr(5770)})
+	dir, err := ioutil.TempDir("", "bandwidthtests")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	downloader.SetBandwidthLimit(goteller.TRAFFIC_DOWNLOAD, RATE)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	path := filepath.Join(dir, "file.txt")
+	start := time.Now()
+	_, err = downloader.Download(ctx, goteller.DownloadRequest{Addr: fixtures.LocalAddr(5770), FileIndex: 1, Filename: "file.txt", Path: path})
+	took := time.Since(start)
+	written, _ := ioutil.ReadFile(path)
+	ok := err == nil && bytes.Equal(written, contents) && near(took, expectedTime(RATE))
+	if !ok {
+		fmt.Printf("Limited download took %v... expected %v (%v)\n", took, expectedTime(RATE), err)
+	}
+	fmt.Printf("Download limits: %t\n", ok)
+}
+
+func main() {
+	TestBandwidthLimits()
+	TestUploadLimits()
+	TestDownloadLimits()
+}
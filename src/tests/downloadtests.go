@@ -0,0 +1,134 @@
+package main
+
+import (
+	"../goteller"
+	"../messages"
+	"./fixtures"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var contents = bytes.Repeat([]byte("download "), 1000)
+
+func startTellers() *goteller.GoTeller {
+	sharer := fixtures.NewTeller("sharer")
+	sharer.OnRequest(func(fileIndex uint32, filename string) (io.ReadCloser, int64) {
+		if filename != "file.txt" {
+			return nil, -1
+		}
+		return ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents))
+	})
+	fixtures.Start(sharer, 5730, []string{fixtures.LocalAddr(5731)})
+	return fixtures.Start(fixtures.NewTeller("downloader"), 5731, []string{fixtures.LocalAddr(5730)})
+}
+
+// The file is written to the Writer, with progress reported along the way
+func TestDownloadToWriter(downloader *goteller.GoTeller) {
+	var buffer bytes.Buffer
+	var written, total int64
+	calls := 0
+	result, err := downloader.Download(context.Background(), goteller.DownloadRequest{
+		Addr:      fixtures.LocalAddr(5730),
+		FileIndex: 1,
+		Filename:  "file.txt",
+		Writer:    &buffer,
+		OnProgress: func(w int64, t int64) {
+			written, total = w, t
+			calls++
+		},
+	})
+	size := int64(len(contents))
+	ok := err == nil && bytes.Equal(buffer.Bytes(), contents)
+	ok = ok && result.StatusCode == http.StatusOK && result.Size == size && result.BytesWritten == size && result.Offset == 0
+	ok = ok && result.Filename == "file.txt" && result.FileIndex == 1 && result.Addr.String() == fixtures.LocalAddr(5730)
+	ok = ok && calls > 0 && written == size && total == size
+	if !ok {
+		fmt.Printf("Download to writer: %v %+v, %d progress calls ending at %d/%d\n", err, result, calls, written, total)
+	}
+	fmt.Printf("Download to writer: %t\n", ok)
+}
+
+// The file is created at Path, and checked against the URN if one is given
+func TestDownloadToPath(downloader *goteller.GoTeller) {
+	dir, err := ioutil.TempDir("", "downloadtests")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sum := sha1.Sum(contents)
+	urn := messages.SHA1URN(sum[:])
+	path := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(path, []byte("Truncated by the download"), 0644)
+	result, err := downloader.Download(context.Background(), goteller.DownloadRequest{
+		Addr:      fixtures.LocalAddr(5730),
+		FileIndex: 1,
+		Filename:  "file.txt",
+		URN:       urn,
+		Path:      path,
+	})
+	written, _ := ioutil.ReadFile(path)
+	ok := err == nil && result.URN == urn && bytes.Equal(written, contents)
+	if !ok {
+		fmt.Printf("Download to path: %v %+v\n", err, result)
+	}
+
+	sum[0]++
+	_, err = downloader.Download(context.Background(), goteller.DownloadRequest{
+		Addr:      fixtures.LocalAddr(5730),
+		FileIndex: 1,
+		Filename:  "file.txt",
+		URN:       messages.SHA1URN(sum[:]),
+		Writer:    ioutil.Discard,
+	})
+	if err == nil {
+		fmt.Println("Download with the wrong URN succeeded")
+		ok = false
+	}
+	fmt.Printf("Download to path: %t\n", ok)
+}
+
+// Failures come back as errors, with the servant's response if there was one
+func TestDownloadErrors(downloader *goteller.GoTeller) {
+	result, err := downloader.Download(context.Background(), goteller.DownloadRequest{
+		Addr:      fixtures.LocalAddr(5730),
+		FileIndex: 2,
+		Filename:  "missing.txt",
+		Writer:    ioutil.Discard,
+	})
+	ok := err != nil && result != nil && result.StatusCode == http.StatusNotFound
+	if !ok {
+		fmt.Printf("Missing file: %v %+v\n", err, result)
+	}
+
+	result, err = downloader.Download(context.Background(), goteller.DownloadRequest{Addr: fixtures.LocalAddr(5730), FileIndex: 1, Filename: "file.txt"})
+	if err == nil || result != nil {
+		fmt.Println("Download without a destination succeeded")
+		ok = false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err = downloader.Download(ctx, goteller.DownloadRequest{Addr: fixtures.LocalAddr(5730), FileIndex: 1, Filename: "file.txt", Writer: ioutil.Discard})
+	if err == nil || time.Since(start) > time.Second {
+		fmt.Printf("Cancelled download: %v after %v\n", err, time.Since(start))
+		ok = false
+	}
+	fmt.Printf("Download errors: %t\n", ok)
+}
+
+func main() {
+	downloader := startTellers()
+	TestDownloadToWriter(downloader)
+	TestDownloadToPath(downloader)
+	TestDownloadErrors(downloader)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"../messages"
+	"bytes"
+	"fmt"
+)
+
+func hitWithTrailer(trailer *messages.QHDTrailer) messages.QueryHitMsg {
+	queryHit := messages.QueryHitMsg{NumHits: 1, Speed: 20, Trailer: trailer}
+	copy(queryHit.ServantID[:], []byte("sourabhdesai1993"))
+	queryHit.ResultSet = []messages.HitResult{{FileIndex: 1, FileSize: 5, Filename: "hi.txt"}}
+	return queryHit
+}
+
+// The open data's first byte holds the enable bits and the second the values,
+// except for the push flag whose bits are the other way around
+func TestFlagEncoding() {
+	trailer := messages.QHDTrailer{VendorCode: "GTLA"}
+	trailer.SetFlag(messages.EQHD_PUSH_FLAG, true)
+	trailer.SetFlag(messages.EQHD_BUSY_FLAG, false)
+	trailer.SetFlag(messages.EQHD_UPLOADED_FLAG, true)
+	buffer := trailer.ToBytes()
+	expected := []byte{'G', 'T', 'L', 'A', messages.EQHD_OPEN_DATA_LEN,
+		messages.EQHD_BUSY_FLAG | messages.EQHD_UPLOADED_FLAG | messages.EQHD_PUSH_FLAG, // Enablers, and the push value
+		messages.EQHD_UPLOADED_FLAG | messages.EQHD_PUSH_FLAG,                           // Values, and the push enabler
+	}
+	if !bytes.Equal(buffer, expected) {
+		fmt.Printf("Wrong EQHD bytes %x... expected %x\n", buffer, expected)
+	}
+	fmt.Printf("Flag encoding: %t\n", bytes.Equal(buffer, expected))
+}
+
+func TestFlagRoundTrip() {
+	trailer := messages.QHDTrailer{VendorCode: "GTLA", PrivateData: []byte{0x01, 0x02}}
+	trailer.SetFlag(messages.EQHD_PUSH_FLAG, false)
+	trailer.SetFlag(messages.EQHD_BUSY_FLAG, true)
+	trailer.SetFlag(messages.EQHD_SPEED_FLAG, true)
+	queryHit := hitWithTrailer(&trailer)
+	parsed, err := messages.ParseQueryHitBytes(queryHit.ToBytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ok := parsed.Trailer != nil && parsed.Trailer.VendorCode == "GTLA" && bytes.Equal(parsed.Trailer.PrivateData, []byte{0x01, 0x02})
+	for _, c := range []struct {
+		flag  byte
+		value bool
+		known bool
+	}{
+		{messages.EQHD_PUSH_FLAG, false, true},
+		{messages.EQHD_BUSY_FLAG, true, true},
+		{messages.EQHD_SPEED_FLAG, true, true},
+		{messages.EQHD_UPLOADED_FLAG, false, false},
+	} {
+		if !ok {
+			break
+		}
+		value, known := parsed.Trailer.Flag(c.flag)
+		if value != c.value || known != c.known {
+			fmt.Printf("Flag %#x is %t (known %t)... expected %t (known %t)\n", c.flag, value, known, c.value, c.known)
+			ok = false
+		}
+	}
+	fmt.Printf("Flag round trip: %t\n", ok)
+}
+
+// The GGEP flag is set whenever there is a GGEP block, which follows the
+// private data
+func TestGGEPFlag() {
+	trailer := messages.QHDTrailer{VendorCode: "GTLA", PrivateData: []byte("vendor")}
+	trailer.GGEP.Set(messages.GGEP_TLS_ID, nil)
+	queryHit := hitWithTrailer(&trailer)
+	parsed, err := messages.ParseQueryHitBytes(queryHit.ToBytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	hasGGEP, known := parsed.Trailer.Flag(messages.EQHD_GGEP_FLAG)
+	ok := hasGGEP && known && parsed.Trailer.GGEP.Has(messages.GGEP_TLS_ID) && string(parsed.Trailer.PrivateData) == "vendor"
+
+	// Without extensions the flag is known to be unset, even if it was set by hand
+	trailer = messages.QHDTrailer{VendorCode: "GTLA"}
+	trailer.SetFlag(messages.EQHD_GGEP_FLAG, true)
+	queryHit = hitWithTrailer(&trailer)
+	parsed, err = messages.ParseQueryHitBytes(queryHit.ToBytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	hasGGEP, _ = parsed.Trailer.Flag(messages.EQHD_GGEP_FLAG)
+	ok = ok && !hasGGEP && len(parsed.Trailer.GGEP) == 0
+	fmt.Printf("GGEP flag: %t\n", ok)
+}
+
+// A hit whose trailer is only a vendor code, and one without a trailer
+func TestShortTrailers() {
+	short := hitWithTrailer(nil)
+	parsed, err := messages.ParseQueryHitBytes(hitBytesWithTrailer([]byte("GTLA")))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	_, known := parsed.Trailer.Flag(messages.EQHD_PUSH_FLAG)
+	ok := parsed.Trailer.VendorCode == "GTLA" && !known
+
+	parsed, err = messages.ParseQueryHitBytes(short.ToBytes())
+	ok = ok && err == nil && parsed.Trailer == nil
+	fmt.Printf("Short trailers: %t\n", ok)
+}
+
+// Puts a trailer's bytes between a hit's result set and its servant ID
+func hitBytesWithTrailer(trailer []byte) []byte {
+	short := hitWithTrailer(nil)
+	buffer := short.ToBytes()
+	return append(append(append([]byte(nil), buffer[:len(buffer)-16]...), trailer...), buffer[len(buffer)-16:]...)
+}
+
+// Received trailers are sent on exactly as they came, whatever the length of
+// their open data
+func TestTrailerRoundTrip() {
+	ggep := messages.GGEP{{ID: messages.GGEP_TLS_ID}}.ToBytes()
+	ok := true
+	for name, trailer := range map[string][]byte{
+		"4 byte":               []byte("GTLA"),
+		"1 byte":               []byte("G"),
+		"3 byte":               []byte("GTL"),
+		"empty open data":      []byte("GTLA\x00"),
+		"1 byte open data":     []byte("GTLA\x01\x1c"),
+		"3 byte open data":     []byte("GTLA\x03\x1c\x15\x7fprivate"),
+		"unusual push bits":    []byte("GTLA\x02\x01\x00"),
+		"open data and GGEP":   append([]byte("GTLA\x02\x3c\x34private"), ggep...),
+		"unknown enabler bits": []byte("GTLA\x02\xc0\x40"),
+	} {
+		buffer := hitBytesWithTrailer(trailer)
+		parsed, err := messages.ParseQueryHitBytes(buffer)
+		if err != nil {
+			fmt.Printf("%s trailer: %v\n", name, err)
+			ok = false
+			continue
+		}
+		if encoded := parsed.ToBytes(); !bytes.Equal(encoded, buffer) {
+			fmt.Printf("%s trailer was sent as %x... expected %x\n", name, encoded, buffer)
+			ok = false
+		}
+	}
+
+	// Changing a flag rewrites the flag bytes but keeps the rest of the open data
+	parsed, err := messages.ParseQueryHitBytes(hitBytesWithTrailer([]byte("GTLA\x03\x1c\x15\x7f")))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	parsed.Trailer.SetFlag(messages.EQHD_BUSY_FLAG, true)
+	expected := hitBytesWithTrailer([]byte("GTLA\x03\x1c\x15\x7f"))
+	expected[len(expected)-16-2] |= messages.EQHD_BUSY_FLAG
+	if encoded := parsed.ToBytes(); !bytes.Equal(encoded, expected) {
+		fmt.Printf("Changed trailer was sent as %x... expected %x\n", encoded, expected)
+		ok = false
+	}
+
+	// A bare vendor code given a flag gets open data
+	parsed, _ = messages.ParseQueryHitBytes(hitBytesWithTrailer([]byte("GTLA")))
+	parsed.Trailer.SetFlag(messages.EQHD_PUSH_FLAG, true)
+	reparsed, err := messages.ParseQueryHitBytes(parsed.ToBytes())
+	if push, known := reparsed.Trailer.Flag(messages.EQHD_PUSH_FLAG); err != nil || !push || !known {
+		fmt.Printf("Flag added to a bare vendor code was lost: %v\n", err)
+		ok = false
+	}
+	fmt.Printf("Trailer round trip: %t\n", ok)
+}
+
+func main() {
+	TestFlagEncoding()
+	TestFlagRoundTrip()
+	TestGGEPFlag()
+	TestShortTrailers()
+	TestTrailerRoundTrip()
+}
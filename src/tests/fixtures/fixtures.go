@@ -0,0 +1,76 @@
+// Helpers shared by the test programs in src/tests
+package fixtures
+
+import (
+	"../../goteller"
+	"../../ipaddr"
+	"../../messages"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Returns the address a teller started at port listens on, which is the one
+// SetToLocalIP picks
+func LocalAddr(port uint16) string {
+	var addr ipaddr.IPAddr
+	if err := addr.SetToLocalIP(); err != nil {
+		panic(err)
+	}
+	addr.Port = port
+	return addr.String()
+}
+
+func MustAddr(str string) ipaddr.IPAddr {
+	addr, err := ipaddr.ParseAddrString(str)
+	if err != nil {
+		panic(err)
+	}
+	return *addr
+}
+
+// Returns a teller that shares nothing and pings often. Debug output goes to
+// stderr if DEBUG is set.
+func NewTeller(id string) *goteller.GoTeller {
+	teller := &goteller.GoTeller{PingInterval: 200 * time.Millisecond}
+	teller.SetServantID(id)
+	if os.Getenv("DEBUG") != "" {
+		teller.SetDebugFile(os.Stderr)
+	}
+	teller.OnQuery(func(string) []messages.HitResult { return nil })
+	teller.OnRequest(func(uint32, string) (io.ReadCloser, int64) { return nil, -1 })
+	return teller
+}
+
+// Answers every request for a file with contents
+func ServeBytes(teller *goteller.GoTeller, contents []byte) {
+	teller.OnRequest(func(uint32, string) (io.ReadCloser, int64) {
+		return ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents))
+	})
+}
+
+// Starts a teller at port and waits for it to listen. Neighbors don't have to
+// be running.
+func Start(teller *goteller.GoTeller, port uint16, neighbors []string) *goteller.GoTeller {
+	teller.SetInitNeighbors(neighbors)
+	if err := teller.StartAtPort(port); err != nil {
+		panic(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	return teller
+}
+
+// An in memory io.WriterAt
+type WriterAt struct {
+	Data []byte
+}
+
+func (w *WriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(w.Data) {
+		w.Data = append(w.Data, make([]byte, end-len(w.Data))...)
+	}
+	copy(w.Data[off:], p)
+	return len(p), nil
+}
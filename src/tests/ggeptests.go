@@ -0,0 +1,141 @@
+package main
+
+import (
+	"../messages"
+	"bytes"
+	"fmt"
+)
+
+// Data with runs of nulls and a run longer than a COBS block of 254 bytes
+func nullyData() []byte {
+	data := []byte{0x00, 0x01, 0x00, 0x00, 0x02}
+	for i := 0; i < 600; i++ {
+		data = append(data, byte(i%255)+1)
+	}
+	return append(data, 0x00)
+}
+
+func roundTrip(ggep messages.GGEP) (messages.GGEP, bool) {
+	encoded := ggep.ToBytes()
+	decoded, n, err := messages.ParseGGEP(encoded)
+	if err != nil {
+		fmt.Println(err)
+		return nil, false
+	}
+	if n != len(encoded) {
+		fmt.Printf("Parsed %d bytes of a %d byte block\n", n, len(encoded))
+		return decoded, false
+	}
+	return decoded, true
+}
+
+func TestCOBSRoundTrip() {
+	data := nullyData()
+	ggep := messages.GGEP{{ID: "NUL", Data: data, COBS: true}}
+	encoded := ggep.ToBytes()
+	// Magic, flags, "NUL" and length bytes come before the data
+	if idx := bytes.IndexByte(encoded[1:], 0x00); idx != -1 {
+		fmt.Printf("COBS encoded block has a null byte at %d\n", idx+1)
+	}
+	decoded, ok := roundTrip(ggep)
+	ok = ok && len(decoded) == 1 && bytes.Equal(decoded[0].Data, data) && decoded[0].COBS
+	fmt.Printf("COBS: %t\n", ok)
+}
+
+func TestDeflateRoundTrip() {
+	data := bytes.Repeat([]byte("compressible "), 200)
+	ggep := messages.GGEP{
+		{ID: "Z", Data: data, Deflate: true},
+		{ID: "ZC", Data: nullyData(), Deflate: true, COBS: true},
+	}
+	if len(ggep.ToBytes()) >= len(data) {
+		fmt.Printf("Deflated block is %d bytes for %d bytes of data\n", len(ggep.ToBytes()), len(data))
+	}
+	decoded, ok := roundTrip(ggep)
+	ok = ok && len(decoded) == 2 && bytes.Equal(decoded[0].Data, data) && bytes.Equal(decoded[1].Data, nullyData())
+	fmt.Printf("Deflate: %t\n", ok)
+}
+
+func TestDataLengths() {
+	ok := true
+	// Lengths around the one, two and three byte encodings
+	for _, length := range []int{0, 1, 63, 64, 4095, 4096, 70000} {
+		ggep := messages.GGEP{{ID: "LEN", Data: bytes.Repeat([]byte{0xAB}, length)}, {ID: "NEXT", Data: []byte("x")}}
+		decoded, rtOk := roundTrip(ggep)
+		if !rtOk || len(decoded) != 2 || !bytes.Equal(decoded[0].Data, ggep[0].Data) || string(decoded[1].Data) != "x" {
+			fmt.Printf("Wrong round trip of %d bytes of data\n", length)
+			ok = false
+		}
+	}
+	fmt.Printf("Lengths: %t\n", ok)
+}
+
+func TestSetGetRemove() {
+	var ggep messages.GGEP
+	ggep.Set("A", []byte("1"))
+	ggep.Set("B", []byte("2"))
+	ggep.Set("A", []byte("3")) // Replaces the first
+	data, ok := ggep.Get("A")
+	ok = ok && string(data) == "3" && len(ggep) == 2
+	ggep.Remove("A")
+	ok = ok && !ggep.Has("A") && ggep.Has("B")
+	if err := ggep.Set("", nil); err == nil {
+		fmt.Println("Empty ID was accepted")
+		ok = false
+	}
+	if err := ggep.Set("SIXTEENCHARSLONG", nil); err == nil {
+		fmt.Println("16 byte ID was accepted")
+		ok = false
+	}
+	fmt.Printf("Set/Get/Remove: %t\n", ok)
+}
+
+func TestMalformedBlocks() {
+	ok := true
+	for _, buffer := range [][]byte{
+		{},
+		{0x00},                // No magic
+		{messages.GGEP_MAGIC}, // No extension
+		{messages.GGEP_MAGIC, 0x81, 'A', 0x85, 'x'},        // Data shorter than its length
+		{messages.GGEP_MAGIC, 0x91, 'A', 0x80},             // Reserved bit
+		{messages.GGEP_MAGIC, 0x01, 'A', 0x80},             // Not flagged last, and nothing follows
+		{messages.GGEP_MAGIC, 0xC1, 'A', 0x82, 0x00, 0x01}, // Bad COBS
+	} {
+		if _, _, err := messages.ParseGGEP(buffer); err == nil {
+			fmt.Printf("Malformed block %x was parsed\n", buffer)
+			ok = false
+		}
+	}
+	fmt.Printf("Malformed: %t\n", ok)
+}
+
+// GGEP on a query hit result must not contain nulls, so it's COBS encoded
+// whenever needed. Results stay comparable with their extensions.
+func TestHitResultGGEP() {
+	queryHit := messages.QueryHitMsg{NumHits: 1, Speed: 20}
+	copy(queryHit.ServantID[:], []byte("sourabhdesai1993"))
+	hit := messages.HitResult{FileIndex: 1, FileSize: 5, Filename: "hi.txt", URN: "urn:sha1:PLSTHIPQGSSZTS5FJUPAKUZWUGYQYPFB"}
+	hit.SetGGEP(messages.GGEP{{ID: "NUL", Data: nullyData()}})
+	queryHit.ResultSet = []messages.HitResult{hit}
+	parsed, err := messages.ParseQueryHitBytes(queryHit.ToBytes())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	result := parsed.ResultSet[0]
+	data, _ := result.GetGGEP().Get("NUL")
+	ok := result == hit && bytes.Equal(data, nullyData())
+
+	hit.SetGGEP(nil)
+	ok = ok && hit.GGEPBlock == "" && hit.GetGGEP() == nil && result != hit
+	fmt.Printf("Hit result GGEP: %t\n", ok)
+}
+
+func main() {
+	TestCOBSRoundTrip()
+	TestDeflateRoundTrip()
+	TestDataLengths()
+	TestSetGetRemove()
+	TestMalformedBlocks()
+	TestHitResultGGEP()
+}
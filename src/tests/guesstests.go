@@ -0,0 +1,31 @@
+package main
+
+import (
+	"../messages"
+	"./fixtures"
+	"bytes"
+	"fmt"
+)
+
+// Query keys are only valid for the address they were issued to
+func TestQueryKey() {
+	secret := []byte("query key secret")
+	key := messages.QueryKey(secret, fixtures.MustAddr("10.0.0.1:6346"))
+	ok := len(key) == messages.QUERY_KEY_LEN
+	ok = ok && bytes.Equal(key, messages.QueryKey(secret, fixtures.MustAddr("10.0.0.1:6346")))
+	for _, other := range [][]byte{
+		messages.QueryKey(secret, fixtures.MustAddr("10.0.0.2:6346")),
+		messages.QueryKey(secret, fixtures.MustAddr("10.0.0.1:6347")),
+		messages.QueryKey([]byte("other secret"), fixtures.MustAddr("10.0.0.1:6346")),
+	} {
+		if bytes.Equal(key, other) {
+			fmt.Printf("Query key %x was issued twice\n", key)
+			ok = false
+		}
+	}
+	fmt.Printf("QueryKey: %t\n", ok)
+}
+
+func main() {
+	TestQueryKey()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"../goteller"
+	"./fixtures"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+func allowed(filter *goteller.IPFilter, ip string) bool {
+	return filter.Allowed(fixtures.MustAddr(ip + ":6346"))
+}
+
+func checkAllowed(filter *goteller.IPFilter, expected map[string]bool) bool {
+	ok := true
+	for ip, allow := range expected {
+		if allowed(filter, ip) != allow {
+			fmt.Printf("%s allowed: %t... expected %t\n", ip, !allow, allow)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// CIDR ranges, address ranges and single addresses, up to their edges
+func TestRangeSpecs() {
+	var filter goteller.IPFilter
+	ok := allowed(&filter, "10.0.0.1") // The zero value allows everything
+	for _, spec := range []string{"10.0.0.0/8", " 192.168.1.10-192.168.1.20 ", "172.16.0.1", "0.0.0.0/32"} {
+		if err := filter.Deny(spec); err != nil {
+			fmt.Println(err)
+			ok = false
+		}
+	}
+	ok = checkAllowed(&filter, map[string]bool{
+		"9.255.255.255":  true,
+		"10.0.0.0":       false,
+		"10.255.255.255": false,
+		"11.0.0.0":       true,
+		"192.168.1.9":    true,
+		"192.168.1.10":   false,
+		"192.168.1.20":   false,
+		"192.168.1.21":   true,
+		"172.16.0.1":     false,
+		"172.16.0.2":     true,
+		"0.0.0.0":        false,
+		"0.0.0.1":        true,
+	}) && ok
+	for _, spec := range []string{"", "10.0.0.0/33", "10.0.0.0/x", "10.0.0.9-10.0.0.1", "256.0.0.1", "10.0.0", "hello"} {
+		if err := filter.Deny(spec); err == nil {
+			fmt.Printf("Bad range \"%s\" was accepted\n", spec)
+			ok = false
+		}
+	}
+	fmt.Printf("Range specs: %t\n", ok)
+}
+
+// Overlapping, adjacent and nested ranges, and allowed ranges inside denied ones
+func TestMergedRanges() {
+	var filter goteller.IPFilter
+	for _, spec := range []string{"1.0.0.10-1.0.0.20", "1.0.0.15-1.0.0.30", "1.0.0.31-1.0.0.40", "1.0.0.12-1.0.0.13", "1.0.0.50-1.0.0.60", "255.255.255.0/24", "255.255.255.255"} {
+		filter.Deny(spec)
+	}
+	filter.Allow("1.0.0.25")
+	filter.Allow("1.0.0.24-1.0.0.26")
+	ok := checkAllowed(&filter, map[string]bool{
+		"1.0.0.9":         true,
+		"1.0.0.10":        false,
+		"1.0.0.14":        false,
+		"1.0.0.23":        false,
+		"1.0.0.24":        true,
+		"1.0.0.26":        true,
+		"1.0.0.27":        false,
+		"1.0.0.31":        false,
+		"1.0.0.40":        false,
+		"1.0.0.41":        true,
+		"1.0.0.49":        true,
+		"1.0.0.55":        false,
+		"255.255.254.255": true,
+		"255.255.255.255": false,
+	})
+
+	// Everything not allowed is denied
+	filter.Clear()
+	filter.Deny("0.0.0.0/0")
+	filter.Allow("8.8.8.0/24")
+	ok = checkAllowed(&filter, map[string]bool{
+		"8.8.8.8":         true,
+		"8.8.9.0":         false,
+		"0.0.0.0":         false,
+		"255.255.255.255": false,
+	}) && ok
+	fmt.Printf("Merged ranges: %t\n", ok)
+}
+
+// ipfilter.dat and P2P lines, comments, and reloading a changed file
+func TestFilterFiles() {
+	file, err := ioutil.TempFile("", "ipfilter")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`# Comment
+// Also a comment
+
+001.002.003.000 - 001.002.003.255 , 000 , Blocked
+004.005.006.000 - 004.005.006.255 , 200 , Not blocked, level above 127
+Some, description:7.8.9.0-7.8.9.10
+11.0.0.0/16
+`)
+	file.Close()
+	var filter goteller.IPFilter
+	ok := true
+	if err := filter.LoadFile(file.Name(), false); err != nil {
+		fmt.Println(err)
+		ok = false
+	}
+	ok = checkAllowed(&filter, map[string]bool{
+		"1.2.3.4":  false,
+		"4.5.6.7":  true,
+		"7.8.9.10": false,
+		"7.8.9.11": true,
+		"11.0.1.1": false,
+		"11.1.0.0": true,
+		"12.0.0.1": true,
+	}) && ok
+
+	// Changes are picked up by Reload
+	time.Sleep(10 * time.Millisecond)
+	ioutil.WriteFile(file.Name(), []byte("4.5.6.7\n"), 0644)
+	os.Chtimes(file.Name(), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err := filter.Reload(); err != nil {
+		fmt.Println(err)
+		ok = false
+	}
+	ok = checkAllowed(&filter, map[string]bool{"1.2.3.4": true, "4.5.6.7": false}) && ok
+	filter.RemoveFile(file.Name())
+	ok = checkAllowed(&filter, map[string]bool{"4.5.6.7": true}) && ok
+	fmt.Printf("Filter files: %t\n", ok)
+}
+
+func main() {
+	TestRangeSpecs()
+	TestMergedRanges()
+	TestFilterFiles()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"../goteller"
+	"../ipaddr"
+	"../messages"
+	"./fixtures"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collects the results of a query
+type hitCollector struct {
+	mutex   sync.Mutex
+	results []goteller.QueryResult
+}
+
+func (collector *hitCollector) onHit(results []goteller.QueryResult, _ uint32, _ string) []goteller.QueryResult {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.results = append(collector.results, results...)
+	return nil
+}
+
+// Sends a query and returns the results that came back
+func search(querier *goteller.GoTeller, query string) []goteller.QueryResult {
+	collector := &hitCollector{}
+	q := goteller.Query{SearchQuery: query, TTL: 2}
+	q.OnHit(collector.onHit)
+	q.OnResponse(func(error, uint32, string, *http.Response) {})
+	querier.SendQuery(q)
+	time.Sleep(500 * time.Millisecond)
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	return append([]goteller.QueryResult(nil), collector.results...)
+}
+
+func filenames(results []goteller.QueryResult) []string {
+	var names []string
+	for _, result := range results {
+		names = append(names, result.GetFilename())
+	}
+	return names
+}
+
+// Whether the hits that reached the querier carried a signature, by the
+// filename of their first result
+var (
+	sigMutex sync.Mutex
+	hitSIGs  = make(map[string]bool)
+)
+
+// Starts a querier, a sharer, and between them a servant whose hit filter
+// drops the results with "dropped" in their name. Returns the querier.
+func startTellers() *goteller.GoTeller {
+	querier := fixtures.NewTeller("querier")
+	querier.AddHitFilter(func(header messages.DescHeader, queryHit *messages.QueryHitMsg, from ipaddr.IPAddr) bool {
+		sigMutex.Lock()
+		defer sigMutex.Unlock()
+		if len(queryHit.ResultSet) > 0 {
+			hitSIGs[queryHit.ResultSet[0].Filename] = queryHit.Trailer != nil && queryHit.Trailer.GGEP.Has(messages.GGEP_SIG_ID)
+		}
+		return true
+	})
+	fixtures.Start(querier, 5790, []string{fixtures.LocalAddr(5791)})
+	middle := fixtures.NewTeller("middle")
+	middle.AddHitFilter(func(header messages.DescHeader, queryHit *messages.QueryHitMsg, from ipaddr.IPAddr) bool {
+		var kept []messages.HitResult
+		for _, hit := range queryHit.ResultSet {
+			if !strings.Contains(hit.Filename, "dropped") {
+				kept = append(kept, hit)
+			}
+		}
+		queryHit.ResultSet = kept
+		return true
+	})
+	fixtures.Start(middle, 5791, []string{fixtures.LocalAddr(5790), fixtures.LocalAddr(5792)})
+	sharer := fixtures.NewTeller("sharer")
+	sharer.OnQuery(func(query string) []messages.HitResult {
+		results := []messages.HitResult{{FileIndex: 1, FileSize: 5, Filename: query + " kept.txt"}}
+		if query != "untouched" {
+			results = append(results, messages.HitResult{FileIndex: 2, FileSize: 5, Filename: query + " with a long name that is dropped.txt"})
+		}
+		return results
+	})
+	fixtures.Start(sharer, 5792, []string{fixtures.LocalAddr(5791)})
+	time.Sleep(time.Second)
+	return querier
+}
+
+// A hit that a filter on the middle servant shortens is forwarded with the
+// length of the hit as sent, so the link to the querier stays in step and
+// carries later hits and pings
+func TestForwardedHitLength(querier *goteller.GoTeller) {
+	ok := true
+	for _, query := range []string{"first", "second", "third"} {
+		names := filenames(search(querier, query))
+		if expected := []string{query + " kept.txt"}; fmt.Sprint(names) != fmt.Sprint(expected) {
+			fmt.Printf("Query \"%s\" got %q... expected %q\n", query, names, expected)
+			ok = false
+		}
+	}
+	fmt.Printf("Forwarded hit length: %t\n", ok)
+}
+
+// Hits changed by a filter lose the signature they no longer match, and hits
+// the filters leave alone keep it
+func TestFilteredHitSignatures(querier *goteller.GoTeller) {
+	ok := true
+	for _, c := range []struct {
+		query  string
+		signed bool
+	}{
+		{"untouched", true},
+		{"filtered", false},
+		{"untouched", true},
+	} {
+		results := search(querier, c.query)
+		if len(results) != 1 {
+			fmt.Printf("Query \"%s\" got %q\n", c.query, filenames(results))
+			ok = false
+			continue
+		}
+		sigMutex.Lock()
+		hasSIG := hitSIGs[results[0].GetFilename()]
+		sigMutex.Unlock()
+		if hasSIG != c.signed {
+			fmt.Printf("Hit of \"%s\" carried a signature: %t... expected %t\n", c.query, hasSIG, c.signed)
+			ok = false
+		}
+		if _, signed := results[0].GetSigner(); signed != c.signed {
+			fmt.Printf("Result of \"%s\" signed: %t... expected %t\n", c.query, signed, c.signed)
+			ok = false
+		}
+	}
+	fmt.Printf("Filtered hit signatures: %t\n", ok)
+}
+
+func main() {
+	querier := startTellers()
+	TestForwardedHitLength(querier)
+	TestFilteredHitSignatures(querier)
+}
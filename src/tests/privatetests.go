@@ -0,0 +1,39 @@
+package main
+
+import (
+	"../messages"
+	"./fixtures"
+	"bytes"
+	"fmt"
+)
+
+// Tags cover the network key, descriptor ID, sender and payload
+func TestNetworkTag() {
+	key := []byte("network key")
+	var guid [16]byte
+	copy(guid[:], "0123456789abcdef")
+	addr := fixtures.MustAddr("10.0.0.1:6346")
+	payload := []byte("payload")
+	tag := messages.NetworkTag(key, guid, addr, payload)
+	ok := len(tag) == messages.NETWORK_TAG_LEN
+	ok = ok && bytes.Equal(tag, messages.NetworkTag(key, guid, addr, []byte("payload")))
+	otherGUID := guid
+	otherGUID[15]++
+	for name, other := range map[string][]byte{
+		"key":     messages.NetworkTag([]byte("other key"), guid, addr, payload),
+		"guid":    messages.NetworkTag(key, otherGUID, addr, payload),
+		"addr":    messages.NetworkTag(key, guid, fixtures.MustAddr("10.0.0.1:6347"), payload),
+		"payload": messages.NetworkTag(key, guid, addr, []byte("payloae")),
+		"empty":   messages.NetworkTag(key, guid, addr, nil),
+	} {
+		if bytes.Equal(tag, other) {
+			fmt.Printf("Tag doesn't change with the %s\n", name)
+			ok = false
+		}
+	}
+	fmt.Printf("NetworkTag: %t\n", ok)
+}
+
+func main() {
+	TestNetworkTag()
+}
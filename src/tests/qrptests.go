@@ -0,0 +1,179 @@
+package main
+
+import (
+	"../goteller"
+	"../messages"
+	"./fixtures"
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Hashes given in the QRP specification
+func TestQRPHash() {
+	ok := true
+	for _, c := range []struct {
+		keyword string
+		bits    uint
+		hash    uint32
+	}{
+		{"", 13, 0},
+		{"eb", 13, 6791},
+		{"ebc", 13, 7082},
+		{"ebck", 13, 6698},
+		{"ebckl", 13, 3179},
+		{"ebcklm", 13, 3235},
+		{"ebcklme", 13, 6438},
+		{"ebcklmen", 13, 1062},
+		{"ebcklmenq", 13, 3527},
+		{"", 16, 0},
+		{"n", 16, 65003},
+		{"nd", 16, 54193},
+		{"ndf", 16, 4953},
+		{"ndfl", 16, 58201},
+		{"ndfla", 16, 34830},
+		{"ndflal", 16, 36910},
+		{"ndflale", 16, 34586},
+		{"ndflalem", 16, 37658},
+		{"ndflaleme", 16, 45559},
+		{"7777a88a8a8a8", 10, 342},
+		{"3nja9", 10, 581},
+		{"3NJA9", 10, 581}, // Case insensitive
+	} {
+		if hash := messages.QRPHash(c.keyword, c.bits); hash != c.hash {
+			fmt.Printf("QRPHash(\"%s\", %d) was %d... expected %d\n", c.keyword, c.bits, hash, c.hash)
+			ok = false
+		}
+	}
+	fmt.Printf("QRPHash: %t\n", ok)
+}
+
+func TestQRPKeywords() {
+	keywords := messages.QRPKeywords("Hello, World_2.mp3")
+	expected := []string{"hello", "world", "2", "mp3"}
+	ok := fmt.Sprint(keywords) == fmt.Sprint(expected)
+	if !ok {
+		fmt.Printf("Keywords were %q... expected %q\n", keywords, expected)
+	}
+	fmt.Printf("QRPKeywords: %t\n", ok)
+}
+
+// A patch split into several PATCH messages is the same once put together
+func TestPatchMessages() {
+	patchData := make([]byte, 1<<12)
+	for i := range patchData {
+		patchData[i] = byte(i*31) ^ byte(i>>3) // Doesn't compress well
+	}
+	patches := messages.PatchMessages(patchData, 4, 512)
+	ok := len(patches) > 1
+	var data []byte
+	for i, patch := range patches {
+		parsed, err := messages.ParsePatchTableBytes(patch.ToBytes())
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+			break
+		}
+		if int(parsed.SeqNo) != i+1 || int(parsed.SeqSize) != len(patches) || parsed.EntryBits != 4 || parsed.Compressor != messages.QRP_COMPRESSOR_ZLIB {
+			fmt.Printf("Wrong PATCH %d/%d header: %+v\n", i+1, len(patches), parsed)
+			ok = false
+		}
+		data = append(data, parsed.Data...)
+	}
+	unpacked, err := messages.PatchData(data, messages.QRP_COMPRESSOR_ZLIB, len(patchData))
+	ok = ok && err == nil && bytes.Equal(unpacked, patchData)
+
+	// Data inflating to more than the table's size is refused
+	if _, err := messages.PatchData(data, messages.QRP_COMPRESSOR_ZLIB, len(patchData)-1); err == nil {
+		fmt.Println("PATCH larger than its table was accepted")
+		ok = false
+	}
+	reset, err := messages.ParseResetTableBytes((&messages.ResetTableMsg{TableLength: 1 << 16, Infinity: 7}).ToBytes())
+	ok = ok && err == nil && reset.TableLength == 1<<16 && reset.Infinity == 7
+	fmt.Printf("PATCH messages: %t\n", ok)
+}
+
+// Counts the queries a servant is asked
+type queryCounter struct {
+	mutex   sync.Mutex
+	queries map[string]int
+}
+
+func (counter *queryCounter) count(query string) []messages.HitResult {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.queries[query]++
+	return nil
+}
+
+func (counter *queryCounter) asked(query string) bool {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.queries[query] > 0
+}
+
+// A chain of servants. The query's last hop, from the middle servant to the
+// sharing one, is only taken if the route table the sharing servant patched
+// into the middle one's matches. Queries reach the sharing servant with their
+// TTL used up, which it answers without forwarding.
+func TestRouteTablePatches() {
+	querier := fixtures.Start(fixtures.NewTeller("querier"), 5740, []string{fixtures.LocalAddr(5741)})
+	fixtures.Start(fixtures.NewTeller("middle"), 5741, []string{fixtures.LocalAddr(5740), fixtures.LocalAddr(5742)})
+	counter := &queryCounter{queries: make(map[string]int)}
+	sharer := fixtures.NewTeller("sharer")
+	sharer.OnQuery(counter.count)
+	fixtures.Start(sharer, 5742, []string{fixtures.LocalAddr(5741)})
+	sharer.ShareFile(messages.HitResult{FileIndex: 1, FileSize: 5, Filename: "Hello World.txt"})
+
+	search := func(query string) bool {
+		q := goteller.Query{SearchQuery: query, TTL: 1}
+		q.OnHit(func([]goteller.QueryResult, uint32, string) []goteller.QueryResult { return nil })
+		q.OnResponse(func(error, uint32, string, *http.Response) {})
+		querier.SendQuery(q)
+		time.Sleep(500 * time.Millisecond)
+		return counter.asked(query)
+	}
+	time.Sleep(time.Second) // Route tables are sent every ping interval
+	ok := true
+	for _, c := range []struct {
+		query  string
+		routed bool
+	}{
+		{"hello", true},
+		{"WORLD hello", true},
+		{"goodbye", false},
+		{"hello goodbye", false},
+	} {
+		if search(c.query) != c.routed {
+			fmt.Printf("Query \"%s\" routed: %t... expected %t\n", c.query, !c.routed, c.routed)
+			ok = false
+		}
+	}
+
+	// Changes to the library are sent as new patches
+	sharer.ShareFile(messages.HitResult{FileIndex: 2, FileSize: 5, Filename: "goodbye.txt"})
+	sharer.UnshareFile(1, "Hello World.txt")
+	time.Sleep(time.Second)
+	for _, c := range []struct {
+		query  string
+		routed bool
+	}{
+		{"goodbye txt", true},
+		{"world", false},
+	} {
+		if search(c.query) != c.routed {
+			fmt.Printf("Query \"%s\" routed: %t... expected %t\n", c.query, !c.routed, c.routed)
+			ok = false
+		}
+	}
+	fmt.Printf("Route table patches: %t\n", ok)
+}
+
+func main() {
+	TestQRPHash()
+	TestQRPKeywords()
+	TestPatchMessages()
+	TestRouteTablePatches()
+}
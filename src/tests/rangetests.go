@@ -0,0 +1,118 @@
+package main
+
+import (
+	"../goteller"
+	"./fixtures"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var contents = []byte("0123456789abcdefghij")
+
+// Range headers are answered with the bytes asked for, the whole file if the
+// header can't be used, or 416 if the range is past the end
+func TestRangeRequests() {
+	sharer := fixtures.NewTeller("ranges")
+	fixtures.ServeBytes(sharer, contents)
+	fixtures.Start(sharer, 5750, []string{fixtures.LocalAddr(5751)})
+	ok := true
+	for _, c := range []struct {
+		spec         string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"bytes=2-5", 206, "bytes 2-5/20", "2345"},
+		{"bytes=15-", 206, "bytes 15-19/20", "fghij"},
+		{"bytes=-3", 206, "bytes 17-19/20", "hij"},
+		{"bytes=-30", 206, "bytes 0-19/20", string(contents)}, // Suffix longer than the file
+		{"bytes=18-40", 206, "bytes 18-19/20", "ij"},          // End past the file
+		{"bytes=19-19", 206, "bytes 19-19/20", "j"},           // Last byte
+		{"bytes=20-", 416, "bytes */20", ""},                  // Start past the file
+		{"bytes=-0", 416, "bytes */20", ""},                   // Empty suffix
+		{"bytes=5-2", 200, "", string(contents)},              // Backwards
+		{"bytes=1-2,4-5", 200, "", string(contents)},          // Several ranges
+		{"items=1-2", 200, "", string(contents)},              // Other unit
+		{"bytes=x-2", 200, "", string(contents)},              // Not a number
+		{"", 200, "", string(contents)},                       // No range
+	} {
+		req, _ := http.NewRequest("GET", "http://"+fixtures.LocalAddr(5750)+"/get/1/file.txt", nil)
+		if c.spec != "" {
+			req.Header.Set("Range", c.spec)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != c.status || res.Header.Get("Content-Range") != c.contentRange || string(body) != c.body {
+			fmt.Printf("Range \"%s\" got %d \"%s\" %q... expected %d \"%s\" %q\n", c.spec, res.StatusCode, res.Header.Get("Content-Range"), body, c.status, c.contentRange, c.body)
+			ok = false
+		}
+	}
+	fmt.Printf("Range requests: %t\n", ok)
+}
+
+// A resumed download checks the Content-Range of the rest of the file, and a
+// swarmed one the Content-Range of every chunk
+func TestContentRanges() {
+	downloader := fixtures.Start(fixtures.NewTeller("downloader"), 5751, []string{fixtures.LocalAddr(5750)})
+	dir, err := ioutil.TempDir("", "rangetests")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	ok := true
+
+	path := filepath.Join(dir, "resumed.txt")
+	ioutil.WriteFile(path+goteller.PARTIAL_SUFFIX, contents[:12], 0644)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := downloader.Download(ctx, goteller.DownloadRequest{Addr: fixtures.LocalAddr(5750), FileIndex: 1, Filename: "file.txt", Path: path, Resume: true})
+	written, _ := ioutil.ReadFile(path)
+	if err != nil || result.Offset != 12 || result.Size != int64(len(contents)) || !bytes.Equal(written, contents) {
+		fmt.Printf("Resumed download: %v %+v %q\n", err, result, written)
+		ok = false
+	}
+
+	var buffer fixtures.WriterAt
+	source := goteller.DownloadSource{Addr: fixtures.LocalAddr(5750), FileIndex: 1, Filename: "file.txt"}
+	_, err = downloader.SwarmDownload(ctx, goteller.SwarmRequest{
+		Sources:   []goteller.DownloadSource{source},
+		Size:      int64(len(contents)),
+		Writer:    &buffer,
+		ChunkSize: 3,
+	})
+	if err != nil || !bytes.Equal(buffer.Data, contents) {
+		fmt.Printf("Swarmed download: %v %q\n", err, buffer.Data)
+		ok = false
+	}
+
+	// Chunks whose Content-Range doesn't give the file's length fail
+	_, err = downloader.SwarmDownload(ctx, goteller.SwarmRequest{
+		Sources:   []goteller.DownloadSource{source},
+		Size:      int64(len(contents)) + 1,
+		Writer:    &fixtures.WriterAt{},
+		ChunkSize: 3,
+	})
+	if err == nil {
+		fmt.Println("Swarmed download of the wrong length succeeded")
+		ok = false
+	}
+	fmt.Printf("Content ranges: %t\n", ok)
+}
+
+func main() {
+	TestRangeRequests()
+	TestContentRanges()
+}
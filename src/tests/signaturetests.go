@@ -0,0 +1,129 @@
+package main
+
+import (
+	"../messages"
+	"./fixtures"
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+)
+
+func hitToSign() messages.QueryHitMsg {
+	queryHit := messages.QueryHitMsg{NumHits: 2, Speed: 20, Addr: fixtures.MustAddr("10.0.0.1:6346")}
+	copy(queryHit.ServantID[:], []byte("sourabhdesai1993"))
+	queryHit.ResultSet = []messages.HitResult{
+		{FileIndex: 1, FileSize: 5, Filename: "hi.txt"},
+		{FileIndex: 2, FileSize: 7, Filename: "bye.txt", URN: "urn:sha1:PLSTHIPQGSSZTS5FJUPAKUZWUGYQYPFB"},
+	}
+	queryHit.ResultSet[1].SetGGEP(messages.GGEP{{ID: "ALT", Data: []byte{10, 0, 0, 2, 0xaa, 0x18}}})
+	trailer := messages.QHDTrailer{VendorCode: "GTLA", PrivateData: []byte("vendor")}
+	trailer.SetFlag(messages.EQHD_PUSH_FLAG, false)
+	trailer.GGEP.Set(messages.GGEP_TLS_ID, nil)
+	queryHit.Trailer = &trailer
+	return queryHit
+}
+
+// Returns the signer of a hit once sent over the network
+func parsedSigner(queryHit messages.QueryHitMsg, descID [16]byte) (ed25519.PublicKey, bool) {
+	parsed, err := messages.ParseQueryHitBytes(queryHit.ToBytes())
+	if err != nil {
+		fmt.Println(err)
+		return nil, false
+	}
+	return parsed.Signer(descID)
+}
+
+func TestSigner() {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var descID [16]byte
+	copy(descID[:], "query descriptor")
+	queryHit := hitToSign()
+	unsigned := queryHit.Trailer
+	queryHit.Sign(descID, private)
+	signer, ok := parsedSigner(queryHit, descID)
+	ok = ok && bytes.Equal(signer, public) && !unsigned.GGEP.Has(messages.GGEP_SIG_ID) // Sign copies the trailer
+
+	// The network tag is added after signing
+	tagged := queryHit
+	trailer := *queryHit.Trailer
+	trailer.GGEP = append(messages.GGEP(nil), trailer.GGEP...)
+	trailer.GGEP.Set(messages.GGEP_NETWORK_TAG_ID, []byte("tag"))
+	tagged.Trailer = &trailer
+	if _, tagOk := parsedSigner(tagged, descID); !tagOk {
+		fmt.Println("Network tag broke the signature")
+		ok = false
+	}
+
+	otherID := descID
+	otherID[0]++
+	if _, idOk := parsedSigner(queryHit, otherID); idOk {
+		fmt.Println("Signature verified for another query")
+		ok = false
+	}
+
+	// Changing any signed part of the hit breaks the signature
+	tampers := map[string]func(*messages.QueryHitMsg){
+		"filename": func(hit *messages.QueryHitMsg) { hit.ResultSet[0].Filename = "ho.txt" },
+		"size":     func(hit *messages.QueryHitMsg) { hit.ResultSet[1].FileSize++ },
+		"urn":      func(hit *messages.QueryHitMsg) { hit.ResultSet[1].URN = "" },
+		"address":  func(hit *messages.QueryHitMsg) { hit.Addr.Port++ },
+		"push":     func(hit *messages.QueryHitMsg) { hit.Trailer.SetFlag(messages.EQHD_PUSH_FLAG, true) },
+		"busy":     func(hit *messages.QueryHitMsg) { hit.Trailer.SetFlag(messages.EQHD_BUSY_FLAG, false) },
+		"vendor":   func(hit *messages.QueryHitMsg) { hit.Trailer.VendorCode = "LIME" },
+		"private":  func(hit *messages.QueryHitMsg) { hit.Trailer.PrivateData = []byte("vendoR") },
+		"ggep":     func(hit *messages.QueryHitMsg) { hit.Trailer.GGEP.Remove(messages.GGEP_TLS_ID) },
+		"speed":    func(hit *messages.QueryHitMsg) { hit.Speed++ },
+		"result ggep": func(hit *messages.QueryHitMsg) {
+			hit.ResultSet[1].SetGGEP(messages.GGEP{{ID: "ALT", Data: []byte{10, 0, 0, 3, 0xaa, 0x18}}})
+		},
+		"added result ggep": func(hit *messages.QueryHitMsg) {
+			hit.ResultSet[0].SetGGEP(messages.GGEP{{ID: "ALT", Data: []byte{10, 0, 0, 3, 0xaa, 0x18}}})
+		},
+		"removed result ggep": func(hit *messages.QueryHitMsg) { hit.ResultSet[1].SetGGEP(nil) },
+	}
+	for name, tamper := range tampers {
+		tampered, err := messages.ParseQueryHitBytes(queryHit.ToBytes())
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+			continue
+		}
+		tamper(tampered)
+		if _, tamperOk := tampered.Signer(descID); tamperOk {
+			fmt.Printf("Signature verified after changing the %s\n", name)
+			ok = false
+		}
+	}
+
+	unsignedHit := hitToSign()
+	if _, unsignedOk := unsignedHit.Signer(descID); unsignedOk {
+		fmt.Println("Unsigned hit has a signer")
+		ok = false
+	}
+	fmt.Printf("Signer: %t\n", ok)
+}
+
+// The signed bytes leave out the signature itself
+func TestSignedBytes() {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var descID [16]byte
+	queryHit := hitToSign()
+	before := queryHit.SignedBytes(descID)
+	queryHit.Sign(descID, private)
+	after := queryHit.SignedBytes(descID)
+	ok := bytes.Equal(before, after) && queryHit.Trailer.GGEP.Has(messages.GGEP_SIG_ID)
+	fmt.Printf("SignedBytes: %t\n", ok)
+}
+
+func main() {
+	TestSigner()
+	TestSignedBytes()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"../goteller"
+	"../messages"
+	"./fixtures"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var contents = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+// Same size, different bytes
+var otherContents = bytes.Repeat([]byte("fedcba9876543210"), 4096)
+
+func sources(ports ...uint16) []goteller.DownloadSource {
+	var sources []goteller.DownloadSource
+	for _, port := range ports {
+		sources = append(sources, goteller.DownloadSource{Addr: fixtures.LocalAddr(port), FileIndex: 1, Filename: "file.txt", Size: int64(len(contents))})
+	}
+	return sources
+}
+
+func TestSwarmURNs() {
+	for i, served := range [][]byte{contents, contents, otherContents} {
+		sharer := fixtures.NewTeller(fmt.Sprintf("sharer%d", i))
+		fixtures.ServeBytes(sharer, served)
+		fixtures.Start(sharer, 5780+uint16(i), []string{fixtures.LocalAddr(5783)})
+	}
+	downloader := fixtures.Start(fixtures.NewTeller("downloader"), 5783, []string{fixtures.LocalAddr(5780)})
+	dir, err := ioutil.TempDir("", "swarmtests")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sum := sha1.Sum(contents)
+	urn := messages.SHA1URN(sum[:])
+	ok := true
+
+	path := filepath.Join(dir, "same.txt")
+	_, err = downloader.SwarmDownload(ctx, goteller.SwarmRequest{Sources: sources(5780, 5781), Size: int64(len(contents)), URN: urn, Path: path, ChunkSize: 4096})
+	written, _ := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(written, contents) {
+		fmt.Printf("Swarm of the same file: %v\n", err)
+		ok = false
+	}
+
+	// Several sources need a URN to check the assembled file against
+	for name, sreq := range map[string]goteller.SwarmRequest{
+		"without a URN":         {Sources: sources(5780, 5781), Size: int64(len(contents)), Path: filepath.Join(dir, "nourn.txt")},
+		"with a source's URN":   {Sources: append(sources(5780), goteller.DownloadSource{Addr: fixtures.LocalAddr(5781), URN: "urn:sha1:PLSTHIPQGSSZTS5FJUPAKUZWUGYQYPFB"}), Size: int64(len(contents)), URN: urn, Path: filepath.Join(dir, "other.txt")},
+		"to an unreadable file": {Sources: sources(5780, 5781), Size: int64(len(contents)), URN: urn, Writer: &fixtures.WriterAt{}},
+	} {
+		if _, err := downloader.SwarmDownload(ctx, sreq); err == nil {
+			fmt.Printf("Swarm %s succeeded\n", name)
+			ok = false
+		}
+	}
+
+	// A source sharing other bytes under the same name and size is caught once
+	// the file is assembled
+	path = filepath.Join(dir, "mixed.txt")
+	_, err = downloader.SwarmDownload(ctx, goteller.SwarmRequest{Sources: sources(5780, 5782), Size: int64(len(contents)), URN: urn, Path: path, ChunkSize: 4096})
+	if _, statErr := os.Stat(path); err == nil || statErr == nil {
+		fmt.Printf("Swarm with a different file: %v\n", err)
+		ok = false
+	}
+	fmt.Printf("Swarm URNs: %t\n", ok)
+}
+
+func main() {
+	TestSwarmURNs()
+}
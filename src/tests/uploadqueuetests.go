@@ -0,0 +1,125 @@
+package main
+
+import (
+	"../goteller"
+	"./fixtures"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Asks for a file, sending an X-Queued header if queued isn't empty. Returns
+// the response's status and X-Queued header.
+func request(path string, queued string) (int, string) {
+	req, _ := http.NewRequest("GET", "http://"+fixtures.LocalAddr(5760)+path, nil)
+	req.Close = true
+	req.Header.Set("X-Queue", goteller.PARQ_VERSION)
+	if queued != "" {
+		req.Header.Set("X-Queued", queued)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return 0, ""
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("X-Queued")
+}
+
+// Returns the ID field of an X-Queued header
+func queuedID(queued string) string {
+	for _, field := range strings.Split(queued, ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "ID=") {
+			return field[len("ID="):]
+		}
+	}
+	return ""
+}
+
+func queueIDs(teller *goteller.GoTeller) []string {
+	var ids []string
+	for _, entry := range teller.UploadQueue() {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+// A downloader keeps its place in the queue by sending back its ID, wherever it
+// is in the X-Queued header and however the field name is written
+func TestQueuedIDs() {
+	teller := fixtures.NewTeller("uploader")
+	teller.UploadSlots = 1
+	// The first upload is held until the pipe is written to
+	pipeReader, pipeWriter := io.Pipe()
+	teller.OnRequest(func(fileIndex uint32, filename string) (io.ReadCloser, int64) {
+		if filename == "held.txt" {
+			return pipeReader, 5
+		}
+		return ioutil.NopCloser(strings.NewReader("hello")), 5
+	})
+	fixtures.Start(teller, 5760, []string{fixtures.LocalAddr(5761)}) // The neighbor is never started
+
+	conn, err := net.Dial("tcp", fixtures.LocalAddr(5760))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /get/1/held.txt HTTP/1.1\r\nHost: %s\r\n\r\n", fixtures.LocalAddr(5760))
+	time.Sleep(100 * time.Millisecond)
+	ok := teller.ActiveUploads() == 1
+
+	status, queued := request("/get/2/queued.txt", "")
+	id := queuedID(queued)
+	if status != http.StatusServiceUnavailable || id == "" {
+		fmt.Printf("First queued request got %d \"%s\"\n", status, queued)
+		ok = false
+	}
+	for _, header := range []string{
+		"ID=" + id,
+		"position=1; length=1; ID=" + id,
+		"id=" + id + "; position=1",
+		" Id=" + id + " ;retry=30",
+	} {
+		status, queued = request("/get/2/queued.txt", header)
+		if status != http.StatusServiceUnavailable || queuedID(queued) != id || fmt.Sprint(queueIDs(teller)) != fmt.Sprint([]string{id}) {
+			fmt.Printf("X-Queued \"%s\" got %d \"%s\"... expected ID %s\n", header, status, queued, id)
+			ok = false
+		}
+	}
+
+	// Unknown IDs are new requests, even for a file already queued
+	status, queued = request("/get/2/queued.txt", "ID=0123456789ABCDEF")
+	other := queuedID(queued)
+	if status != http.StatusServiceUnavailable || other == "" || other == id || len(teller.UploadQueue()) != 2 {
+		fmt.Printf("Unknown ID got %d \"%s\" with %d queued\n", status, queued, len(teller.UploadQueue()))
+		ok = false
+	}
+
+	// Once the slot is free the first queued request gets it
+	pipeWriter.Write([]byte("hello"))
+	pipeWriter.Close()
+	ioutil.ReadAll(conn)
+	time.Sleep(100 * time.Millisecond)
+	status, _ = request("/get/2/queued.txt", "ID="+other)
+	if status != http.StatusServiceUnavailable {
+		fmt.Printf("Second in the queue got %d\n", status)
+		ok = false
+	}
+	status, _ = request("/get/2/queued.txt", "position=1; ID="+id)
+	if status != http.StatusOK || fmt.Sprint(queueIDs(teller)) != fmt.Sprint([]string{other}) {
+		fmt.Printf("First in the queue got %d with %v queued\n", status, queueIDs(teller))
+		ok = false
+	}
+	fmt.Printf("Queued IDs: %t\n", ok)
+}
+
+func main() {
+	TestQueuedIDs()
+}
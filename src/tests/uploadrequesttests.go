@@ -0,0 +1,81 @@
+package main
+
+import (
+	"../goteller"
+	"./fixtures"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A body that records whether it was closed
+type trackedBody struct {
+	*bytes.Reader
+	mutex  sync.Mutex
+	closed bool
+}
+
+func (body *trackedBody) Close() error {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	body.closed = true
+	return nil
+}
+
+func (body *trackedBody) wasClosed() bool {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	return body.closed
+}
+
+// Bodies given by the OnUploadRequest callback are closed once the response is
+// sent, whether they are empty, served or refused
+func TestUploadBodiesClosed() {
+	var mutex sync.Mutex
+	var body *trackedBody
+	var status int
+	teller := fixtures.NewTeller("uploader")
+	teller.OnUploadRequest(func(req *goteller.UploadRequest) *goteller.UploadResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return &goteller.UploadResponse{StatusCode: status, Body: body}
+	})
+	fixtures.Start(teller, 5800, []string{fixtures.LocalAddr(5801)}) // The neighbor is never started
+
+	ok := true
+	for _, c := range []struct {
+		name     string
+		contents string
+		status   int
+	}{
+		{"Empty", "", http.StatusOK},
+		{"Served", "hello", http.StatusOK},
+		{"Refused", "hello", http.StatusForbidden},
+	} {
+		mutex.Lock()
+		body = &trackedBody{Reader: bytes.NewReader([]byte(c.contents))}
+		status = c.status
+		mutex.Unlock()
+		res, err := http.Get("http://" + fixtures.LocalAddr(5800) + "/get/1/file.txt")
+		if err != nil {
+			fmt.Println(err)
+			ok = false
+			continue
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		time.Sleep(100 * time.Millisecond)
+		if res.StatusCode != c.status || !body.wasClosed() {
+			fmt.Printf("%s body got %d and closed: %t... expected %d and true\n", c.name, res.StatusCode, body.wasClosed(), c.status)
+			ok = false
+		}
+	}
+	fmt.Printf("Upload bodies closed: %t\n", ok)
+}
+
+func main() {
+	TestUploadBodiesClosed()
+}